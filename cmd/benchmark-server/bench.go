@@ -18,6 +18,7 @@ var (
 	n           = flag.Int("n", 1000, "Number of interactsh sessions to register")
 	concurrency = flag.Int("c", 300, "Number of concurrent requests to send")
 	token       = flag.String("token", "gg", "Authentication token for the server")
+	keyType     = flag.String("key-type", "rsa", "Key type used to register sessions (rsa, x25519)")
 )
 
 var (
@@ -55,6 +56,7 @@ func benchmarkServer() {
 		ServerURL:         *serverURL,
 		PersistentSession: false,
 		Token:             *token,
+		KeyType:           *keyType,
 	})
 	if err != nil {
 		errors++
@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/projectdiscovery/gologger"
 	"github.com/projectdiscovery/interactsh/pkg/client"
 	"github.com/projectdiscovery/interactsh/pkg/server"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
 )
 
 const banner = `
@@ -44,6 +46,11 @@ func main() {
 	httpOnly := flag.Bool("http-only", false, "Display only http interaction in CLI output")
 	smtpOnly := flag.Bool("smtp-only", false, "Display only smtp interactions in CLI output")
 	token := flag.String("token", "", "Authentication token to connect interactsh server")
+	keyType := flag.String("key-type", "rsa", "Key type used to register the session (rsa, x25519)")
+	sessionTTL := flag.Int("session-ttl", 0, "Requested session lifetime in hours (0 = server maximum)")
+	slidingExpiry := flag.Bool("sliding-expiry", false, "Refresh the session lifetime on each poll")
+	noStream := flag.Bool("no-stream", false, "Poll the server instead of receiving interactions from its event stream")
+	shared := flag.String("shared", "token,tld", "Shared streams of interactions to receive from the server (token,tld)")
 
 	flag.Parse()
 
@@ -62,6 +69,15 @@ func main() {
 		ServerURL:         *serverURL,
 		PersistentSession: *persistent,
 		Token:             *token,
+		KeyType:           *keyType,
+		SessionTTL:        time.Duration(*sessionTTL) * time.Hour,
+		SlidingExpiry:     *slidingExpiry,
+		DisableStreaming:  *noStream,
+		SharedStreams:     strings.Split(*shared, ","),
+		OnSessionEvicted: func(reason storage.EvictionReason) bool {
+			gologger.Warning().Msgf("Session was evicted by the server (%s), registering again\n", reason)
+			return true
+		},
 	})
 	if err != nil {
 		gologger.Fatal().Msgf("Could not create client: %s\n", err)
@@ -12,6 +12,8 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/projectdiscovery/gologger"
@@ -22,23 +24,50 @@ import (
 )
 
 func main() {
-	var eviction int
-	var debug, smb, responder bool
+	var eviction, sharedRetention, sessionMaxInteractions, sessionMaxSize, maxStorageSize, pollMaxSize, pollMaxWait int
+	var debug, smb, responder, disk bool
+	var diskPath, dropPolicy, exportState, importState, stateKey, tokensFile, recordsFile string
+	var dnsListen, httpListen, httpsListen, smtpListen, smtpsListen, disable string
 
 	options := &server.Options{}
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flag.BoolVar(&debug, "debug", false, "Run interactsh in debug mode")
 	flag.StringVar(&options.Domain, "domain", "", "Domain to use for interactsh server")
 	flag.StringVar(&options.IPAddress, "ip", "", "Public IP Address to use for interactsh server")
+	flag.StringVar(&options.IPv6Address, "ipv6", "", "Public IPv6 Address to use for interactsh server")
 	flag.StringVar(&options.ListenIP, "listen-ip", "0.0.0.0", "Public IP Address to listen on")
+	flag.StringVar(&options.ListenIPv6, "listen-ipv6", "", "Public IPv6 Address to listen on (default :: if ipv6 is set)")
+	flag.StringVar(&dnsListen, "dns-listen", ":53", "Comma separated addresses of the dns listeners (udp and tcp), on the listen ip without host")
+	flag.StringVar(&httpListen, "http-listen", ":80", "Comma separated addresses of the http listeners, on the listen ip without host")
+	flag.StringVar(&httpsListen, "https-listen", ":443", "Comma separated addresses of the https listeners, on the listen ip without host")
+	flag.StringVar(&smtpListen, "smtp-listen", ":25,:587", "Comma separated addresses of the smtp listeners, on the listen ip without host")
+	flag.StringVar(&smtpsListen, "smtps-listen", ":465", "Comma separated addresses of the smtps listeners, on the listen ip without host")
+	flag.StringVar(&disable, "disable", "", "Comma separated protocols to disable (dns,http,https,smtp,smtps)")
 	flag.StringVar(&options.Hostmaster, "hostmaster", "", "Hostmaster email to use for interactsh server")
-	flag.IntVar(&eviction, "eviction", 30, "Number of days to persist interactions for")
+	flag.IntVar(&eviction, "eviction", 30, "Number of days to persist interactions for (maximum session lifetime)")
+	flag.BoolVar(&disk, "disk", false, "Persist sessions and interactions to disk across restarts")
+	flag.StringVar(&diskPath, "disk-path", "interactsh.db", "Path of the database file used for disk storage")
+	flag.IntVar(&sessionMaxInteractions, "session-max-interactions", 0, "Maximum number of pending interactions per session (0 = unlimited)")
+	flag.IntVar(&sessionMaxSize, "session-max-size", 0, "Maximum size in MB of the pending interactions per session (0 = unlimited)")
+	flag.IntVar(&maxStorageSize, "max-storage-size", 0, "Maximum size in MB of the pending interactions of all sessions (0 = unlimited)")
+	flag.StringVar(&dropPolicy, "drop-policy", "oldest", "Policy to drop interactions once a session quota is exceeded (oldest,newest,sample)")
+	flag.IntVar(&options.PollMaxInteractions, "poll-max-interactions", 1000, "Maximum number of interactions returned by a poll (0 = unlimited)")
+	flag.IntVar(&pollMaxSize, "poll-max-size", 10, "Maximum size in MB of the interactions returned by a poll (0 = unlimited)")
+	flag.IntVar(&pollMaxWait, "poll-max-wait", 60, "Maximum number of seconds a long poll waits for interactions (0 = disabled)")
+	flag.BoolVar(&options.Webhooks, "webhook", false, "Deliver interactions to the webhook URL registered by sessions")
+	flag.IntVar(&options.WebhookQueueSize, "webhook-queue-size", 1000, "Maximum number of sessions waiting for a webhook delivery")
+	flag.IntVar(&sharedRetention, "shared-retention", 24, "Number of hours to keep smb, responder and root-tld interactions for all clients (0 = until dropped by quota)")
+	flag.StringVar(&exportState, "export-state", "", "Export sessions and interactions to the encrypted state file on shutdown")
+	flag.StringVar(&importState, "import-state", "", "Import sessions and interactions from the encrypted state file at startup, skipping already registered sessions")
+	flag.StringVar(&stateKey, "state-key", os.Getenv("INTERACTSH_STATE_KEY"), "Key used to encrypt the state file and the session keys of the disk storage (default $INTERACTSH_STATE_KEY)")
 	flag.BoolVar(&responder, "responder", false, "Start a responder agent - docker must be installed")
 	flag.BoolVar(&smb, "smb", false, "Start a smb agent - impacket and python 3 must be installed")
 	flag.BoolVar(&options.Auth, "auth", false, "Enable authentication to server using random generated token")
 	flag.StringVar(&options.Token, "token", "", "Enable authentication to server using given token")
+	flag.StringVar(&tokensFile, "tokens", "", "Enable authentication to server using the named tokens with scopes of the YAML file")
 	flag.StringVar(&options.OriginURL, "origin-url", "https://app.interactsh.com", "Origin URL to send in ACAO Header")
 	flag.BoolVar(&options.RootTLD, "root-tld", false, "Enable wildcard/global interaction for *.domain.com")
+	flag.StringVar(&recordsFile, "records", "", "YAML file of static dns records served along with the default ones (reloaded on SIGHUP)")
 	flag.Parse()
 
 	if options.IPAddress == "" && options.ListenIP == "0.0.0.0" {
@@ -46,6 +75,38 @@ func main() {
 		options.IPAddress = ip
 		options.ListenIP = ip
 	}
+	// listeners are bound on both stacks once an ipv6 address is answered
+	if options.IPv6Address != "" && options.ListenIPv6 == "" {
+		options.ListenIPv6 = "::"
+	}
+	options.DNSListeners = splitList(dnsListen)
+	options.HTTPListeners = splitList(httpListen)
+	options.HTTPSListeners = splitList(httpsListen)
+	options.SMTPListeners = splitList(smtpListen)
+	options.SMTPSListeners = splitList(smtpsListen)
+	for _, protocol := range splitList(disable) {
+		switch protocol {
+		case "dns":
+			options.DNSListeners = []string{}
+		case "http":
+			options.HTTPListeners = []string{}
+		case "https":
+			options.HTTPSListeners = []string{}
+		case "smtp":
+			options.SMTPListeners = []string{}
+		case "smtps":
+			options.SMTPSListeners = []string{}
+		default:
+			gologger.Fatal().Msgf("Unknown protocol %s to disable\n", protocol)
+		}
+	}
+	if recordsFile != "" {
+		records, err := server.LoadRecordStore(recordsFile, options.Domain)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not load dns records: %s\n", err)
+		}
+		options.Records = records
+	}
 	if options.Hostmaster == "" {
 		options.Hostmaster = fmt.Sprintf("admin@%s", options.Domain)
 	}
@@ -76,6 +137,16 @@ func main() {
 		options.Auth = true
 	}
 
+	// or if named tokens are loaded from a file
+	if tokensFile != "" {
+		tokens, err := server.LoadTokenStore(tokensFile)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not load tokens: %s\n", err)
+		}
+		options.Tokens = tokens
+		options.Auth = true
+	}
+
 	if options.Auth && options.Token == "" {
 		b := make([]byte, 32)
 		if _, err := rand.Read(b); err != nil {
@@ -85,8 +156,56 @@ func main() {
 		log.Printf("Client Token: %s\n", options.Token)
 	}
 
-	store := storage.New(time.Duration(eviction) * time.Hour * 24)
+	policy, err := storage.ParseDropPolicy(dropPolicy)
+	if err != nil {
+		gologger.Fatal().Msgf("Could not parse drop policy: %s\n", err)
+	}
+	// the http server is notified of evicted sessions once created
+	var evictionHandler atomic.Value
+	storeOptions := &storage.Options{
+		EvictionTTL:     time.Duration(eviction) * time.Hour * 24,
+		SharedRetention: time.Duration(sharedRetention) * time.Hour,
+		Quota: storage.Quota{
+			MaxInteractions: sessionMaxInteractions,
+			MaxBytes:        int64(sessionMaxSize) * 1024 * 1024,
+			MaxTotalBytes:   int64(maxStorageSize) * 1024 * 1024,
+			DropPolicy:      policy,
+		},
+		OnEviction: func(event *storage.EvictionEvent) {
+			gologger.Debug().Msgf("Session %s was evicted (%s)\n", event.CorrelationID, event.Reason)
+			if httpServer, ok := evictionHandler.Load().(*server.HTTPServer); ok {
+				httpServer.SessionEvicted(event)
+			}
+		},
+		StateKey: stateKey,
+	}
+	var store storage.Backend
+	if disk {
+		if stateKey == "" {
+			gologger.Warning().Msgf("No state key provided, sessions of the disk storage will not survive restarts\n")
+		}
+		diskStore, err := storage.NewDisk(diskPath, storeOptions)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create disk storage: %s\n", err)
+		}
+		store = diskStore
+	} else {
+		store = storage.NewWithOptions(storeOptions)
+	}
 	options.Storage = store
+	options.PollMaxSize = int64(pollMaxSize) * 1024 * 1024
+	options.PollMaxWait = time.Duration(pollMaxWait) * time.Second
+	options.SharedRetention = storeOptions.SharedRetention
+	options.Metrics = server.NewMetrics()
+
+	if importState != "" {
+		if err := importStateFile(store, importState, stateKey); err != nil {
+			gologger.Fatal().Msgf("Could not import state: %s\n", err)
+		}
+	}
+	if exportState != "" && stateKey == "" {
+		gologger.Fatal().Msgf("No state key provided to export state\n")
+	}
 
 	if options.Auth {
 		_ = options.Storage.SetID(options.Token)
@@ -97,32 +216,50 @@ func main() {
 		_ = store.SetID(options.Domain)
 	}
 
-	dnsServer, err := server.NewDNSServer(options)
-	if err != nil {
-		gologger.Fatal().Msgf("Could not create DNS server")
+	var dnsServer *server.DNSServer
+	if len(options.DNSListeners) > 0 {
+		dnsServer, err = server.NewDNSServer(options)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create DNS server: %s\n", err)
+		}
+		go dnsServer.ListenAndServe()
 	}
-	go dnsServer.ListenAndServe()
 
-	trimmedDomain := strings.TrimSuffix(options.Domain, ".")
-	autoTLS, err := acme.NewAutomaticTLS(options.Hostmaster, fmt.Sprintf("*.%s,%s", trimmedDomain, trimmedDomain), func(txt string) {
-		dnsServer.TxtRecord = txt
-	})
-	if err != nil {
-		gologger.Warning().Msgf("An error occurred while applying for an certificate, error: %v", err)
-		gologger.Warning().Msgf("Could not generate certs for auto TLS, https will be disabled")
+	// the certificates are issued with dns challenges answered by the dns server
+	var autoTLS *acme.AutoTLS
+	if len(options.HTTPSListeners) > 0 || len(options.SMTPSListeners) > 0 {
+		if dnsServer == nil {
+			gologger.Warning().Msgf("Could not generate certs for auto TLS without the DNS server, https and smtps will be disabled")
+		} else {
+			trimmedDomain := strings.TrimSuffix(options.Domain, ".")
+			autoTLS, err = acme.NewAutomaticTLS(options.Hostmaster, fmt.Sprintf("*.%s,%s", trimmedDomain, trimmedDomain), func(txt string) {
+				dnsServer.TxtRecord = txt
+			})
+			if err != nil {
+				gologger.Warning().Msgf("An error occurred while applying for an certificate, error: %v", err)
+				gologger.Warning().Msgf("Could not generate certs for auto TLS, https will be disabled")
+			}
+		}
 	}
 
-	httpServer, err := server.NewHTTPServer(options)
-	if err != nil {
-		gologger.Fatal().Msgf("Could not create HTTP server")
+	if len(options.HTTPListeners) > 0 || len(options.HTTPSListeners) > 0 {
+		httpServer, err := server.NewHTTPServer(options)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create HTTP server: %s\n", err)
+		}
+		evictionHandler.Store(httpServer)
+		go httpServer.ListenAndServe(autoTLS)
+	} else {
+		gologger.Warning().Msgf("HTTP and HTTPS are disabled, clients can't register or poll interactions")
 	}
-	go httpServer.ListenAndServe(autoTLS)
 
-	smtpServer, err := server.NewSMTPServer(options)
-	if err != nil {
-		gologger.Fatal().Msgf("Could not create SMTP server")
+	if len(options.SMTPListeners) > 0 || len(options.SMTPSListeners) > 0 {
+		smtpServer, err := server.NewSMTPServer(options)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create SMTP server: %s\n", err)
+		}
+		go smtpServer.ListenAndServe(autoTLS)
 	}
-	go smtpServer.ListenAndServe(autoTLS)
 
 	if responder {
 		responderServer, err := server.NewResponderServer(options)
@@ -144,13 +281,85 @@ func main() {
 
 	log.Printf("Listening on DNS, SMTP and HTTP ports\n")
 
+	// the records file is reloaded on SIGHUP
+	if recordsFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := options.Records.Reload(); err != nil {
+					gologger.Error().Msgf("Could not reload dns records: %s\n", err)
+				} else {
+					gologger.Info().Msgf("Reloaded dns records from %s\n", recordsFile)
+				}
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	for range c {
+		if exportState != "" {
+			if err := exportStateFile(store, exportState, stateKey); err != nil {
+				gologger.Error().Msgf("Could not export state: %s\n", err)
+			}
+		}
+		_ = store.Close()
 		os.Exit(1)
 	}
 }
 
+// importStateFile imports the sessions of an encrypted state file into the storage.
+func importStateFile(store storage.Backend, path, key string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	snapshot, err := storage.ReadSnapshot(file, key)
+	if err != nil {
+		return err
+	}
+	if err := store.Import(snapshot); err != nil {
+		return err
+	}
+	log.Printf("Imported %d sessions from %s\n", len(snapshot.Sessions), path)
+	return nil
+}
+
+// exportStateFile exports the sessions of the storage to an encrypted state file.
+func exportStateFile(store storage.Backend, path, key string) error {
+	snapshot, err := store.Export()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteSnapshot(file, snapshot, key); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d sessions to %s\n", len(snapshot.Sessions), path)
+	return nil
+}
+
+// splitList returns the non-empty items of a comma separated flag value.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 type noopWriter struct{}
 
 func (n *noopWriter) Write(data []byte, level levels.Level) {}
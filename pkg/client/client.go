@@ -1,9 +1,12 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -16,6 +19,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -25,13 +29,24 @@ import (
 	"github.com/pkg/errors"
 	"github.com/projectdiscovery/gologger"
 	"github.com/projectdiscovery/interactsh/pkg/server"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
 	"github.com/projectdiscovery/retryablehttp-go"
 	"github.com/rs/xid"
+	"golang.org/x/crypto/nacl/box"
 	"gopkg.in/corvus-ch/zbase32.v1"
 )
 
 var authError = errors.New("couldn't authenticate to the server")
 
+// ErrSessionEvicted is returned by polls for a session evicted by the server.
+var ErrSessionEvicted = errors.New("session was evicted by the server")
+
+// longPollWait is the wait of long polls, below the timeout of the poll client.
+const longPollWait = 20 * time.Second
+
+// errStreamUnsupported is returned for servers without event streams.
+var errStreamUnsupported = errors.New("server does not support event streams")
+
 var objectIDCounter = uint32(0)
 
 // Client is a client for communicating with interactsh server instance.
@@ -41,9 +56,30 @@ type Client struct {
 	serverURL         *url.URL
 	httpClient        *retryablehttp.Client
 	privKey           *rsa.PrivateKey
+	x25519PublicKey   *[32]byte
+	x25519PrivateKey  *[32]byte
+	keyType           string
+	publicKey         string
+	onSessionEvicted  SessionEvictedCallback
+	sessionTTL        time.Duration
+	slidingExpiry     bool
+	filter            *storage.Filter
+	disableStreaming  bool
+	webhook           string
+	sharedStreams     []string
 	quitChan          chan struct{}
 	persistentSession bool
 	token             string
+	// cursor is the sequence number of the last received interaction which
+	// is acknowledged to the server on the next poll.
+	cursor uint64
+	// dropped is the last number of interactions dropped by the server.
+	dropped uint64
+	// maxWait is the maximum wait of long polls advertised by the server.
+	maxWait time.Duration
+	// tokenCursor and tldCursor are the cursors of the shared streams.
+	tokenCursor uint64
+	tldCursor   uint64
 }
 
 // Options contains configuration options for interactsh client
@@ -54,8 +90,35 @@ type Options struct {
 	PersistentSession bool
 	// Token if the server requires authentication
 	Token string
+	// KeyType is the type of key pair used to receive the session key,
+	// either rsa (default) or x25519 which is much faster to generate.
+	KeyType string
+	// SessionTTL is the requested lifetime of the session, the server maximum if unset.
+	SessionTTL time.Duration
+	// SlidingExpiry refreshes the expiry of the session on each poll.
+	SlidingExpiry bool
+	// OnSessionEvicted is called when the server has evicted the session.
+	OnSessionEvicted SessionEvictedCallback
+	// Filter selects the interactions returned by the server on each poll,
+	// the other ones are kept on the server for other clients of the session.
+	Filter *storage.Filter
+	// DisableStreaming polls the server each interval instead of receiving
+	// the interactions pushed by its event stream.
+	DisableStreaming bool
+	// Webhook is the URL the server posts the interactions of the session to,
+	// which are handled with HandleWebhook instead of polling the server.
+	Webhook string
+	// SharedStreams contains the shared streams of interactions received along
+	// with the ones of the session, server.SharedStreamToken for the ones of the
+	// smb and responder servers and server.SharedStreamTLD for the root tld.
+	SharedStreams []string
 }
 
+// SessionEvictedCallback is a callback function for a session evicted by the
+// server with the reason of the eviction if known. The session is registered
+// again with the same correlation-id if it returns true.
+type SessionEvictedCallback func(reason storage.EvictionReason) bool
+
 // New creates a new client instance based on provided options
 func New(options *Options) (*Client, error) {
 	parsed, err := url.Parse(options.ServerURL)
@@ -70,9 +133,30 @@ func New(options *Options) (*Client, error) {
 		persistentSession: options.PersistentSession,
 		httpClient:        retryablehttp.NewClient(retryablehttp.DefaultOptionsSingle),
 		token:             options.Token,
+		keyType:           options.KeyType,
+		sessionTTL:        options.SessionTTL,
+		slidingExpiry:     options.SlidingExpiry,
+		onSessionEvicted:  options.OnSessionEvicted,
+		filter:            options.Filter,
+		disableStreaming:  options.DisableStreaming,
+		webhook:           options.Webhook,
+		sharedStreams:     options.SharedStreams,
+	}
+	// Generate a Public / Private key for interactsh client
+	var publicKey string
+	switch options.KeyType {
+	case "", storage.KeyTypeRSA:
+		publicKey, err = client.generateRSAKeyPair()
+	case storage.KeyTypeX25519:
+		publicKey, err = client.generateX25519KeyPair()
+	default:
+		err = fmt.Errorf("unsupported key type %s", options.KeyType)
+	}
+	if err != nil {
+		return nil, err
 	}
-	// Generate an RSA Public / Private key for interactsh client
-	if err := client.generateRSAKeyPair(); err != nil {
+	client.publicKey = publicKey
+	if err := client.register(); err != nil {
 		return nil, err
 	}
 	return client, nil
@@ -83,17 +167,41 @@ type InteractionCallback func(*server.Interaction)
 
 // StartPolling starts polling the server each duration and returns any events
 // that may have been captured by the collaborator server.
+//
+// Interactions are pushed by the event stream of the server as soon as they
+// are captured if it is supported, the stream being reconnected each duration
+// once closed. Otherwise the server is polled each duration, or continuously
+// with long polls if the server supports them.
 func (c *Client) StartPolling(duration time.Duration, callback InteractionCallback) {
 	ticker := time.NewTicker(duration)
 	c.quitChan = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
+		<-c.quitChan
+		cancel()
+	}()
+	go func() {
+		streaming := !c.disableStreaming
 		for {
+			var err error
+			if streaming {
+				if err = c.streamInteractions(ctx, callback); err == errStreamUnsupported {
+					gologger.Debug().Msgf("Falling back to polling: %s\n", err)
+					streaming = false
+				}
+			} else {
+				err = c.getInteractions(ctx, callback)
+				// long polls return as soon as interactions are captured so they are chained
+				for err == nil && c.maxWait > 0 && ctx.Err() == nil {
+					err = c.getInteractions(ctx, callback)
+				}
+			}
+			if err != nil && err.Error() == authError.Error() {
+				gologger.Fatal().Msgf("Could not authenticate to the server")
+			}
+
 			select {
 			case <-ticker.C:
-				err := c.getInteractions(callback)
-				if err != nil && err.Error() == authError.Error() {
-					gologger.Fatal().Msgf("Could not authenticate to the server")
-				}
 			case <-c.quitChan:
 				ticker.Stop()
 				return
@@ -102,18 +210,75 @@ func (c *Client) StartPolling(duration time.Duration, callback InteractionCallba
 	}()
 }
 
-// getInteractions returns the interactions from the server.
-func (c *Client) getInteractions(callback InteractionCallback) error {
+// writeFilter writes the query parameters of a poll filter.
+func writeFilter(builder *strings.Builder, filter *storage.Filter) {
+	if len(filter.Protocols) > 0 {
+		builder.WriteString("&protocol=")
+		builder.WriteString(url.QueryEscape(strings.Join(filter.Protocols, ",")))
+	}
+	if !filter.Since.IsZero() {
+		builder.WriteString("&since=")
+		builder.WriteString(url.QueryEscape(filter.Since.Format(time.RFC3339Nano)))
+	}
+	if filter.FullIDPrefix != "" {
+		builder.WriteString("&full-id-prefix=")
+		builder.WriteString(url.QueryEscape(filter.FullIDPrefix))
+	}
+	if filter.Limit > 0 {
+		builder.WriteString("&limit=")
+		builder.WriteString(strconv.Itoa(filter.Limit))
+	}
+}
+
+// writeShared writes the query parameters of the shared streams of a poll.
+func writeShared(builder *strings.Builder, streams []string, tokenCursor, tldCursor uint64) {
+	builder.WriteString("&shared=")
+	builder.WriteString(url.QueryEscape(strings.Join(streams, ",")))
+	if tokenCursor > 0 {
+		builder.WriteString("&token-after=")
+		builder.WriteString(strconv.FormatUint(tokenCursor, 10))
+	}
+	if tldCursor > 0 {
+		builder.WriteString("&tld-after=")
+		builder.WriteString(strconv.FormatUint(tldCursor, 10))
+	}
+}
+
+// getInteractions returns the interactions from the server following
+// the pages of the response until all of them are received.
+func (c *Client) getInteractions(ctx context.Context, callback InteractionCallback) error {
+	for {
+		hasMore, err := c.getInteractionsPage(ctx, callback)
+		if err != nil || !hasMore {
+			return err
+		}
+	}
+}
+
+// getInteractionsPage returns a page of interactions from the server
+// acknowledging the previous ones, along with whether more are pending.
+func (c *Client) getInteractionsPage(ctx context.Context, callback InteractionCallback) (bool, error) {
 	builder := &strings.Builder{}
 	builder.WriteString(c.serverURL.String())
 	builder.WriteString("/poll?id=")
 	builder.WriteString(c.correlationID)
 	builder.WriteString("&secret=")
 	builder.WriteString(c.secretKey)
+	builder.WriteString("&after=")
+	builder.WriteString(strconv.FormatUint(c.cursor, 10))
+	writeShared(builder, c.sharedStreams, c.tokenCursor, c.tldCursor)
+	if c.filter != nil {
+		writeFilter(builder, c.filter)
+	}
+	if wait := c.longPollWait(); wait > 0 {
+		builder.WriteString("&wait=")
+		builder.WriteString(strconv.Itoa(int(wait / time.Second)))
+	}
 	req, err := retryablehttp.NewRequest("GET", builder.String(), nil)
 	if err != nil {
-		return err
+		return false, err
 	}
+	req.Request = req.Request.WithContext(ctx)
 
 	if c.token != "" {
 		req.Header.Add("Authorization", c.token)
@@ -127,22 +292,117 @@ func (c *Client) getInteractions(callback InteractionCallback) error {
 		}
 	}()
 	if err != nil {
-		return err
+		return false, err
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == http.StatusUnauthorized {
-			return authError
+			return false, authError
 		}
-		return errors.New("couldn't poll interactions")
+		if resp.StatusCode == http.StatusGone {
+			return false, c.sessionEvicted(resp.Body)
+		}
+		return false, errors.New("couldn't poll interactions")
 	}
 	response := &server.PollResponse{}
 	if err := jsoniter.NewDecoder(resp.Body).Decode(response); err != nil {
 		gologger.Error().Msgf("Could not decode interactions: %v\n", err)
+		return false, err
+	}
+	c.maxWait = time.Duration(response.MaxWait) * time.Second
+	c.handleResponse(response, callback)
+	return response.HasMore, nil
+}
+
+// longPollWait returns the wait of long polls, zero if the server doesn't support them.
+func (c *Client) longPollWait() time.Duration {
+	if c.maxWait > longPollWait {
+		return longPollWait
+	}
+	return c.maxWait
+}
+
+// streamInteractions receives the interactions pushed by the event stream of
+// the server until it is closed or polling is stopped.
+func (c *Client) streamInteractions(ctx context.Context, callback InteractionCallback) error {
+	builder := &strings.Builder{}
+	builder.WriteString(c.serverURL.String())
+	builder.WriteString("/events?id=")
+	builder.WriteString(c.correlationID)
+	builder.WriteString("&secret=")
+	builder.WriteString(c.secretKey)
+	builder.WriteString("&after=")
+	builder.WriteString(strconv.FormatUint(c.cursor, 10))
+	writeShared(builder, c.sharedStreams, c.tokenCursor, c.tldCursor)
+	if c.filter != nil {
+		writeFilter(builder, c.filter)
+	}
+	req, err := http.NewRequest("GET", builder.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if c.token != "" {
+		req.Header.Add("Authorization", c.token)
+	}
+
+	// the stream is long lived so it doesn't use the timeout of the poll client
+	httpClient := &http.Client{Transport: c.httpClient.HTTPClient.Transport}
+	resp, err := httpClient.Do(req)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return authError
+	case resp.StatusCode == http.StatusGone:
+		return c.sessionEvicted(resp.Body)
+	case resp.StatusCode == http.StatusNotFound:
+		return errStreamUnsupported
+	case resp.StatusCode != http.StatusOK:
+		return errors.Errorf("couldn't stream interactions, status code %d", resp.StatusCode)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		// older servers answer unknown paths with their default handler
+		return errStreamUnsupported
+	}
 
+	reader := bufio.NewReader(resp.Body)
+	data := &bytes.Buffer{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("data:")) {
+				data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+			}
+			continue
+		}
+		// a blank line dispatches the event
+		if data.Len() == 0 {
+			continue
+		}
+		response := &server.PollResponse{}
+		if err := jsoniter.Unmarshal(data.Bytes(), response); err != nil {
+			gologger.Error().Msgf("Could not decode interactions: %v\n", err)
+		} else {
+			c.handleResponse(response, callback)
+		}
+		data.Reset()
+	}
+}
+
+// handleResponse reports the interactions of a poll response and updates
+// the cursor to acknowledge them with.
+func (c *Client) handleResponse(response *server.PollResponse, callback InteractionCallback) {
 	for _, data := range response.Data {
-		plaintext, err := c.decryptMessage(response.AESKey, data)
+		plaintext, err := c.decryptMessage(response.Version, response.AESKey, data)
 		if err != nil {
 			gologger.Error().Msgf("Could not decrypt interaction: %v\n", err)
 			continue
@@ -155,7 +415,30 @@ func (c *Client) getInteractions(callback InteractionCallback) error {
 		callback(interaction)
 	}
 
-	for _, plaintext := range response.Extra {
+	handlePlaintext(response.Extra, callback)
+	// handle root-tld data if any
+	handlePlaintext(response.TLDData, callback)
+
+	if response.Dropped > c.dropped {
+		gologger.Warning().Msgf("Server dropped %d interactions because of the session quota\n", response.Dropped-c.dropped)
+		c.dropped = response.Dropped
+	}
+
+	// acknowledge the received interactions only once they were all handled
+	if response.Cursor > c.cursor {
+		c.cursor = response.Cursor
+	}
+	if response.TokenCursor > c.tokenCursor {
+		c.tokenCursor = response.TokenCursor
+	}
+	if response.TLDCursor > c.tldCursor {
+		c.tldCursor = response.TLDCursor
+	}
+}
+
+// handlePlaintext reports the unencrypted interactions of the auth token and root tld.
+func handlePlaintext(data []string, callback InteractionCallback) {
+	for _, plaintext := range data {
 		interaction := &server.Interaction{}
 		if err := jsoniter.UnmarshalFromString(plaintext, interaction); err != nil {
 			gologger.Error().Msgf("Could not unmarshal interaction data interaction: %v\n", err)
@@ -163,17 +446,62 @@ func (c *Client) getInteractions(callback InteractionCallback) error {
 		}
 		callback(interaction)
 	}
+}
 
-	// handle root-tld data if any
-	for _, data := range response.TLDData {
-		interaction := &server.Interaction{}
-		if err := jsoniter.UnmarshalFromString(data, interaction); err != nil {
-			gologger.Error().Msgf("Could not unmarshal interaction data interaction: %v\n", err)
-			continue
-		}
-		callback(interaction)
+// sessionEvicted handles a poll response for a session evicted by the server.
+func (c *Client) sessionEvicted(body io.Reader) error {
+	response := &server.ErrorResponse{}
+	if err := jsoniter.NewDecoder(body).Decode(response); err != nil {
+		return errors.New("couldn't poll interactions")
+	}
+	return c.pollError(response)
+}
+
+// pollError handles the error of a failed poll, registering the session again
+// if it was evicted by the server and the evicted callback allows it.
+func (c *Client) pollError(response *server.ErrorResponse) error {
+	if response.Code != server.ErrorCodeSessionEvicted {
+		return errors.New("couldn't poll interactions")
+	}
+	reason := storage.EvictionReason(response.Reason)
+	if c.onSessionEvicted == nil || !c.onSessionEvicted(reason) {
+		return ErrSessionEvicted
 	}
 
+	// interactions of the new session are numbered from the start
+	c.cursor, c.dropped = 0, 0
+	if err := c.register(); err != nil {
+		return errors.Wrap(err, "could not register evicted session")
+	}
+	return nil
+}
+
+// HandleWebhook verifies the signature of a webhook request posted by the
+// server and reports the interactions it contains.
+func (c *Client) HandleWebhook(req *http.Request, callback InteractionCallback) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return errors.Wrap(err, "could not read webhook request")
+	}
+	signature := server.SignWebhook(c.secretKey, body)
+	if !hmac.Equal([]byte(signature), []byte(req.Header.Get(server.WebhookSignatureHeader))) {
+		return errors.New("invalid webhook signature")
+	}
+	request := &server.WebhookRequest{}
+	if err := jsoniter.Unmarshal(body, request); err != nil {
+		return errors.Wrap(err, "could not decode webhook request")
+	}
+	if request.CorrelationID != c.correlationID {
+		return errors.New("webhook request is for another session")
+	}
+	c.handleResponse(&server.PollResponse{
+		Data:      request.Data,
+		AESKey:    request.AESKey,
+		Sequences: request.Sequences,
+		Cursor:    request.Cursor,
+		Version:   request.Version,
+		Dropped:   request.Dropped,
+	}, callback)
 	return nil
 }
 
@@ -223,31 +551,50 @@ func (c *Client) Close() error {
 }
 
 // generateRSAKeyPair generates an RSA public-private keypair and
-// registers the current client with the master server using the
-// provided RSA Public Key as well as Correlation Key.
-func (c *Client) generateRSAKeyPair() error {
+// returns the base64 encoded PEM RSA Public Key.
+func (c *Client) generateRSAKeyPair() (string, error) {
 	// Generate a 2048-bit private-key
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return errors.Wrap(err, "could not generate rsa private key")
+		return "", errors.Wrap(err, "could not generate rsa private key")
 	}
 	c.privKey = priv
 	pub := priv.Public()
 
 	pubkeyBytes, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
-		return errors.Wrap(err, "could not marshal public key")
+		return "", errors.Wrap(err, "could not marshal public key")
 	}
 	pubkeyPem := pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA PUBLIC KEY",
 		Bytes: pubkeyBytes,
 	})
+	return base64.StdEncoding.EncodeToString(pubkeyPem), nil
+}
 
-	encoded := base64.StdEncoding.EncodeToString(pubkeyPem)
+// generateX25519KeyPair generates an X25519 public-private keypair and
+// returns the base64 encoded raw X25519 Public Key.
+func (c *Client) generateX25519KeyPair() (string, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate x25519 private key")
+	}
+	c.x25519PublicKey, c.x25519PrivateKey = pub, priv
+	return base64.StdEncoding.EncodeToString(pub[:]), nil
+}
+
+// register registers the current client with the master server using
+// the Public Key as well as Correlation Key.
+func (c *Client) register() error {
 	register := server.RegisterRequest{
-		PublicKey:     encoded,
+		PublicKey:     c.publicKey,
+		KeyType:       c.keyType,
 		SecretKey:     c.secretKey,
 		CorrelationID: c.correlationID,
+		Version:       storage.CryptoVersionAEAD,
+		TTL:           int(c.sessionTTL / time.Second),
+		SlidingExpiry: c.slidingExpiry,
+		Webhook:       c.webhook,
 	}
 	data, err := jsoniter.Marshal(register)
 	if err != nil {
@@ -309,17 +656,29 @@ func (c *Client) URL() string {
 	return URL
 }
 
-// decryptMessage decrypts an AES-256-RSA-OAEP encrypted message to string
-func (c *Client) decryptMessage(key string, secureMessage string) ([]byte, error) {
+// decryptMessage decrypts an AES-256-RSA-OAEP encrypted message to string.
+//
+// Servers not supporting crypto versions fall back to the legacy
+// unauthenticated AES-CFB envelope, otherwise AES-GCM is used and
+// tampered messages are rejected.
+func (c *Client) decryptMessage(version int, key string, secureMessage string) ([]byte, error) {
 	decodedKey, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decrypt the key plaintext first
-	keyPlaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, c.privKey, decodedKey, nil)
-	if err != nil {
-		return nil, err
+	var keyPlaintext []byte
+	if c.keyType == storage.KeyTypeX25519 {
+		var ok bool
+		if keyPlaintext, ok = box.OpenAnonymous(nil, decodedKey, c.x25519PublicKey, c.x25519PrivateKey); !ok {
+			return nil, errors.New("could not open sealed key")
+		}
+	} else {
+		keyPlaintext, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, c.privKey, decodedKey, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	cipherText, err := base64.StdEncoding.DecodeString(secureMessage)
@@ -332,6 +691,22 @@ func (c *Client) decryptMessage(key string, secureMessage string) ([]byte, error
 		return nil, err
 	}
 
+	if version == storage.CryptoVersionAEAD {
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(cipherText) < gcm.NonceSize() {
+			return nil, errors.New("ciphertext nonce size is too small")
+		}
+		// Nonce is at the start of the Ciphertext
+		decoded, err := gcm.Open(nil, cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():], nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not authenticate message")
+		}
+		return decoded, nil
+	}
+
 	if len(cipherText) < aes.BlockSize {
 		return nil, errors.New("ciphertext block size is too small")
 	}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/projectdiscovery/interactsh/pkg/server"
+	"github.com/projectdiscovery/retryablehttp-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient creates a client of a test server without registering it.
+func newTestClient(t *testing.T, serverURL, correlationID string) *Client {
+	parsed, err := url.Parse(serverURL)
+	require.Nil(t, err, "could not parse server URL")
+	return &Client{
+		serverURL:     parsed,
+		correlationID: correlationID,
+		secretKey:     "secret",
+		httpClient:    retryablehttp.NewClient(retryablehttp.DefaultOptionsSingle),
+	}
+}
+
+func TestStreamInteractions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "text/event-stream", req.Header.Get("Accept"), "could not request event stream")
+		require.Equal(t, "3", req.URL.Query().Get("after"), "could not resume event stream")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		// comments are skipped, data lines are joined and lines may end with CRLF
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "id: 4\r\ndata: {\"extra\":[\"{\\\"protocol\\\":\\\"smb\\\"}\"],\r\ndata: \"cursor\":4}\r\n\r\n")
+		fmt.Fprint(w, "id: 5\ndata: {\"tlddata\":[\"{\\\"protocol\\\":\\\"dns\\\"}\"],\"cursor\":5,\"token-cursor\":2}\n\n")
+		// invalid events are skipped
+		fmt.Fprint(w, "data: invalid\n\n")
+	}))
+	defer ts.Close()
+
+	c := newTestClient(t, ts.URL, "stream")
+	c.cursor = 3
+	var protocols []string
+	err := c.streamInteractions(context.Background(), func(interaction *server.Interaction) {
+		protocols = append(protocols, interaction.Protocol)
+	})
+	require.Nil(t, err, "could not stream interactions")
+	require.Equal(t, []string{"smb", "dns"}, protocols, "could not parse events")
+	require.Equal(t, uint64(5), c.cursor, "could not acknowledge streamed interactions")
+	require.Equal(t, uint64(2), c.tokenCursor, "could not update shared cursor")
+}
+
+func TestStreamUnsupported(t *testing.T) {
+	tests := map[string]struct {
+		handler     http.HandlerFunc
+		unsupported bool
+	}{
+		"not-found": {handler: http.NotFound, unsupported: true},
+		"default-handler": {handler: func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("<html><head></head><body></body></html>"))
+		}, unsupported: true},
+		"unavailable": {handler: func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(test.handler)
+			defer ts.Close()
+
+			c := newTestClient(t, ts.URL, "stream")
+			err := c.streamInteractions(context.Background(), func(*server.Interaction) {})
+			require.NotNil(t, err, "could stream interactions")
+			require.Equal(t, test.unsupported, err == errStreamUnsupported, "could not fall back correctly")
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/interactsh/pkg/server"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/projectdiscovery/retryablehttp-go"
+)
+
+// errBulkUnsupported is returned for servers without bulk polls.
+var errBulkUnsupported = errors.New("server does not support bulk polls")
+
+// Pool polls the interactions of many clients of the same server with a
+// single bulk poll request instead of a poll request per client.
+type Pool struct {
+	serverURL  *url.URL
+	token      string
+	filter     *storage.Filter
+	shared     []string
+	httpClient *retryablehttp.Client
+	quitChan   chan struct{}
+
+	mutex   sync.Mutex
+	clients []*Client
+	// offset is the index of the first client polled by the next request so
+	// that clients left out of a response by its size limit are polled first.
+	offset int
+	// maxWait is the maximum wait of long polls advertised by the server.
+	maxWait time.Duration
+	// tokenCursor and tldCursor are the cursors of the shared streams.
+	tokenCursor uint64
+	tldCursor   uint64
+}
+
+// NewPool creates a new pool for the clients of the server of the options.
+// Only the server URL, token, filter and shared streams of the options are used.
+func NewPool(options *Options) (*Pool, error) {
+	parsed, err := url.Parse(options.ServerURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse server URL")
+	}
+	pool := &Pool{
+		serverURL:  parsed,
+		token:      options.Token,
+		filter:     options.Filter,
+		shared:     options.SharedStreams,
+		httpClient: retryablehttp.NewClient(retryablehttp.DefaultOptionsSingle),
+	}
+	return pool, nil
+}
+
+// Add adds a client to the pool. The client must not be polled by itself
+// while it is part of the pool.
+func (p *Pool) Add(c *Client) error {
+	if c.serverURL.String() != p.serverURL.String() {
+		return errors.New("could not add client of another server")
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, client := range p.clients {
+		if client == c {
+			return nil
+		}
+	}
+	p.clients = append(p.clients, c)
+	return nil
+}
+
+// Remove removes a client from the pool.
+func (p *Pool) Remove(c *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, client := range p.clients {
+		if client == c {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// Len returns the number of clients of the pool.
+func (p *Pool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.clients)
+}
+
+// StartPolling starts polling the server each duration for the interactions
+// of all the clients of the pool, which are reported to the callback.
+//
+// The server is polled continuously with long polls if it supports them. The
+// clients are polled one by one if the server doesn't support bulk polls.
+func (p *Pool) StartPolling(duration time.Duration, callback InteractionCallback) {
+	ticker := time.NewTicker(duration)
+	p.quitChan = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-p.quitChan
+		cancel()
+	}()
+	go func() {
+		bulk := true
+		for {
+			var err error
+			if bulk {
+				err = p.getInteractions(ctx, callback)
+				// long polls return as soon as interactions are captured so they are chained
+				for err == nil && p.maxWait > 0 && ctx.Err() == nil {
+					err = p.getInteractions(ctx, callback)
+				}
+				if err == errBulkUnsupported {
+					gologger.Debug().Msgf("Falling back to polling each client: %s\n", err)
+					bulk = false
+				}
+			}
+			if !bulk {
+				for _, client := range p.snapshot() {
+					if err = client.getInteractions(ctx, callback); err != nil && err.Error() == authError.Error() {
+						break
+					}
+				}
+			}
+			if err != nil && err.Error() == authError.Error() {
+				gologger.Fatal().Msgf("Could not authenticate to the server")
+			}
+
+			select {
+			case <-ticker.C:
+			case <-p.quitChan:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// StopPolling stops the polling to the interactsh server.
+func (p *Pool) StopPolling() {
+	close(p.quitChan)
+}
+
+// snapshot returns the clients of the pool starting with the next one to poll.
+func (p *Pool) snapshot() []*Client {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.clients) == 0 {
+		return nil
+	}
+	p.offset %= len(p.clients)
+	clients := make([]*Client, 0, len(p.clients))
+	clients = append(clients, p.clients[p.offset:]...)
+	clients = append(clients, p.clients[:p.offset]...)
+	return clients
+}
+
+// resume sets the offset of the next request to the one of a client, which
+// is left unchanged if the client was removed meanwhile.
+func (p *Pool) resume(c *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, client := range p.clients {
+		if client == c {
+			p.offset = i
+			return
+		}
+	}
+}
+
+// getInteractions returns the interactions of the clients from the server
+// with bulk polls until all of them are received.
+func (p *Pool) getInteractions(ctx context.Context, callback InteractionCallback) error {
+	for {
+		hasMore, err := p.getInteractionsPage(ctx, callback)
+		if err != nil || !hasMore {
+			return err
+		}
+	}
+}
+
+// getInteractionsPage returns a page of interactions of the clients from the
+// server with a bulk poll, along with whether more are pending.
+func (p *Pool) getInteractionsPage(ctx context.Context, callback InteractionCallback) (bool, error) {
+	all := p.snapshot()
+	if len(all) == 0 {
+		return false, nil
+	}
+	// the remaining clients are polled first by the next request
+	clients := all
+	truncated := len(clients) > server.MaxBulkPollSessions
+	if truncated {
+		clients = clients[:server.MaxBulkPollSessions]
+	}
+	request := &server.BulkPollRequest{Sessions: make([]*server.BulkPollSession, len(clients))}
+	for i, client := range clients {
+		after := client.cursor
+		request.Sessions[i] = &server.BulkPollSession{
+			CorrelationID: client.correlationID,
+			SecretKey:     client.secretKey,
+			After:         &after,
+		}
+	}
+	data, err := jsoniter.Marshal(request)
+	if err != nil {
+		return false, errors.Wrap(err, "could not marshal bulk poll request")
+	}
+
+	builder := &strings.Builder{}
+	builder.WriteString(p.serverURL.String())
+	builder.WriteString("/poll/bulk?wait=")
+	builder.WriteString(strconv.Itoa(int(p.longPollWait() / time.Second)))
+	writeShared(builder, p.shared, p.tokenCursor, p.tldCursor)
+	if p.filter != nil {
+		writeFilter(builder, p.filter)
+	}
+	req, err := retryablehttp.NewRequest("POST", builder.String(), bytes.NewReader(data))
+	if err != nil {
+		return false, errors.Wrap(err, "could not create new request")
+	}
+	req.Request = req.Request.WithContext(ctx)
+	req.ContentLength = int64(len(data))
+
+	if p.token != "" {
+		req.Header.Add("Authorization", p.token)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	defer func() {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+		}
+	}()
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return false, authError
+	case http.StatusNotFound:
+		return false, errBulkUnsupported
+	default:
+		return false, errors.Errorf("couldn't poll interactions, status code %d", resp.StatusCode)
+	}
+	// older servers answer unknown paths with their default handler
+	response := &server.BulkPollResponse{}
+	if jsoniter.NewDecoder(resp.Body).Decode(response) != nil || response.Responses == nil {
+		return false, errBulkUnsupported
+	}
+	p.maxWait = time.Duration(response.MaxWait) * time.Second
+
+	for _, client := range clients {
+		if polled, ok := response.Responses[client.correlationID]; ok {
+			client.handleResponse(polled, callback)
+			continue
+		}
+		if polled, ok := response.Errors[client.correlationID]; ok {
+			err := client.pollError(polled)
+			if err == ErrSessionEvicted {
+				// evicted sessions which are not registered again are never polled again
+				p.Remove(client)
+			}
+			if err != nil {
+				gologger.Warning().Msgf("Could not poll interactions for %s: %s\n", client.correlationID, err)
+			}
+		}
+	}
+	handlePlaintext(response.Extra, callback)
+	// handle root-tld data if any
+	handlePlaintext(response.TLDData, callback)
+	if response.TokenCursor > p.tokenCursor {
+		p.tokenCursor = response.TokenCursor
+	}
+	if response.TLDCursor > p.tldCursor {
+		p.tldCursor = response.TLDCursor
+	}
+
+	// clients left out of the response are polled first by the next request,
+	// the responses being in the order of the request
+	if polled := len(response.Responses) + len(response.Errors); polled < len(all) {
+		p.resume(all[polled])
+	}
+	return response.HasMore || truncated, nil
+}
+
+// longPollWait returns the wait of long polls, zero if the server doesn't support them.
+func (p *Pool) longPollWait() time.Duration {
+	if p.maxWait > longPollWait {
+		return longPollWait
+	}
+	return p.maxWait
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/projectdiscovery/interactsh/pkg/server"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPool creates a pool of clients for a test server without registering them.
+func newTestPool(t *testing.T, serverURL string, count int) (*Pool, []*Client) {
+	pool, err := NewPool(&Options{ServerURL: serverURL, SharedStreams: []string{server.SharedStreamToken}})
+	require.Nil(t, err, "could not create pool")
+
+	clients := make([]*Client, count)
+	for i := range clients {
+		clients[i] = newTestClient(t, serverURL, string(rune('a'+i)))
+		require.Nil(t, pool.Add(clients[i]), "could not add client to pool")
+	}
+	return pool, clients
+}
+
+func TestPoolBulkPoll(t *testing.T) {
+	var requests []*server.BulkPollRequest
+	var queries []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := &server.BulkPollRequest{}
+		require.Nil(t, jsoniter.NewDecoder(req.Body).Decode(r), "could not decode bulk poll request")
+		requests = append(requests, r)
+		queries = append(queries, req.URL.Query())
+
+		// the first session is evicted and only the second one fits in the response
+		first, second := r.Sessions[0].CorrelationID, r.Sessions[1].CorrelationID
+		response := &server.BulkPollResponse{
+			Responses:   map[string]*server.PollResponse{second: {Cursor: 7}},
+			HasMore:     true,
+			TokenCursor: 3,
+			Extra:       []string{`{"protocol":"smb"}`},
+		}
+		if first == "a" {
+			response.Errors = map[string]*server.ErrorResponse{first: {Code: server.ErrorCodeSessionEvicted}}
+		} else {
+			response.Responses[first] = &server.PollResponse{}
+		}
+		_ = jsoniter.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	pool, clients := newTestPool(t, ts.URL, 4)
+	var interactions []*server.Interaction
+	callback := func(interaction *server.Interaction) {
+		interactions = append(interactions, interaction)
+	}
+
+	hasMore, err := pool.getInteractionsPage(context.Background(), callback)
+	require.Nil(t, err, "could not bulk poll")
+	require.True(t, hasMore, "could not report pending interactions")
+	require.Len(t, requests[0].Sessions, 4, "could not poll all clients")
+	require.Equal(t, "a", requests[0].Sessions[0].CorrelationID, "could not poll first client first")
+
+	// evicted sessions are removed from the pool
+	require.Equal(t, 3, pool.Len(), "could not remove evicted client")
+	require.Equal(t, uint64(7), clients[1].cursor, "could not update cursor of polled client")
+	require.Len(t, interactions, 1, "could not report shared interaction")
+	require.Equal(t, "smb", interactions[0].Protocol, "could not decode shared interaction")
+
+	// clients left out of the response are polled first by the next request
+	_, err = pool.getInteractionsPage(context.Background(), callback)
+	require.Nil(t, err, "could not bulk poll")
+	require.Equal(t, "c", requests[1].Sessions[0].CorrelationID, "could not rotate polled clients")
+	require.Equal(t, uint64(7), *requests[1].Sessions[2].After, "could not acknowledge polled interactions")
+	require.Equal(t, "token", queries[1].Get("shared"), "could not request shared streams")
+	require.Equal(t, "3", queries[1].Get("token-after"), "could not keep shared cursor")
+}
+
+func TestPoolBulkUnsupported(t *testing.T) {
+	tests := map[string]struct {
+		handler     http.HandlerFunc
+		unsupported bool
+	}{
+		"not-found": {handler: http.NotFound, unsupported: true},
+		"default-handler": {handler: func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("<html><head></head><body></body></html>"))
+		}, unsupported: true},
+		"unavailable": {handler: func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(test.handler)
+			defer ts.Close()
+
+			pool, _ := newTestPool(t, ts.URL, 1)
+			_, err := pool.getInteractionsPage(context.Background(), func(*server.Interaction) {})
+			require.NotNil(t, err, "could bulk poll")
+			require.Equal(t, test.unsupported, err == errBulkUnsupported, "could not fall back correctly")
+		})
+	}
+}
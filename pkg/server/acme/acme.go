@@ -259,6 +259,21 @@ func (kpr *AutoTLS) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certif
 	}
 }
 
+// NotAfter returns the expiry of the current certificate, zero if it can't be parsed.
+func (kpr *AutoTLS) NotAfter() time.Time {
+	kpr.certMu.RLock()
+	defer kpr.certMu.RUnlock()
+
+	if kpr.cert == nil || len(kpr.cert.Certificate) == 0 {
+		return time.Time{}
+	}
+	parsed, err := x509.ParseCertificate(kpr.cert.Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed.NotAfter
+}
+
 func getFastDialer() (*fastdialer.Dialer, error) {
 	fastdialerOpts := fastdialer.DefaultOptions
 	fastdialerOpts.EnableFallback = true
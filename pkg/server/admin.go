@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+)
+
+// AdminSession contains the details of a session for its administration.
+type AdminSession struct {
+	CorrelationID string `json:"correlation-id"`
+	// Created is the time at which the session was registered.
+	Created time.Time `json:"created"`
+	// Expiry is the time after which the session is evicted.
+	Expiry time.Time `json:"expiry"`
+	// TTL is the lifetime of the session in seconds.
+	TTL int64 `json:"ttl"`
+	// SlidingExpiry is true if the expiry is refreshed on each poll.
+	SlidingExpiry bool `json:"sliding-expiry"`
+	// Pending is the number of pending interactions.
+	Pending int `json:"pending"`
+	// Size is the size in bytes of the pending interactions.
+	Size int64 `json:"size"`
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Token is the name of the auth token which registered the session.
+	Token string `json:"token,omitempty"`
+	// Webhook is the URL the interactions of the session are posted to.
+	Webhook string `json:"webhook,omitempty"`
+}
+
+// AdminSessionsResponse is the response listing the sessions of the server.
+type AdminSessionsResponse struct {
+	Sessions []*AdminSession `json:"sessions"`
+}
+
+// newAdminSession returns the details of a session from the storage.
+func newAdminSession(info *storage.SessionInfo) *AdminSession {
+	return &AdminSession{
+		CorrelationID: info.CorrelationID,
+		Created:       info.Created,
+		Expiry:        info.Expiry,
+		TTL:           int64(info.TTL / time.Second),
+		SlidingExpiry: info.Sliding,
+		Pending:       info.Pending,
+		Size:          info.Size,
+		Dropped:       info.Dropped,
+		Token:         info.Owner,
+		Webhook:       info.Webhook,
+	}
+}
+
+// adminSessionsHandler is a handler to list, inspect and evict sessions.
+//
+// A GET request lists the sessions of the server, or returns the session of
+// the id parameter if specified. A DELETE request evicts the session of the
+// id parameter along with its interactions.
+func (h *HTTPServer) adminSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	ID := req.URL.Query().Get("id")
+	switch req.Method {
+	case http.MethodGet:
+		var response interface{}
+		if ID == "" {
+			sessions, err := h.options.Storage.ListSessions()
+			if err != nil {
+				jsonError(w, fmt.Sprintf("could not list sessions: %s", err), http.StatusInternalServerError)
+				return
+			}
+			list := &AdminSessionsResponse{Sessions: make([]*AdminSession, len(sessions))}
+			for i, session := range sessions {
+				list.Sessions[i] = newAdminSession(session)
+			}
+			response = list
+		} else {
+			session, err := h.options.Storage.GetSessionInfo(ID)
+			if err != nil {
+				adminError(w, "could not get session", err)
+				return
+			}
+			response = newAdminSession(session)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_ = jsoniter.NewEncoder(w).Encode(response)
+	case http.MethodDelete:
+		if ID == "" {
+			jsonError(w, "no id specified for session", http.StatusBadRequest)
+			return
+		}
+		if err := h.options.Storage.EvictSession(ID); err != nil {
+			adminError(w, "could not evict session", err)
+			return
+		}
+		if h.webhooks != nil {
+			h.webhooks.remove(ID)
+		}
+		gologger.Info().Msgf("Evicted session %s for %s\n", ID, requestToken(req).Name)
+		jsonMsg(w, "session evicted", http.StatusOK)
+	default:
+		jsonError(w, "unsupported method for sessions", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminInteractionsHandler is a handler to purge the pending interactions of
+// the session of the id parameter with a DELETE request, keeping the session.
+func (h *HTTPServer) adminInteractionsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		jsonError(w, "unsupported method for interactions", http.StatusMethodNotAllowed)
+		return
+	}
+	ID := req.URL.Query().Get("id")
+	if ID == "" {
+		jsonError(w, "no id specified for session", http.StatusBadRequest)
+		return
+	}
+	if err := h.options.Storage.PurgeSession(ID); err != nil {
+		adminError(w, "could not purge session", err)
+		return
+	}
+	gologger.Info().Msgf("Purged interactions of session %s for %s\n", ID, requestToken(req).Name)
+	jsonMsg(w, "session interactions purged", http.StatusOK)
+}
+
+// adminError writes the response for a failed request on a session.
+func adminError(w http.ResponseWriter, msg string, err error) {
+	code := http.StatusBadRequest
+	if _, evicted := storage.IsSessionEvicted(err); evicted {
+		code = http.StatusNotFound
+	}
+	jsonError(w, fmt.Sprintf("%s: %s", msg, err), code)
+}
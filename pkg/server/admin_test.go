@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestAdminSessions(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID := xid.New().String()
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519, Owner: "scanner"})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	h := &HTTPServer{options: &Options{Auth: true, Token: "admin-token", Storage: store}}
+	handler := h.authMiddleware(ScopeAdmin, http.HandlerFunc(h.adminSessionsHandler))
+	request := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "admin-token")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := request(http.MethodGet, "/admin/sessions")
+	require.Equal(t, http.StatusOK, recorder.Code, "could not list sessions")
+	response := &AdminSessionsResponse{}
+	require.Nil(t, jsoniter.NewDecoder(recorder.Body).Decode(response), "could not decode sessions")
+	require.Len(t, response.Sessions, 1, "could not list registered session")
+	require.Equal(t, "scanner", response.Sessions[0].Token, "could not get token of session")
+
+	require.Equal(t, http.StatusOK, request(http.MethodDelete, "/admin/sessions?id="+correlationID).Code, "could not evict session")
+	require.Equal(t, http.StatusNotFound, request(http.MethodGet, "/admin/sessions?id="+correlationID).Code, "could get evicted session")
+
+	// admin endpoints are closed if the server doesn't require authentication
+	h.options.Auth = false
+	require.Equal(t, http.StatusForbidden, request(http.MethodGet, "/admin/sessions").Code, "could list sessions without authentication")
+}
@@ -2,8 +2,12 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
@@ -11,7 +15,8 @@ import (
 	"github.com/projectdiscovery/gologger"
 )
 
-// DNSServer is a DNS server instance that listens on port 53.
+// DNSServer is a DNS server instance that listens on port 53 or the
+// configured dns listeners.
 type DNSServer struct {
 	options    *Options
 	mxDomain   string
@@ -19,8 +24,9 @@ type DNSServer struct {
 	ns2Domain  string
 	dotDomain  string
 	ipAddress  net.IP
+	ipv6       net.IP
 	timeToLive uint32
-	server     *dns.Server
+	servers    []*dns.Server
 	TxtRecord  string // used for ACME verification
 }
 
@@ -30,25 +36,47 @@ func NewDNSServer(options *Options) (*DNSServer, error) {
 	server := &DNSServer{
 		options:    options,
 		ipAddress:  net.ParseIP(options.IPAddress),
+		ipv6:       net.ParseIP(options.IPv6Address),
 		mxDomain:   "mail." + dotdomain,
 		ns1Domain:  "ns1." + dotdomain,
 		ns2Domain:  "ns2." + dotdomain,
 		dotDomain:  "." + dotdomain,
 		timeToLive: 3600,
 	}
-	server.server = &dns.Server{
-		Addr:    options.ListenIP + ":53",
-		Net:     "udp",
-		Handler: server,
+	if options.Records == nil {
+		options.Records = NewRecordStore(options.Domain)
+	}
+	addresses, err := options.listenAddresses(options.DNSListeners, "53")
+	if err != nil {
+		return nil, err
+	}
+	// each address is served over udp and tcp, the latter for the answers
+	// truncated over udp and the resolvers querying over tcp directly.
+	for _, address := range addresses {
+		for _, network := range []string{"udp", "tcp"} {
+			server.servers = append(server.servers, &dns.Server{
+				Addr:    address,
+				Net:     listenNetwork(network, address),
+				Handler: server,
+			})
+		}
 	}
 	return server, nil
 }
 
 // ListenAndServe listens on dns ports for the server.
 func (h *DNSServer) ListenAndServe() {
-	if err := h.server.ListenAndServe(); err != nil {
-		gologger.Error().Msgf("Could not serve dns on port 53: %s\n", err)
+	var wg sync.WaitGroup
+	for _, server := range h.servers {
+		wg.Add(1)
+		go func(server *dns.Server) {
+			defer wg.Done()
+			if err := server.ListenAndServe(); err != nil {
+				gologger.Error().Msgf("Could not serve dns over %s on %s: %s\n", server.Net, server.Addr, err)
+			}
+		}(server)
 	}
+	wg.Wait()
 }
 
 // ServeDNS is the default handler for DNS queries.
@@ -67,50 +95,76 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	domain := m.Question[0].Name
 
 	var uniqueID, fullID string
-
-	// Clould providers
-	if r.Question[0].Qtype == dns.TypeTXT {
-		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{h.TxtRecord}})
-	} else if r.Question[0].Qtype == dns.TypeA || r.Question[0].Qtype == dns.TypeANY {
-		nsHeader := dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.timeToLive}
-
-		handleClould := func(ipAddress net.IP) {
-			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: ipAddress})
-
-			m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns1Domain})
-			m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns2Domain})
-			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: h.ns1Domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
-			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: h.ns2Domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
+	var rebind *rebinding
+	var encoded net.IP
+	if strings.HasSuffix(domain, h.dotDomain) {
+		for _, label := range strings.Split(strings.TrimSuffix(domain, h.dotDomain), ".") {
+			if encoded = decodeIP(label); encoded != nil {
+				break
+			}
 		}
-
-		handleAppWithCname := func(cname string, ips ...net.IP) {
-			fqdnCname := dns.Fqdn(cname)
-			m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.timeToLive}, Target: fqdnCname})
-			for _, ip := range ips {
-				m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: fqdnCname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: ip})
+		parts := strings.Split(domain, ".")
+		for i, part := range parts {
+			if value := parseRebinding(part); value != nil {
+				rebind = value
+				if value.uniqueID == "" {
+					continue
+				}
+				part = value.uniqueID
+			}
+			if len(part) == 33 {
+				uniqueID = part
+				fullID = part
+				if i+1 <= len(parts) {
+					fullID = strings.Join(parts[:i+1], ".")
+				}
 			}
+		}
+	}
 
-			m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns1Domain})
-			m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns2Domain})
-			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: h.ns1Domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
-			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: h.ns2Domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
+	// static records such as the ones of clould providers
+	records, found := h.options.Records.lookup(domain, r.Question[0].Qtype)
+	if len(records) > 0 {
+		m.Answer = append(m.Answer, records...)
+		h.addAuthority(m, domain)
+	} else if found {
+		// names of static records have no other records, so that they don't
+		// resolve to the server for the other query types
+		m.Ns = append(m.Ns, h.soaRecord())
+	} else if r.Question[0].Qtype == dns.TypeTXT {
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{h.TxtRecord}})
+	} else if r.Question[0].Qtype == dns.TypeA || r.Question[0].Qtype == dns.TypeAAAA || r.Question[0].Qtype == dns.TypeANY {
+		handleAddress := func(ipAddress, ipv6 net.IP) {
+			m.Answer = append(m.Answer, h.addressRecords(dns.Fqdn(domain), r.Question[0].Qtype, ipAddress, ipv6)...)
+			h.addAuthority(m, domain)
 		}
 
-		// check for clould providers
 		switch {
-		case strings.EqualFold(domain, "aws"+h.dotDomain):
-			handleClould(net.ParseIP("169.254.169.254"))
-		case strings.EqualFold(domain, "alibaba"+h.dotDomain):
-			handleClould(net.ParseIP("100.100.100.200"))
-		case strings.EqualFold(domain, "app"+h.dotDomain):
-			handleAppWithCname("projectdiscovery.github.io", net.ParseIP("185.199.108.153"), net.ParseIP("185.199.110.153"), net.ParseIP("185.199.111.153"), net.ParseIP("185.199.108.153"))
+		case rebind != nil:
+			ip := h.rebindAddress(rebind, uniqueID, r.Question[0].Qtype)
+			if ip.To4() != nil {
+				handleAddress(ip, nil)
+			} else {
+				handleAddress(nil, ip)
+			}
+			// rebinding answers must not be cached by resolvers
+			for _, answer := range m.Answer {
+				answer.Header().Ttl = 0
+			}
+		case encoded != nil:
+			if encoded.To4() != nil {
+				handleAddress(encoded, nil)
+			} else {
+				handleAddress(nil, encoded)
+			}
 		default:
-			handleClould(h.ipAddress)
+			handleAddress(h.ipAddress, h.ipv6)
 		}
 
 	} else if r.Question[0].Qtype == dns.TypeSOA {
-		nsHdr := dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: h.timeToLive}
-		m.Answer = append(m.Answer, &dns.SOA{Hdr: nsHdr, Ns: h.ns1Domain, Mbox: h.options.Hostmaster})
+		soa := h.soaRecord()
+		soa.Hdr.Name = dns.Fqdn(domain)
+		m.Answer = append(m.Answer, soa)
 	} else if r.Question[0].Qtype == dns.TypeMX {
 		nsHdr := dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: h.timeToLive}
 		m.Answer = append(m.Answer, &dns.MX{Hdr: nsHdr, Mx: h.mxDomain, Preference: 1})
@@ -119,6 +173,10 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns1Domain})
 		m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns2Domain})
 	}
+	transport := dnsTransport(w)
+	if transport == "udp" {
+		truncateDNS(r, m)
+	}
 	responseMsg := m.String()
 
 	// if root-tld is enabled stores any interaction towards the main domain
@@ -130,6 +188,7 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			UniqueID:      domain,
 			FullId:        domain,
 			QType:         toQType(r.Question[0].Qtype),
+			Transport:     transport,
 			RawRequest:    requestMsg,
 			RawResponse:   responseMsg,
 			RemoteAddress: host,
@@ -140,24 +199,14 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			gologger.Warning().Msgf("Could not encode root tld dns interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("Root TLD DNS Interaction: \n%s\n", buffer.String())
-			if err := h.options.Storage.AddInteractionWithId(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.Storage.AddInteractionWithId(correlationID, buffer.Bytes())
+			h.options.Metrics.recordInteraction("dns", SharedStreamTLD, err)
+			if err != nil {
 				gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 			}
 		}
 	}
 
-	if strings.HasSuffix(domain, h.dotDomain) {
-		parts := strings.Split(domain, ".")
-		for i, part := range parts {
-			if len(part) == 33 {
-				uniqueID = part
-				fullID = part
-				if i+1 <= len(parts) {
-					fullID = strings.Join(parts[:i+1], ".")
-				}
-			}
-		}
-	}
 	if uniqueID != "" {
 		correlationID := uniqueID[:20]
 		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
@@ -166,6 +215,7 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			UniqueID:      uniqueID,
 			FullId:        fullID,
 			QType:         toQType(r.Question[0].Qtype),
+			Transport:     transport,
 			RawRequest:    requestMsg,
 			RawResponse:   responseMsg,
 			RemoteAddress: host,
@@ -176,7 +226,9 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			gologger.Warning().Msgf("Could not encode dns interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("DNS Interaction: \n%s\n", buffer.String())
-			if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes())
+			h.options.Metrics.recordInteraction("dns", streamSession, err)
+			if err != nil {
 				gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 			}
 		}
@@ -186,6 +238,152 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
+// decimalPrefix is the prefix of the labels of decimal encoded addresses.
+const decimalPrefix = "dec-"
+
+// decodeIP decodes the address embedded in a label, either dashed such as
+// 10-0-0-1 or 2001-db8--1, hex encoded with a 0x prefix such as 0x0a000001,
+// or decimal encoded with a dec- prefix such as dec-167772161. Plain numeric
+// labels aren't decoded since they are commonly dates or ids. It returns
+// nil for other labels.
+func decodeIP(label string) net.IP {
+	label = strings.ToLower(label)
+	switch {
+	case strings.HasPrefix(label, decimalPrefix):
+		value, err := strconv.ParseUint(label[len(decimalPrefix):], 10, 32)
+		if err != nil {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(value))
+		return ip
+	case strings.HasPrefix(label, "0x"):
+		ip, err := hex.DecodeString(label[2:])
+		if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+			return nil
+		}
+		return net.IP(ip)
+	case strings.Contains(label, "-"):
+		if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)).To4(); ip != nil {
+			return ip
+		}
+		if ip := net.ParseIP(strings.Replace(label, "-", ":", -1)); ip != nil && ip.To4() == nil {
+			return ip
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// rebindPrefix is the prefix of the labels of dns rebinding payloads.
+const rebindPrefix = "rebind-"
+
+// rebinding is a dns rebinding payload answering alternately two addresses.
+type rebinding struct {
+	label    string
+	ips      [2]net.IP
+	uniqueID string
+}
+
+// parseRebinding parses a dns rebinding label, rebind-<ipA>-<ipB> with both
+// addresses of the same family hex encoded, such as rebind-7f000001-a9fea9fe,
+// optionally followed by -<unique-id>. It returns nil for other labels.
+func parseRebinding(label string) *rebinding {
+	if len(label) <= len(rebindPrefix) || !strings.EqualFold(label[:len(rebindPrefix)], rebindPrefix) {
+		return nil
+	}
+	parts := strings.Split(label[len(rebindPrefix):], "-")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil
+	}
+	rebind := &rebinding{label: strings.ToLower(label)}
+	for i := range rebind.ips {
+		ip, err := hex.DecodeString(parts[i])
+		if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+			return nil
+		}
+		rebind.ips[i] = net.IP(ip)
+	}
+	if len(rebind.ips[0]) != len(rebind.ips[1]) {
+		return nil
+	}
+	if len(parts) == 3 {
+		if len(parts[2]) != 33 {
+			return nil
+		}
+		rebind.uniqueID = parts[2]
+	}
+	return rebind
+}
+
+// rebindAddress returns the address answered to a query of a rebinding
+// payload, alternating between its addresses on each query of their family
+// for the session of the unique id. The first address is answered to queries
+// without a session.
+func (h *DNSServer) rebindAddress(rebind *rebinding, uniqueID string, qtype uint16) net.IP {
+	ipv4 := len(rebind.ips[0]) == net.IPv4len
+	if qtype != dns.TypeANY && (qtype == dns.TypeA) != ipv4 {
+		return nil
+	}
+	if uniqueID == "" {
+		return rebind.ips[0]
+	}
+	count, err := h.options.Storage.IncrementCounter(uniqueID[:20], rebind.label)
+	if err != nil {
+		gologger.Debug().Msgf("Could not get rebinding state of %s: %s\n", rebind.label, err)
+		return rebind.ips[0]
+	}
+	return rebind.ips[(count-1)%2]
+}
+
+// addAuthority adds the name servers of the domain along with their addresses to a response.
+// soaRecord returns the SOA record of the domain.
+func (h *DNSServer) soaRecord() *dns.SOA {
+	hdr := dns.RR_Header{Name: h.dotDomain[1:], Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: h.timeToLive}
+	return &dns.SOA{Hdr: hdr, Ns: h.ns1Domain, Mbox: h.options.Hostmaster}
+}
+
+func (h *DNSServer) addAuthority(m *dns.Msg, domain string) {
+	nsHeader := dns.RR_Header{Name: dns.Fqdn(domain), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.timeToLive}
+	m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns1Domain})
+	m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: h.ns2Domain})
+	m.Extra = append(m.Extra, h.addressRecords(h.ns1Domain, dns.TypeANY, h.ipAddress, h.ipv6)...)
+	m.Extra = append(m.Extra, h.addressRecords(h.ns2Domain, dns.TypeANY, h.ipAddress, h.ipv6)...)
+}
+
+// addressRecords returns the A and AAAA records of a name for a query type,
+// the ones of a nil address being omitted.
+func (h *DNSServer) addressRecords(name string, qtype uint16, ipv4, ipv6 net.IP) []dns.RR {
+	var records []dns.RR
+	if ipv4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+		records = append(records, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: ipv4})
+	}
+	if ipv6 != nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+		records = append(records, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: h.timeToLive}, AAAA: ipv6})
+	}
+	return records
+}
+
+// dnsTransport returns the transport of the request written to, udp or tcp.
+func dnsTransport(w dns.ResponseWriter) string {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// truncateDNS truncates a response to the udp payload size of the request,
+// 512 bytes unless advertised with edns0, setting the TC bit if records had
+// to be dropped so that the resolver retries over tcp.
+func truncateDNS(r, m *dns.Msg) {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	m.Truncate(size)
+}
+
 func toQType(ttype uint16) (rtype string) {
 	switch ttype {
 	case dns.TypeA:
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// testResponseWriter is a dns.ResponseWriter recording the written response.
+type testResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv6loopback, Port: 53}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestDNSAAAA(t *testing.T) {
+	server, err := NewDNSServer(&Options{Domain: "example.com", IPAddress: "192.0.2.1", IPv6Address: "2001:db8::1", DNSListeners: []string{}})
+	require.Nil(t, err, "could not create dns server")
+
+	query := new(dns.Msg)
+	query.SetQuestion("ns1.example.com.", dns.TypeAAAA)
+	w := &testResponseWriter{}
+	server.ServeDNS(w, query)
+	require.Len(t, w.msg.Answer, 1, "could not answer aaaa query")
+	require.Equal(t, "2001:db8::1", w.msg.Answer[0].(*dns.AAAA).AAAA.String(), "could not answer ipv6 address")
+	// ns1 and ns2 are glued with both their addresses
+	require.Len(t, w.msg.Extra, 4, "could not glue name servers")
+}
+
+func TestDNSStaticRecords(t *testing.T) {
+	server, err := NewDNSServer(&Options{Domain: "example.com", IPAddress: "192.0.2.1", IPv6Address: "2001:db8::1", DNSListeners: []string{}})
+	require.Nil(t, err, "could not create dns server")
+	server.TxtRecord = "acme"
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		w := &testResponseWriter{}
+		server.ServeDNS(w, query)
+		return w.msg
+	}
+
+	msg := resolve("gcp.example.com.", dns.TypeA)
+	require.Len(t, msg.Answer, 1, "could not answer static record")
+	require.Equal(t, "169.254.169.254", msg.Answer[0].(*dns.A).A.String(), "could not answer static address")
+
+	// names of static records don't resolve to the server for other types
+	for name, qtype := range map[string]uint16{"gcp.example.com.": dns.TypeAAAA, "aws.example.com.": dns.TypeTXT, "azure.example.com.": dns.TypeMX} {
+		msg = resolve(name, qtype)
+		require.Equal(t, dns.RcodeSuccess, msg.Rcode, "could not answer %s %s", name, dns.TypeToString[qtype])
+		require.Empty(t, msg.Answer, "could answer %s %s", name, dns.TypeToString[qtype])
+		require.Len(t, msg.Ns, 1, "could not answer authority of %s", name)
+		require.Equal(t, dns.TypeSOA, msg.Ns[0].Header().Rrtype, "could not answer soa of %s", name)
+	}
+
+	msg = resolve("other.example.com.", dns.TypeAAAA)
+	require.Len(t, msg.Answer, 1, "could not answer name without static records")
+	require.Equal(t, "2001:db8::1", msg.Answer[0].(*dns.AAAA).AAAA.String(), "could not answer server address")
+}
+
+func TestDNSRebinding(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID := xid.New().String()
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519})
+	require.Nil(t, err, "could not register correlation-id in storage")
+	uniqueID := correlationID + "abcdefghijklm"
+
+	server, err := NewDNSServer(&Options{Domain: "example.com", IPAddress: "192.0.2.1", Storage: store, DNSListeners: []string{}})
+	require.Nil(t, err, "could not create dns server")
+	resolve := func(name string, qtype uint16) []dns.RR {
+		query := new(dns.Msg)
+		query.SetQuestion(name, qtype)
+		w := &testResponseWriter{}
+		server.ServeDNS(w, query)
+		return w.msg.Answer
+	}
+
+	name := "rebind-7f000001-a9fea9fe." + uniqueID + ".example.com."
+	for _, expected := range []string{"127.0.0.1", "169.254.169.254", "127.0.0.1"} {
+		answers := resolve(name, dns.TypeA)
+		require.Len(t, answers, 1, "could not answer rebinding query")
+		require.Equal(t, expected, answers[0].(*dns.A).A.String(), "could not alternate rebinding addresses")
+		require.Zero(t, answers[0].Header().Ttl, "could not answer rebinding with zero ttl")
+		// queries of the other family don't advance the rebinding
+		require.Empty(t, resolve(name, dns.TypeAAAA), "could answer aaaa for ipv4 rebinding")
+	}
+
+	// the unique id can be embedded in the rebinding label
+	answers := resolve("rebind-7f000001-a9fea9fe-"+uniqueID+".example.com.", dns.TypeA)
+	require.Len(t, answers, 1, "could not answer rebinding query with embedded id")
+	require.Equal(t, "127.0.0.1", answers[0].(*dns.A).A.String(), "could not answer first rebinding address")
+	require.Nil(t, parseRebinding("rebind-7f000001-00000000000000000000000000000001"), "could parse mixed family rebinding")
+}
+
+func TestDNSEncodedAddresses(t *testing.T) {
+	for label, expected := range map[string]string{
+		"10-0-0-1":                           "10.0.0.1",
+		"2001-db8--1":                        "2001:db8::1",
+		"--1":                                "::1",
+		"0x0A000001":                         "10.0.0.1",
+		"0x20010db8000000000000000000000001": "2001:db8::1",
+		"dec-167772161":                      "10.0.0.1",
+		"DEC-2130706433":                     "127.0.0.1",
+	} {
+		ip := decodeIP(label)
+		require.NotNil(t, ip, "could not decode %s", label)
+		require.Equal(t, expected, ip.String(), "could not decode %s", label)
+	}
+	for _, label := range []string{"www", "10-0-0", "10-0-0-256", "0x0a0000", "123", "167772161", "d1", "d2021", "d167772161", "dec-", "dec-1-2", "dec-4294967296", "rebind-7f000001-a9fea9fe"} {
+		require.Nil(t, decodeIP(label), "could decode %s", label)
+	}
+
+	server, err := NewDNSServer(&Options{Domain: "example.com", IPAddress: "192.0.2.1", DNSListeners: []string{}})
+	require.Nil(t, err, "could not create dns server")
+	query := new(dns.Msg)
+	query.SetQuestion("payload.2001-db8--1.example.com.", dns.TypeAAAA)
+	w := &testResponseWriter{}
+	server.ServeDNS(w, query)
+	require.Len(t, w.msg.Answer, 1, "could not answer encoded address")
+	require.Equal(t, "2001:db8::1", w.msg.Answer[0].(*dns.AAAA).AAAA.String(), "could not answer encoded address")
+
+	// numeric labels such as dates are not addresses
+	for _, name := range []string{"20211117.example.com.", "d2021.example.com."} {
+		query.SetQuestion(name, dns.TypeA)
+		w = &testResponseWriter{}
+		server.ServeDNS(w, query)
+		require.Len(t, w.msg.Answer, 1, "could not answer numeric label")
+		require.Equal(t, "192.0.2.1", w.msg.Answer[0].(*dns.A).A.String(), "could not answer server address for numeric label of %s", name)
+	}
+}
+
+func TestDNSTruncation(t *testing.T) {
+	response := func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 0; i < 64; i++ {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "app.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IPv4(127, 0, 0, byte(i))})
+		}
+		return m
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("app.example.com.", dns.TypeA)
+	m := response(query)
+	truncateDNS(query, m)
+	require.True(t, m.Truncated, "could not set tc bit")
+	require.Less(t, len(m.Answer), 64, "could not drop answers")
+	packed, err := m.Pack()
+	require.Nil(t, err, "could not pack truncated response")
+	require.LessOrEqual(t, len(packed), dns.MinMsgSize, "could not fit response in udp payload")
+
+	// edns0 advertises a larger payload size
+	query.SetEdns0(4096, false)
+	m = response(query)
+	truncateDNS(query, m)
+	require.False(t, m.Truncated, "could set tc bit for edns0 payload size")
+	require.Len(t, m.Answer, 64, "could drop answers for edns0 payload size")
+}
@@ -2,29 +2,39 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
 	"github.com/projectdiscovery/gologger"
 	"github.com/projectdiscovery/gologger/levels"
 	"github.com/projectdiscovery/interactsh/pkg/server/acme"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
 )
 
 // HTTPServer is a http server instance that listens both
 // TLS and Non-TLS based servers.
 type HTTPServer struct {
-	options      *Options
-	domain       string
-	tlsserver    http.Server
-	nontlsserver http.Server
+	options       *Options
+	domain        string
+	tlsservers    []*http.Server
+	nontlsservers []*http.Server
+	webhooks      *webhookDispatcher
+	// sharedCursors contains the cursors of the shared streams of legacy clients.
+	sharedCursors *sharedCursors
 }
 
 type noopLogger struct {
@@ -38,36 +48,87 @@ func (l *noopLogger) Write(p []byte) (n int, err error) {
 func NewHTTPServer(options *Options) (*HTTPServer, error) {
 	gologger.DefaultLogger.SetMaxLevel(levels.LevelDebug)
 
-	server := &HTTPServer{options: options, domain: strings.TrimSuffix(options.Domain, ".")}
+	server := &HTTPServer{options: options, domain: strings.TrimSuffix(options.Domain, "."), sharedCursors: newSharedCursors(options.SharedRetention)}
+	// tokens created with the management API are kept in memory without a tokens file
+	if options.Tokens == nil {
+		options.Tokens = NewTokenStore()
+	}
+	if options.Metrics == nil {
+		options.Metrics = NewMetrics()
+	}
+	if options.Webhooks {
+		server.webhooks = newWebhookDispatcher(options.Storage, options.WebhookQueueSize, server.boundPollFilter(nil))
+		if err := server.webhooks.restore(); err != nil {
+			return nil, err
+		}
+	}
 
 	router := &http.ServeMux{}
 	router.Handle("/", server.logger(http.HandlerFunc(server.defaultHandler)))
-	router.Handle("/register", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.registerHandler))))
-	router.Handle("/deregister", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.deregisterHandler))))
-	router.Handle("/poll", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.pollHandler))))
-	router.Handle("/metrics", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.metricsHandler))))
-	server.tlsserver = http.Server{Addr: options.ListenIP + ":443", Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)}
-	server.nontlsserver = http.Server{Addr: options.ListenIP + ":80", Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)}
+	router.Handle("/register", server.corsMiddleware(server.authMiddleware(ScopeRegister, http.HandlerFunc(server.registerHandler))))
+	router.Handle("/deregister", server.corsMiddleware(server.authMiddleware(ScopeRegister, http.HandlerFunc(server.deregisterHandler))))
+	router.Handle("/poll", server.corsMiddleware(server.authMiddleware(ScopePoll, http.HandlerFunc(server.pollHandler))))
+	router.Handle("/poll/bulk", server.corsMiddleware(server.authMiddleware(ScopePoll, http.HandlerFunc(server.bulkPollHandler))))
+	router.Handle("/events", server.corsMiddleware(server.authMiddleware(ScopePoll, http.HandlerFunc(server.eventsHandler))))
+	router.Handle("/session", server.corsMiddleware(server.authMiddleware(ScopePoll, http.HandlerFunc(server.sessionHandler))))
+	router.Handle("/metrics", server.corsMiddleware(server.authMiddleware(ScopeMetrics, http.HandlerFunc(server.metricsHandler))))
+	router.Handle("/tokens", server.corsMiddleware(server.authMiddleware(ScopeAdmin, http.HandlerFunc(server.tokensHandler))))
+	router.Handle("/admin/sessions", server.corsMiddleware(server.authMiddleware(ScopeAdmin, http.HandlerFunc(server.adminSessionsHandler))))
+	router.Handle("/admin/sessions/interactions", server.corsMiddleware(server.authMiddleware(ScopeAdmin, http.HandlerFunc(server.adminInteractionsHandler))))
+
+	tlsAddresses, err := options.listenAddresses(options.HTTPSListeners, "443")
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range tlsAddresses {
+		server.tlsservers = append(server.tlsservers, &http.Server{Addr: address, Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)})
+	}
+	addresses, err := options.listenAddresses(options.HTTPListeners, "80")
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		server.nontlsservers = append(server.nontlsservers, &http.Server{Addr: address, Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)})
+	}
 	return server, nil
 }
 
 // ListenAndServe listens on http and/or https ports for the server.
 func (h *HTTPServer) ListenAndServe(autoTLS *acme.AutoTLS) {
-	go func() {
-		if autoTLS == nil {
-			return
-		}
-		h.tlsserver.TLSConfig = &tls.Config{}
-		h.tlsserver.TLSConfig.GetCertificate = autoTLS.GetCertificateFunc()
+	var wg sync.WaitGroup
+	if autoTLS != nil {
+		h.options.Metrics.setAutoTLS(autoTLS)
+		for _, server := range h.tlsservers {
+			server.TLSConfig = &tls.Config{}
+			server.TLSConfig.GetCertificate = autoTLS.GetCertificateFunc()
 
-		if err := h.tlsserver.ListenAndServeTLS("", ""); err != nil {
-			gologger.Error().Msgf("Could not serve http on tls: %s\n", err)
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				listener, err := listen(server.Addr)
+				if err == nil {
+					err = server.ServeTLS(listener, "", "")
+				}
+				if err != nil {
+					gologger.Error().Msgf("Could not serve http on tls on %s: %s\n", server.Addr, err)
+				}
+			}(server)
 		}
-	}()
-
-	if err := h.nontlsserver.ListenAndServe(); err != nil {
-		gologger.Error().Msgf("Could not serve http: %s\n", err)
 	}
+	for _, server := range h.nontlsservers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			listener, err := listen(server.Addr)
+			if err == nil {
+				err = server.Serve(listener)
+			}
+			if err != nil {
+				gologger.Error().Msgf("Could not serve http on %s: %s\n", server.Addr, err)
+			}
+		}(server)
+	}
+	wg.Wait()
 }
 
 func (h *HTTPServer) logger(handler http.Handler) http.HandlerFunc {
@@ -108,7 +169,9 @@ func (h *HTTPServer) logger(handler http.Handler) http.HandlerFunc {
 				gologger.Warning().Msgf("Could not encode root tld http interaction: %s\n", err)
 			} else {
 				gologger.Debug().Msgf("Root TLD HTTP Interaction: \n%s\n", buffer.String())
-				if err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes()); err != nil {
+				err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes())
+				h.options.Metrics.recordInteraction(httpProtocol(r), SharedStreamTLD, err)
+				if err != nil {
 					gologger.Warning().Msgf("Could not store root tld http interaction: %s\n", err)
 				}
 			}
@@ -143,7 +206,9 @@ func (h *HTTPServer) logger(handler http.Handler) http.HandlerFunc {
 				gologger.Warning().Msgf("Could not encode http interaction: %s\n", err)
 			} else {
 				gologger.Debug().Msgf("HTTP Interaction: \n%s\n", buffer.String())
-				if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+				err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes())
+				h.options.Metrics.recordInteraction(httpProtocol(r), streamSession, err)
+				if err != nil {
 					gologger.Warning().Msgf("Could not store http interaction: %s\n", err)
 				}
 			}
@@ -184,10 +249,21 @@ func (h *HTTPServer) defaultHandler(w http.ResponseWriter, req *http.Request) {
 type RegisterRequest struct {
 	// PublicKey is the public RSA Key of the client.
 	PublicKey string `json:"public-key"`
+	// KeyType is the type of the public key of the client, RSA if unset.
+	KeyType string `json:"key-type,omitempty"`
 	// SecretKey is the secret-key for correlation ID registered for the client.
 	SecretKey string `json:"secret-key"`
 	// CorrelationID is an ID for correlation with requests.
 	CorrelationID string `json:"correlation-id"`
+	// Version is the crypto version of the interaction envelope requested by the client.
+	Version int `json:"version,omitempty"`
+	// TTL is the requested lifetime of the session in seconds, bounded by the server maximum.
+	TTL int `json:"ttl,omitempty"`
+	// SlidingExpiry refreshes the expiry of the session by its TTL on each poll.
+	SlidingExpiry bool `json:"sliding-expiry,omitempty"`
+	// Webhook is the URL to post the interactions of the session to as they are
+	// captured, signed with the secret key in the X-Interactsh-Signature header.
+	Webhook string `json:"webhook,omitempty"`
 }
 
 // registerHandler is a handler for client register requests
@@ -198,11 +274,38 @@ func (h *HTTPServer) registerHandler(w http.ResponseWriter, req *http.Request) {
 		jsonError(w, fmt.Sprintf("could not decode json body: %s", err), http.StatusBadRequest)
 		return
 	}
-	if err := h.options.Storage.SetIDPublicKey(r.CorrelationID, r.SecretKey, r.PublicKey); err != nil {
+	if r.Webhook != "" {
+		if h.webhooks == nil {
+			jsonError(w, "webhooks are not enabled on the server", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(r.Webhook); err != nil {
+			jsonError(w, fmt.Sprintf("invalid webhook: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	registration := &storage.Registration{
+		CorrelationID: r.CorrelationID,
+		SecretKey:     r.SecretKey,
+		PublicKey:     r.PublicKey,
+		KeyType:       r.KeyType,
+		Version:       r.Version,
+		TTL:           time.Duration(r.TTL) * time.Second,
+		Sliding:       r.SlidingExpiry,
+		Webhook:       r.Webhook,
+	}
+	if token := requestToken(req); token != nil {
+		registration.Owner = token.Name
+	}
+	if err := h.options.Storage.Register(registration); err != nil {
 		gologger.Warning().Msgf("Could not set id and public key for %s: %s\n", r.CorrelationID, err)
 		jsonError(w, fmt.Sprintf("could not set id and public key: %s", err), http.StatusBadRequest)
 		return
 	}
+	if r.Webhook != "" {
+		h.webhooks.add(r.CorrelationID, r.SecretKey, r.Webhook)
+	}
+	h.options.Metrics.recordRegistration(true)
 	jsonMsg(w, "registration successful", http.StatusOK)
 	gologger.Debug().Msgf("Registered correlationID %s for key\n", r.CorrelationID)
 }
@@ -223,25 +326,73 @@ func (h *HTTPServer) deregisterHandler(w http.ResponseWriter, req *http.Request)
 		jsonError(w, fmt.Sprintf("could not decode json body: %s", err), http.StatusBadRequest)
 		return
 	}
+	if err := h.checkOwner(requestToken(req), r.CorrelationID); err != nil {
+		jsonError(w, fmt.Sprintf("could not remove id: %s", err), http.StatusForbidden)
+		return
+	}
 	if err := h.options.Storage.RemoveID(r.CorrelationID, r.SecretKey); err != nil {
 		gologger.Warning().Msgf("Could not remove id for %s: %s\n", r.CorrelationID, err)
 		jsonError(w, fmt.Sprintf("could not remove id: %s", err), http.StatusBadRequest)
 		return
 	}
+	h.forget(r.CorrelationID)
+	h.options.Metrics.recordRegistration(false)
 	jsonMsg(w, "deregistration successful", http.StatusOK)
 	gologger.Debug().Msgf("Deregistered correlationID %s for key\n", r.CorrelationID)
 }
 
+// SessionEvicted forgets the state kept by the server for a session evicted
+// from the storage, it is meant to be called by the eviction callback of the
+// storage.
+func (h *HTTPServer) SessionEvicted(event *storage.EvictionEvent) {
+	h.forget(event.CorrelationID)
+}
+
+// forget forgets the webhook and the shared cursors of a session.
+func (h *HTTPServer) forget(ID string) {
+	if h.webhooks != nil {
+		h.webhooks.remove(ID)
+	}
+	h.sharedCursors.delete(ID)
+}
+
 // PollResponse is the response for a polling request
 type PollResponse struct {
 	Data    []string `json:"data"`
 	Extra   []string `json:"extra"`
 	AESKey  string   `json:"aes_key"`
 	TLDData []string `json:"tlddata,omitempty"`
+	// Sequences contains the sequence number of each item in Data for cursor based polls.
+	Sequences []uint64 `json:"sequences,omitempty"`
+	// Cursor is the cursor to acknowledge the returned Data with on the next poll.
+	Cursor uint64 `json:"cursor,omitempty"`
+	// Version is the crypto version of the interaction envelope used for Data.
+	Version int `json:"version,omitempty"`
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// HasMore is true if interactions were left out of the response because of
+	// its limits, they are returned by the next poll.
+	HasMore bool `json:"has-more,omitempty"`
+	// Continuation is the token to get the next page of a cursor based poll
+	// with, without acknowledging the returned Data.
+	Continuation string `json:"continuation,omitempty"`
+	// MaxWait is the maximum wait in seconds of long polls supported by the server.
+	MaxWait int `json:"max-wait,omitempty"`
+	// TokenCursor is the cursor of the auth token stream to request Extra after on the next poll.
+	TokenCursor uint64 `json:"token-cursor,omitempty"`
+	// TLDCursor is the cursor of the root tld stream to request TLDData after on the next poll.
+	TLDCursor uint64 `json:"tld-cursor,omitempty"`
+}
+
+// empty returns true if the response contains no interaction.
+func (r *PollResponse) empty() bool {
+	return len(r.Data) == 0 && len(r.Extra) == 0 && len(r.TLDData) == 0
 }
 
 // pollHandler is a handler for client poll requests
 func (h *HTTPServer) pollHandler(w http.ResponseWriter, req *http.Request) {
+	defer h.options.Metrics.recordPoll("poll", time.Now())
+
 	ID := req.URL.Query().Get("id")
 	if ID == "" {
 		jsonError(w, "no id specified for poll", http.StatusBadRequest)
@@ -253,27 +404,591 @@ func (h *HTTPServer) pollHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	data, aesKey, err := h.options.Storage.GetInteractions(ID, secret)
+	filter, err := parsePollFilter(req)
 	if err != nil {
-		gologger.Warning().Msgf("Could not get interactions for %s: %s\n", ID, err)
-		jsonError(w, fmt.Sprintf("could not get interactions: %s", err), http.StatusBadRequest)
+		jsonError(w, fmt.Sprintf("invalid filter specified for poll: %s", err), http.StatusBadRequest)
+		return
+	}
+	filter = h.boundPollFilter(filter)
+	shared, err := parseSharedPoll(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid shared streams specified for poll: %s", err), http.StatusBadRequest)
 		return
 	}
 
-	// At this point the client is authenticated, so we return also the data related to the auth token
-	extradata, _ := h.options.Storage.GetInteractionsWithId(h.options.Token)
-	var tlddata []string
-	if h.options.RootTLD {
-		tlddata, _ = h.options.Storage.GetInteractionsWithId(h.options.Domain)
+	// Polls with an after cursor acknowledge the interactions up to the cursor
+	// and keep the returned ones until they are acknowledged by a later poll.
+	var after *uint64
+	if value := req.URL.Query().Get("after"); value != "" {
+		cursor, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			jsonError(w, fmt.Sprintf("invalid after cursor specified for poll: %s", err), http.StatusBadRequest)
+			return
+		}
+		after = &cursor
+	}
+
+	// Long polls wait for interactions up to the requested duration if none are pending
+	wait, err := h.parsePollWait(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid wait specified for poll: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.checkOwner(requestToken(req), ID); err != nil {
+		h.pollError(w, ID, err)
+		return
+	}
+	var notify <-chan struct{}
+	if wait > 0 {
+		// subscribe before the first poll so that no interaction is missed
+		var cancel func()
+		notify, cancel = h.subscribe(shared, ID)
+		defer cancel()
+	}
+
+	response, err := h.poll(ID, secret, after, shared, filter)
+	if err != nil {
+		h.pollError(w, ID, err)
+		return
 	}
-	response := &PollResponse{Data: data, AESKey: aesKey, TLDData: tlddata, Extra: extradata}
+	if wait > 0 && response.empty() && waitPoll(req, notify, wait) {
+		if response, err = h.poll(ID, secret, after, shared, filter); err != nil {
+			h.pollError(w, ID, err)
+			return
+		}
+	}
+	response.MaxWait = int(h.options.PollMaxWait / time.Second)
 
 	if err := jsoniter.NewEncoder(w).Encode(response); err != nil {
 		gologger.Warning().Msgf("Could not encode interactions for %s: %s\n", ID, err)
 		jsonError(w, fmt.Sprintf("could not encode interactions: %s", err), http.StatusBadRequest)
 		return
 	}
-	gologger.Debug().Msgf("Polled %d interactions for %s correlationID\n", len(data), ID)
+	gologger.Debug().Msgf("Polled %d interactions for %s correlationID\n", len(response.Data), ID)
+}
+
+// poll returns the interactions for a correlation ID matching the filter, cursor
+// based if after is not nil, along with the interactions of the shared streams.
+func (h *HTTPServer) poll(ID, secret string, after *uint64, shared *sharedPoll, filter *storage.Filter) (*PollResponse, error) {
+	response, err := h.pollSession(ID, secret, after, filter)
+	if err != nil {
+		return nil, err
+	}
+	// At this point the client is authenticated, so we return also the data related to the auth token
+	sharedInteractions := h.pollShared(ID, shared, filter)
+	response.Extra = sharedInteractions.extra
+	response.TLDData = sharedInteractions.tld
+	response.TokenCursor = sharedInteractions.tokenCursor
+	response.TLDCursor = sharedInteractions.tldCursor
+	response.HasMore = response.HasMore || sharedInteractions.hasMore
+	return response, nil
+}
+
+// pollSession returns the interactions for a correlation ID matching the filter,
+// cursor based if after is not nil.
+func (h *HTTPServer) pollSession(ID, secret string, after *uint64, filter *storage.Filter) (*PollResponse, error) {
+	var interactions *storage.Interactions
+	var err error
+	if after != nil {
+		interactions, err = h.options.Storage.GetInteractionsAfter(ID, secret, *after, filter)
+	} else {
+		interactions, err = h.options.Storage.GetInteractions(ID, secret, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PollResponse{
+		Data:      interactions.Data,
+		AESKey:    interactions.AESKey,
+		Sequences: interactions.Sequences,
+		Cursor:    interactions.Cursor,
+		Version:   interactions.Version,
+		Dropped:   interactions.Dropped,
+		HasMore:   interactions.HasMore,
+	}
+	if interactions.HasMore && after != nil {
+		response.Continuation = strconv.FormatUint(interactions.Cursor, 10)
+	}
+	return response, nil
+}
+
+// parsePollWait parses the wait of a long poll request bounded by the maximum
+// wait of the server, zero if the request is not a long poll.
+func (h *HTTPServer) parsePollWait(req *http.Request) (time.Duration, error) {
+	value := req.URL.Query().Get("wait")
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid wait %s", value)
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > h.options.PollMaxWait {
+		wait = h.options.PollMaxWait
+	}
+	return wait, nil
+}
+
+// waitPoll waits for a notification of a long poll up to the wait duration
+// and returns true if one was received.
+func waitPoll(req *http.Request, notify <-chan struct{}, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-notify:
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	return false
+}
+
+// BulkPollRequest is a request to poll the interactions of several sessions at once.
+type BulkPollRequest struct {
+	// Sessions contains the sessions to poll.
+	Sessions []*BulkPollSession `json:"sessions"`
+}
+
+// BulkPollSession is a session polled by a bulk poll request.
+type BulkPollSession struct {
+	// CorrelationID is an ID for correlation with requests.
+	CorrelationID string `json:"correlation-id"`
+	// SecretKey is the secretKey for the interactsh client.
+	SecretKey string `json:"secret-key"`
+	// After is the cursor to acknowledge the interactions of a cursor based poll with.
+	After *uint64 `json:"after,omitempty"`
+}
+
+// BulkPollResponse is the response for a bulk poll request.
+type BulkPollResponse struct {
+	// Responses contains the poll response of each polled session by correlation-id.
+	Responses map[string]*PollResponse `json:"responses"`
+	// Errors contains the error of each session which could not be polled by correlation-id.
+	Errors  map[string]*ErrorResponse `json:"errors,omitempty"`
+	Extra   []string                  `json:"extra"`
+	TLDData []string                  `json:"tlddata,omitempty"`
+	// HasMore is true if interactions were left out of the response because of
+	// its limits, they are returned by the next poll.
+	HasMore bool `json:"has-more,omitempty"`
+	// MaxWait is the maximum wait in seconds of long polls supported by the server.
+	MaxWait int `json:"max-wait,omitempty"`
+	// TokenCursor is the cursor of the auth token stream to request Extra after on the next poll.
+	TokenCursor uint64 `json:"token-cursor,omitempty"`
+	// TLDCursor is the cursor of the root tld stream to request TLDData after on the next poll.
+	TLDCursor uint64 `json:"tld-cursor,omitempty"`
+}
+
+// MaxBulkPollSessions is the maximum number of sessions of a bulk poll request.
+const MaxBulkPollSessions = 10000
+
+// bulkPollHandler is a handler for client bulk poll requests
+func (h *HTTPServer) bulkPollHandler(w http.ResponseWriter, req *http.Request) {
+	defer h.options.Metrics.recordPoll("bulk", time.Now())
+
+	if req.Method != http.MethodPost {
+		jsonError(w, "bulk poll requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	r := &BulkPollRequest{}
+	if err := jsoniter.NewDecoder(req.Body).Decode(r); err != nil {
+		gologger.Warning().Msgf("Could not decode json body: %s\n", err)
+		jsonError(w, fmt.Sprintf("could not decode json body: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(r.Sessions) == 0 {
+		jsonError(w, "no sessions specified for bulk poll", http.StatusBadRequest)
+		return
+	}
+	if len(r.Sessions) > MaxBulkPollSessions {
+		jsonError(w, fmt.Sprintf("too many sessions specified for bulk poll (maximum %d)", MaxBulkPollSessions), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parsePollFilter(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid filter specified for poll: %s", err), http.StatusBadRequest)
+		return
+	}
+	filter = h.boundPollFilter(filter)
+	shared, err := parseSharedPoll(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid shared streams specified for poll: %s", err), http.StatusBadRequest)
+		return
+	}
+	// bulk polls are not tied to a single session to keep cursors for
+	if shared.legacy {
+		shared = &sharedPoll{}
+	}
+	wait, err := h.parsePollWait(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid wait specified for poll: %s", err), http.StatusBadRequest)
+		return
+	}
+	var notify <-chan struct{}
+	if wait > 0 {
+		IDs := make([]string, len(r.Sessions))
+		for i, session := range r.Sessions {
+			IDs[i] = session.CorrelationID
+		}
+		var cancel func()
+		notify, cancel = h.subscribe(shared, IDs...)
+		defer cancel()
+	}
+
+	token := requestToken(req)
+	response := h.bulkPoll(token, r.Sessions, shared, filter)
+	if wait > 0 && response.empty() && waitPoll(req, notify, wait) {
+		response = h.bulkPoll(token, r.Sessions, shared, filter)
+	}
+	response.MaxWait = int(h.options.PollMaxWait / time.Second)
+
+	if err := jsoniter.NewEncoder(w).Encode(response); err != nil {
+		gologger.Warning().Msgf("Could not encode bulk poll interactions: %s\n", err)
+		jsonError(w, fmt.Sprintf("could not encode interactions: %s", err), http.StatusBadRequest)
+		return
+	}
+	gologger.Debug().Msgf("Bulk polled %d sessions\n", len(response.Responses))
+}
+
+// bulkPoll polls the sessions of a bulk poll request of a token. Once the maximum
+// size of a poll is reached the remaining sessions are left out of the response.
+func (h *HTTPServer) bulkPoll(token *Token, sessions []*BulkPollSession, shared *sharedPoll, filter *storage.Filter) *BulkPollResponse {
+	response := &BulkPollResponse{Responses: make(map[string]*PollResponse)}
+	var size int64
+	for _, session := range sessions {
+		if h.options.PollMaxSize > 0 && size >= h.options.PollMaxSize {
+			response.HasMore = true
+			break
+		}
+		err := h.checkOwner(token, session.CorrelationID)
+		var polled *PollResponse
+		if err == nil {
+			polled, err = h.pollSession(session.CorrelationID, session.SecretKey, session.After, filter)
+		}
+		if err != nil {
+			if response.Errors == nil {
+				response.Errors = make(map[string]*ErrorResponse)
+			}
+			response.Errors[session.CorrelationID], _ = pollErrorResponse(err)
+			continue
+		}
+		response.Responses[session.CorrelationID] = polled
+		response.HasMore = response.HasMore || polled.HasMore
+		for _, data := range polled.Data {
+			size += int64(len(data))
+		}
+	}
+
+	if len(response.Responses) == 0 {
+		return response
+	}
+	// the shared streams are returned once the client is authenticated by a session
+	sharedInteractions := h.pollShared("", shared, filter)
+	response.Extra = sharedInteractions.extra
+	response.TLDData = sharedInteractions.tld
+	response.TokenCursor = sharedInteractions.tokenCursor
+	response.TLDCursor = sharedInteractions.tldCursor
+	response.HasMore = response.HasMore || sharedInteractions.hasMore
+	return response
+}
+
+// empty returns true if the response contains no interaction.
+func (r *BulkPollResponse) empty() bool {
+	for _, response := range r.Responses {
+		if !response.empty() {
+			return false
+		}
+	}
+	return len(r.Extra) == 0 && len(r.TLDData) == 0
+}
+
+// eventsKeepAlive is the interval at which comments are sent on idle event streams.
+var eventsKeepAlive = 30 * time.Second
+
+// eventsHandler is a handler for client event streams, pushing the interactions
+// of a correlation ID as Server-Sent Events as soon as they are stored.
+//
+// Each event contains a cursor based poll response with its cursor as id. The
+// interactions of an event are acknowledged once the next one is sent, or by the
+// after cursor or Last-Event-ID header of the request resuming the stream. The
+// stream is closed if the session is evicted meanwhile.
+func (h *HTTPServer) eventsHandler(w http.ResponseWriter, req *http.Request) {
+	ID := req.URL.Query().Get("id")
+	if ID == "" {
+		jsonError(w, "no id specified for events", http.StatusBadRequest)
+		return
+	}
+	secret := req.URL.Query().Get("secret")
+	if secret == "" {
+		jsonError(w, "no secret specified for events", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parsePollFilter(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid filter specified for events: %s", err), http.StatusBadRequest)
+		return
+	}
+	filter = h.boundPollFilter(filter)
+	shared, err := parseSharedPoll(req)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid shared streams specified for events: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var after uint64
+	value := req.URL.Query().Get("after")
+	if value == "" {
+		value = req.Header.Get("Last-Event-ID")
+	}
+	if value != "" {
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			jsonError(w, fmt.Sprintf("invalid after cursor specified for events: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.checkOwner(requestToken(req), ID); err != nil {
+		h.pollError(w, ID, err)
+		return
+	}
+	// subscribe before the first poll so that no interaction is missed
+	notify, cancel := h.subscribe(shared, ID)
+	defer cancel()
+
+	response, err := h.poll(ID, secret, &after, shared, filter)
+	if err != nil {
+		h.pollError(w, ID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		if !response.empty() {
+			if err := writeEvent(w, response); err != nil {
+				return
+			}
+			flusher.Flush()
+			gologger.Debug().Msgf("Pushed %d interactions for %s correlationID\n", len(response.Data), ID)
+		}
+		after = response.Cursor
+		shared.advance(response)
+
+		// pending pages are pushed right away
+	wait:
+		for !response.HasMore {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-notify:
+				break wait
+			}
+		}
+		if response, err = h.poll(ID, secret, &after, shared, filter); err != nil {
+			gologger.Warning().Msgf("Could not get interactions for %s: %s\n", ID, err)
+			return
+		}
+	}
+}
+
+// subscribe subscribes to the interactions of correlation IDs along with the
+// ones of the shared streams returned by their polls.
+func (h *HTTPServer) subscribe(shared *sharedPoll, IDs ...string) (<-chan struct{}, func()) {
+	ids := append([]string(nil), IDs...)
+	if shared.token && h.options.Token != "" {
+		ids = append(ids, h.options.Token)
+	}
+	if shared.tld && h.options.RootTLD {
+		ids = append(ids, h.options.Domain)
+	}
+	return h.options.Storage.Subscribe(ids...)
+}
+
+// writeEvent writes a poll response as a Server-Sent Event.
+func writeEvent(w io.Writer, response *PollResponse) error {
+	data, err := jsoniter.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", response.Cursor, data)
+	return err
+}
+
+// parsePollFilter parses the filter of a poll request, nil if none is specified.
+//
+// Only the interactions matching the protocol, since and full-id-prefix
+// parameters are returned, up to limit, the other ones are kept for later polls.
+// Cursor based polls return the interactions after the continuation token of
+// the previous page if any.
+func parsePollFilter(req *http.Request) (*storage.Filter, error) {
+	query := req.URL.Query()
+	filter := &storage.Filter{FullIDPrefix: query.Get("full-id-prefix")}
+	if value := query.Get("protocol"); value != "" {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				filter.Protocols = append(filter.Protocols, protocol)
+			}
+		}
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := parseTimestamp(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.Since = since
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit %s", value)
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("continuation"); value != "" {
+		continuation, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid continuation token %s", value)
+		}
+		filter.Continuation = continuation
+	}
+	if len(filter.Protocols) == 0 && filter.Since.IsZero() && filter.FullIDPrefix == "" && filter.Limit == 0 && filter.Continuation == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// boundPollFilter bounds the interactions returned by a poll to the maximum
+// response size of the server so that large backlogs are returned in pages.
+func (h *HTTPServer) boundPollFilter(filter *storage.Filter) *storage.Filter {
+	if h.options.PollMaxInteractions <= 0 && h.options.PollMaxSize <= 0 {
+		return filter
+	}
+	bounded := &storage.Filter{}
+	if filter != nil {
+		*bounded = *filter
+	}
+	if h.options.PollMaxInteractions > 0 && (bounded.Limit == 0 || bounded.Limit > h.options.PollMaxInteractions) {
+		bounded.Limit = h.options.PollMaxInteractions
+	}
+	bounded.MaxSize = h.options.PollMaxSize
+	return bounded
+}
+
+// parseTimestamp parses a RFC3339 timestamp or unix time in seconds.
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", value)
+	}
+	return timestamp, nil
+}
+
+// SessionResponse is the response for a session request
+type SessionResponse struct {
+	// Expiry is the time after which the session is evicted.
+	Expiry time.Time `json:"expiry"`
+	// Remaining is the remaining lifetime of the session in seconds.
+	Remaining int64 `json:"remaining"`
+	// TTL is the lifetime of the session in seconds.
+	TTL int64 `json:"ttl"`
+	// SlidingExpiry is true if the expiry is refreshed on each poll.
+	SlidingExpiry bool `json:"sliding-expiry"`
+}
+
+// sessionHandler is a handler for client session requests
+func (h *HTTPServer) sessionHandler(w http.ResponseWriter, req *http.Request) {
+	ID := req.URL.Query().Get("id")
+	if ID == "" {
+		jsonError(w, "no id specified for session", http.StatusBadRequest)
+		return
+	}
+	secret := req.URL.Query().Get("secret")
+	if secret == "" {
+		jsonError(w, "no secret specified for session", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.checkOwner(requestToken(req), ID); err != nil {
+		jsonError(w, fmt.Sprintf("could not get session: %s", err), http.StatusForbidden)
+		return
+	}
+	session, err := h.options.Storage.GetSession(ID, secret)
+	if err != nil {
+		gologger.Warning().Msgf("Could not get session for %s: %s\n", ID, err)
+		jsonError(w, fmt.Sprintf("could not get session: %s", err), http.StatusBadRequest)
+		return
+	}
+	response := &SessionResponse{
+		Expiry:        session.Expiry,
+		Remaining:     int64(time.Until(session.Expiry) / time.Second),
+		TTL:           int64(session.TTL / time.Second),
+		SlidingExpiry: session.Sliding,
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := jsoniter.NewEncoder(w).Encode(response); err != nil {
+		gologger.Warning().Msgf("Could not encode session for %s: %s\n", ID, err)
+	}
+}
+
+// ErrorCodeSessionEvicted is the error code returned by polls for a
+// session which has expired or was evicted and must be registered again.
+const ErrorCodeSessionEvicted = "session-evicted"
+
+// ErrorResponse is the response for a failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code is a machine readable code for the error.
+	Code string `json:"code,omitempty"`
+	// Reason is the reason of the session eviction.
+	Reason string `json:"reason,omitempty"`
+}
+
+// pollError writes the response for a failed poll.
+func (h *HTTPServer) pollError(w http.ResponseWriter, ID string, err error) {
+	gologger.Warning().Msgf("Could not get interactions for %s: %s\n", ID, err)
+
+	response, code := pollErrorResponse(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = jsoniter.NewEncoder(w).Encode(response)
+}
+
+// pollErrorResponse returns the response for a failed poll along with its status code.
+func pollErrorResponse(err error) (*ErrorResponse, int) {
+	response := &ErrorResponse{Error: fmt.Sprintf("could not get interactions: %s", err)}
+	if err == errSessionOwner {
+		return response, http.StatusForbidden
+	}
+	reason, evicted := storage.IsSessionEvicted(err)
+	if !evicted {
+		return response, http.StatusBadRequest
+	}
+	response.Code = ErrorCodeSessionEvicted
+	response.Reason = string(reason)
+	return response, http.StatusGone
 }
 
 func (h *HTTPServer) corsMiddleware(next http.Handler) http.Handler {
@@ -308,25 +1023,153 @@ func jsonMsg(w http.ResponseWriter, err string, code int) {
 	jsonBody(w, "message", err, code)
 }
 
-func (h *HTTPServer) authMiddleware(next http.Handler) http.Handler {
+// authMiddleware authenticates the token of a request and checks that it is
+// granted the scope of the handler, passing it to the handler in the context.
+func (h *HTTPServer) authMiddleware(scope Scope, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if !h.checkToken(req) {
+		token, ok := h.checkToken(req)
+		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		// the admin endpoints are never open, even if the server doesn't require authentication
+		if token == nil && scope == ScopeAdmin {
+			jsonError(w, "admin endpoints require authentication to be enabled", http.StatusForbidden)
+			return
+		}
+		if token != nil {
+			if !token.Allows(scope) {
+				jsonError(w, fmt.Sprintf("token is not allowed to %s", scope), http.StatusForbidden)
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), tokenContextKey{}, token))
+		}
 		next.ServeHTTP(w, req)
 	})
 }
 
-func (h *HTTPServer) checkToken(req *http.Request) bool {
-	return !h.options.Auth || h.options.Auth && h.options.Token == req.Header.Get("Authorization")
+// checkToken returns the token of a request and whether it is authenticated,
+// the token being nil if the server doesn't require authentication.
+func (h *HTTPServer) checkToken(req *http.Request) (*Token, bool) {
+	if !h.options.Auth {
+		return nil, true
+	}
+	// tokens may be sent as bearer tokens, such as by Prometheus scrapers
+	value := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	// the server token is granted every scope
+	if h.options.Token != "" && subtle.ConstantTimeCompare([]byte(h.options.Token), []byte(value)) == 1 {
+		return &Token{Name: masterTokenName, Scopes: []Scope{ScopeAdmin}}, true
+	}
+	if h.options.Tokens == nil {
+		return nil, false
+	}
+	token := h.options.Tokens.Authenticate(value)
+	return token, token != nil
+}
+
+// errSessionOwner is returned for requests on a session registered by another token.
+var errSessionOwner = errors.New("session was registered by another token")
+
+// checkOwner returns an error if the session of a correlation ID was registered
+// by another token than the one of a request, unless the token is granted the
+// admin scope. Missing sessions are left to be reported by the storage.
+func (h *HTTPServer) checkOwner(token *Token, ID string) error {
+	if token == nil || token.Allows(ScopeAdmin) {
+		return nil
+	}
+	info, err := h.options.Storage.GetSessionInfo(ID)
+	if _, missing := storage.IsSessionEvicted(err); missing {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not get session owner")
+	}
+	if info.Owner != "" && info.Owner != token.Name {
+		return errSessionOwner
+	}
+	return nil
+}
+
+// tokenContextKey is the context key of the token of a request.
+type tokenContextKey struct{}
+
+// requestToken returns the token of an authenticated request, nil if the
+// server doesn't require authentication.
+func requestToken(req *http.Request) *Token {
+	token, _ := req.Context().Value(tokenContextKey{}).(*Token)
+	return token
 }
 
 // metricsHandler is a handler for /metrics endpoint
 func (h *HTTPServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	metrics := h.options.Storage.GetCacheMetrics()
+	if wantsPrometheus(req) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.options.Metrics.writePrometheus(w, metrics)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	_ = jsoniter.NewEncoder(w).Encode(metrics)
 }
+
+// TokenRequest is a request to create an auth token.
+type TokenRequest struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+	// TTL is the lifetime of the token in seconds, it never expires if unset.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// TokensResponse is the response listing the auth tokens of the server.
+type TokensResponse struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// tokensHandler is a handler to list, create and revoke auth tokens.
+func (h *HTTPServer) tokensHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_ = jsoniter.NewEncoder(w).Encode(&TokensResponse{Tokens: h.options.Tokens.List()})
+	case http.MethodPost:
+		r := &TokenRequest{}
+		if err := jsoniter.NewDecoder(req.Body).Decode(r); err != nil {
+			jsonError(w, fmt.Sprintf("could not decode json body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if r.TTL < 0 {
+			jsonError(w, "invalid ttl specified for token", http.StatusBadRequest)
+			return
+		}
+		token := &Token{Name: r.Name, Scopes: r.Scopes}
+		if r.TTL > 0 {
+			token.Expiry = time.Now().Add(time.Duration(r.TTL) * time.Second).UTC()
+		}
+		if err := h.options.Tokens.Add(token); err != nil {
+			jsonError(w, fmt.Sprintf("could not create token: %s", err), http.StatusBadRequest)
+			return
+		}
+		gologger.Debug().Msgf("Created token %s\n", token.Name)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_ = jsoniter.NewEncoder(w).Encode(token)
+	case http.MethodDelete:
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			jsonError(w, "no name specified for token", http.StatusBadRequest)
+			return
+		}
+		if err := h.options.Tokens.Revoke(name); err != nil {
+			jsonError(w, fmt.Sprintf("could not revoke token: %s", err), http.StatusBadRequest)
+			return
+		}
+		gologger.Debug().Msgf("Revoked token %s\n", name)
+		jsonMsg(w, "token revoked", http.StatusOK)
+	default:
+		jsonError(w, "unsupported method for tokens", http.StatusMethodNotAllowed)
+	}
+}
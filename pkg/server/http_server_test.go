@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// registerSessions registers sessions with the secret key "secret" in the storage.
+func registerSessions(t *testing.T, store storage.Backend, count int) []string {
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationIDs := make([]string, count)
+	for i := range correlationIDs {
+		correlationIDs[i] = xid.New().String()
+		err = store.Register(&storage.Registration{CorrelationID: correlationIDs[i], SecretKey: "secret", PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519})
+		require.Nil(t, err, "could not register correlation-id in storage")
+	}
+	return correlationIDs
+}
+
+func TestBulkPoll(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	correlationIDs := registerSessions(t, store, 3)
+	for _, correlationID := range correlationIDs[:2] {
+		require.Nil(t, store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`)), "could not add interaction")
+	}
+	require.Nil(t, store.SetID("token"), "could not set token id")
+	require.Nil(t, store.AddInteractionWithId("token", []byte(`{"protocol":"smb"}`)), "could not add token interaction")
+
+	h := &HTTPServer{options: &Options{Token: "token", Storage: store, PollMaxSize: 1}, sharedCursors: newSharedCursors(0)}
+	handler := h.authMiddleware(ScopePoll, http.HandlerFunc(h.bulkPollHandler))
+	request := func(target string, sessions ...string) (*httptest.ResponseRecorder, *BulkPollResponse) {
+		r := &BulkPollRequest{}
+		for _, correlationID := range sessions {
+			r.Sessions = append(r.Sessions, &BulkPollSession{CorrelationID: correlationID, SecretKey: "secret"})
+		}
+		body, err := jsoniter.Marshal(r)
+		require.Nil(t, err, "could not marshal bulk poll request")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+
+		response := &BulkPollResponse{}
+		if recorder.Code == http.StatusOK {
+			require.Nil(t, jsoniter.NewDecoder(recorder.Body).Decode(response), "could not decode bulk poll response")
+		}
+		return recorder, response
+	}
+
+	tooMany := make([]string, MaxBulkPollSessions+1)
+	recorder, _ := request("/poll/bulk", tooMany...)
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "could bulk poll too many sessions")
+
+	// the remaining sessions are left out once the maximum size is reached
+	recorder, response := request("/poll/bulk?shared=token", correlationIDs[0], correlationIDs[1], "missing")
+	require.Equal(t, http.StatusOK, recorder.Code, "could not bulk poll sessions")
+	require.Len(t, response.Responses, 1, "could not truncate bulk poll response")
+	require.Len(t, response.Responses[correlationIDs[0]].Data, 1, "could not poll first session")
+	require.True(t, response.HasMore, "could not report truncated sessions")
+
+	// sessions which can't be polled are reported by correlation-id
+	recorder, response = request("/poll/bulk?shared=token&token-after=1", correlationIDs[2], "missing", correlationIDs[1])
+	require.Equal(t, http.StatusOK, recorder.Code, "could not bulk poll sessions")
+	require.Len(t, response.Responses, 2, "could not poll sessions")
+	require.Len(t, response.Responses[correlationIDs[1]].Data, 1, "could not poll left out session")
+	require.Equal(t, ErrorCodeSessionEvicted, response.Errors["missing"].Code, "could not report missing session")
+	require.Empty(t, response.Extra, "could return acknowledged token interactions")
+	require.Equal(t, uint64(1), response.TokenCursor, "could not keep token cursor")
+
+	// the shared streams are returned along with the polled sessions
+	_, response = request("/poll/bulk?shared=token", correlationIDs[2])
+	require.Len(t, response.Extra, 1, "could not return token interactions")
+	require.Equal(t, uint64(1), response.TokenCursor, "could not return token cursor")
+	_, response = request("/poll/bulk", correlationIDs[2])
+	require.Empty(t, response.Extra, "could return token interactions without shared cursors")
+	_, response = request("/poll/bulk?shared=token", "missing")
+	require.Empty(t, response.Extra, "could return token interactions without polled session")
+}
+
+func TestLongPoll(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	correlationID := registerSessions(t, store, 1)[0]
+	h := &HTTPServer{options: &Options{Storage: store, PollMaxWait: 1 * time.Second}, sharedCursors: newSharedCursors(0)}
+	handler := h.authMiddleware(ScopePoll, http.HandlerFunc(h.pollHandler))
+	request := func(wait string) (*httptest.ResponseRecorder, *PollResponse) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/poll?id="+correlationID+"&secret=secret&wait="+wait, nil))
+
+		response := &PollResponse{}
+		if recorder.Code == http.StatusOK {
+			require.Nil(t, jsoniter.NewDecoder(recorder.Body).Decode(response), "could not decode poll response")
+		}
+		return recorder, response
+	}
+
+	for _, wait := range []string{"-1", "soon"} {
+		recorder, _ := request(wait)
+		require.Equal(t, http.StatusBadRequest, recorder.Code, "could long poll with invalid wait %s", wait)
+	}
+
+	// waits are bounded by the maximum wait of the server
+	start := time.Now()
+	recorder, response := request("30")
+	require.Equal(t, http.StatusOK, recorder.Code, "could not long poll")
+	require.Empty(t, response.Data, "could return interactions")
+	require.Equal(t, 1, response.MaxWait, "could not advertise maximum wait")
+	require.WithinDuration(t, start.Add(1*time.Second), time.Now(), 500*time.Millisecond, "could not wait up to maximum wait")
+
+	// long polls return as soon as an interaction is added
+	h.options.PollMaxWait = 30 * time.Second
+	responses := make(chan *PollResponse, 1)
+	go func() {
+		_, response := request("30")
+		responses <- response
+	}()
+	select {
+	case <-responses:
+		t.Fatal("could return long poll without interactions")
+	case <-time.After(200 * time.Millisecond):
+	}
+	require.Nil(t, store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`)), "could not add interaction")
+	select {
+	case response := <-responses:
+		require.Len(t, response.Data, 1, "could not return added interaction")
+		require.Equal(t, 30, response.MaxWait, "could not advertise maximum wait")
+	case <-time.After(5 * time.Second):
+		t.Fatal("could not return long poll once interaction was added")
+	}
+}
+
+// readEvent reads the next event of an event stream skipping its comments.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, *PollResponse) {
+	var id string
+	response := &PollResponse{}
+	for {
+		line, err := reader.ReadString('\n')
+		require.Nil(t, err, "could not read event stream")
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			require.Nil(t, jsoniter.UnmarshalFromString(strings.TrimPrefix(line, "data: "), response), "could not decode event data")
+		case line == "" && id != "":
+			return id, response
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	keepAlive := eventsKeepAlive
+	eventsKeepAlive = 100 * time.Millisecond
+	defer func() { eventsKeepAlive = keepAlive }()
+
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	correlationID := registerSessions(t, store, 1)[0]
+	h := &HTTPServer{options: &Options{Storage: store}, sharedCursors: newSharedCursors(0)}
+	ts := httptest.NewServer(h.authMiddleware(ScopePoll, http.HandlerFunc(h.eventsHandler)))
+	defer ts.Close()
+	connect := func(lastEventID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/events?id="+correlationID+"&secret=secret", nil)
+		require.Nil(t, err, "could not create events request")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := ts.Client().Do(req)
+		require.Nil(t, err, "could not connect to event stream")
+		return resp
+	}
+
+	require.Nil(t, store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`)), "could not add interaction")
+	resp := connect("")
+	require.Equal(t, http.StatusOK, resp.StatusCode, "could not connect to event stream")
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"), "could not stream events")
+	reader := bufio.NewReader(resp.Body)
+
+	// pending interactions are pushed right away with their cursor as id
+	id, response := readEvent(t, reader)
+	require.Equal(t, "1", id, "could not set event id")
+	require.Equal(t, []uint64{1}, response.Sequences, "could not push pending interaction")
+
+	// idle streams are kept alive with comments until interactions are added
+	line, err := reader.ReadString('\n')
+	require.Nil(t, err, "could not read event stream")
+	require.Equal(t, ": keep-alive\n", line, "could not keep idle stream alive")
+	require.Nil(t, store.AddInteraction(correlationID, []byte(`{"protocol":"http"}`)), "could not add interaction")
+	id, response = readEvent(t, reader)
+	require.Equal(t, "2", id, "could not set event id")
+	require.Equal(t, []uint64{2}, response.Sequences, "could not push added interaction")
+	resp.Body.Close()
+
+	// resumed streams push the interactions after the last event received
+	resp = connect("1")
+	defer resp.Body.Close()
+	id, response = readEvent(t, bufio.NewReader(resp.Body))
+	require.Equal(t, "2", id, "could not resume event stream")
+	require.Equal(t, []uint64{2}, response.Sequences, "could not push unacknowledged interaction")
+
+	invalid := connect("invalid")
+	invalid.Body.Close()
+	require.Equal(t, http.StatusBadRequest, invalid.StatusCode, "could resume event stream with invalid id")
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/projectdiscovery/interactsh/pkg/server/acme"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+)
+
+// streamSession is the stream of the interactions stored for their session.
+const streamSession = "session"
+
+// interactionKey identifies the counter of the interactions of a protocol
+// stored in a stream, either for their session or in a shared stream.
+type interactionKey struct {
+	protocol string
+	stream   string
+}
+
+// metricsInteractions are the counters of interactions always exposed, so
+// that their series exist before the first interaction.
+var metricsInteractions = []interactionKey{
+	{"dns", streamSession}, {"http", streamSession}, {"https", streamSession}, {"smtp", streamSession},
+	{"smb", SharedStreamToken}, {"responder", SharedStreamToken},
+}
+
+// pollBuckets are the upper bounds in seconds of the buckets of the poll
+// duration histograms, long polls lasting up to their wait.
+var pollBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics contains the counters of the servers exposed on /metrics along
+// with the metrics of the storage. Its methods do nothing on a nil Metrics.
+type Metrics struct {
+	mutex sync.Mutex
+	// interactions is the number of stored interactions by protocol and stream.
+	interactions map[interactionKey]uint64
+	// unknown is the number of interactions dropped by protocol because
+	// their correlation-id has no session.
+	unknown         map[string]uint64
+	registrations   uint64
+	deregistrations uint64
+	// polls contains the poll durations by endpoint.
+	polls   map[string]*histogram
+	autoTLS *acme.AutoTLS
+}
+
+// histogram is a cumulative histogram of durations in seconds.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewMetrics creates new metrics for the servers.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		interactions: make(map[interactionKey]uint64),
+		unknown:      make(map[string]uint64),
+		polls:        make(map[string]*histogram),
+	}
+}
+
+// recordInteraction records the result of storing an interaction of a
+// protocol in a stream, an interaction of the root tld being stored in the
+// tld stream as well as for its session.
+func (m *Metrics) recordInteraction(protocol, stream string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		if _, evicted := storage.IsSessionEvicted(err); !evicted {
+			return
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err != nil {
+		m.unknown[protocol]++
+	} else {
+		m.interactions[interactionKey{protocol, stream}]++
+	}
+}
+
+// recordRegistration records a registration, or a deregistration if registered is false.
+func (m *Metrics) recordRegistration(registered bool) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if registered {
+		m.registrations++
+	} else {
+		m.deregistrations++
+	}
+}
+
+// recordPoll records the duration of a poll of an endpoint started at the provided time.
+func (m *Metrics) recordPoll(endpoint string, start time.Time) {
+	if m == nil {
+		return
+	}
+	seconds := time.Since(start).Seconds()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	polls, ok := m.polls[endpoint]
+	if !ok {
+		polls = &histogram{counts: make([]uint64, len(pollBuckets))}
+		m.polls[endpoint] = polls
+	}
+	for i, bound := range pollBuckets {
+		if seconds <= bound {
+			polls.counts[i]++
+		}
+	}
+	polls.count++
+	polls.sum += seconds
+}
+
+// setAutoTLS sets the certificate whose expiry is exposed.
+func (m *Metrics) setAutoTLS(autoTLS *acme.AutoTLS) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.autoTLS = autoTLS
+	m.mutex.Unlock()
+}
+
+// writePrometheus writes the metrics along with the ones of the storage in
+// the Prometheus text exposition format.
+func (m *Metrics) writePrometheus(w io.Writer, cache *storage.CacheMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeMetricHeader(w, "interactsh_interactions_total", "counter", "Interactions stored by protocol and stream (session, token or tld).")
+	keys := append([]interactionKey(nil), metricsInteractions...)
+	for key := range m.interactions {
+		if !containsInteractionKey(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol == keys[j].protocol {
+			return keys[i].stream < keys[j].stream
+		}
+		return keys[i].protocol < keys[j].protocol
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "interactsh_interactions_total{protocol=%q,stream=%q} %d\n", key.protocol, key.stream, m.interactions[key])
+	}
+	writeMetricHeader(w, "interactsh_interactions_unknown_total", "counter", "Interactions dropped by protocol because their correlation-id has no session.")
+	protocols := []string{"dns", "http", "https", "smtp"}
+	for protocol := range m.unknown {
+		if !stringsContain(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		fmt.Fprintf(w, "interactsh_interactions_unknown_total{protocol=%q} %d\n", protocol, m.unknown[protocol])
+	}
+	writeMetricHeader(w, "interactsh_registrations_total", "counter", "Sessions registered.")
+	fmt.Fprintf(w, "interactsh_registrations_total %d\n", m.registrations)
+	writeMetricHeader(w, "interactsh_deregistrations_total", "counter", "Sessions deregistered by their client.")
+	fmt.Fprintf(w, "interactsh_deregistrations_total %d\n", m.deregistrations)
+
+	writeMetricHeader(w, "interactsh_poll_duration_seconds", "histogram", "Duration of polls by endpoint, including the wait of long polls.")
+	endpoints := make([]string, 0, len(m.polls))
+	for endpoint := range m.polls {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		polls := m.polls[endpoint]
+		for i, bound := range pollBuckets {
+			fmt.Fprintf(w, "interactsh_poll_duration_seconds_bucket{endpoint=%q,le=\"%g\"} %d\n", endpoint, bound, polls.counts[i])
+		}
+		fmt.Fprintf(w, "interactsh_poll_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n", endpoint, polls.count)
+		fmt.Fprintf(w, "interactsh_poll_duration_seconds_sum{endpoint=%q} %g\n", endpoint, polls.sum)
+		fmt.Fprintf(w, "interactsh_poll_duration_seconds_count{endpoint=%q} %d\n", endpoint, polls.count)
+	}
+
+	writeMetricHeader(w, "interactsh_sessions", "gauge", "Active sessions.")
+	fmt.Fprintf(w, "interactsh_sessions %d\n", cache.Sessions)
+	writeMetricHeader(w, "interactsh_storage_bytes", "gauge", "Size in bytes of the pending interactions.")
+	fmt.Fprintf(w, "interactsh_storage_bytes %d\n", cache.Size)
+	writeMetricHeader(w, "interactsh_evicted_sessions_total", "counter", "Sessions evicted by reason.")
+	reasons := make([]string, 0, len(cache.Evictions))
+	for reason := range cache.Evictions {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "interactsh_evicted_sessions_total{reason=%q} %d\n", reason, cache.Evictions[storage.EvictionReason(reason)])
+	}
+
+	if m.autoTLS != nil {
+		if expiry := m.autoTLS.NotAfter(); !expiry.IsZero() {
+			writeMetricHeader(w, "interactsh_certificate_expiry_timestamp_seconds", "gauge", "Expiry of the ACME certificate in unix seconds.")
+			fmt.Fprintf(w, "interactsh_certificate_expiry_timestamp_seconds %d\n", expiry.Unix())
+		}
+	}
+}
+
+// containsInteractionKey returns true if the slice contains the key.
+func containsInteractionKey(keys []interactionKey, key interactionKey) bool {
+	for _, item := range keys {
+		if item == key {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMetricHeader writes the help and type lines of a metric.
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// stringsContain returns true if the slice contains the value.
+func stringsContain(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsPrometheus returns true if a metrics request asks for the Prometheus
+// text format, either explicitly or through the Accept header of scrapers.
+func wantsPrometheus(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "prometheus"
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+// httpProtocol returns the protocol of a http request for the metrics.
+func httpProtocol(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	h := &HTTPServer{options: &Options{Storage: store, Metrics: NewMetrics()}}
+	h.options.Metrics.recordInteraction("dns", streamSession, nil)
+	h.options.Metrics.recordInteraction("dns", SharedStreamTLD, nil)
+	h.options.Metrics.recordInteraction("http", streamSession, store.AddInteraction("unknown", []byte(`{}`)))
+	h.options.Metrics.recordRegistration(true)
+	h.options.Metrics.recordPoll("poll", time.Now())
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	recorder := httptest.NewRecorder()
+	h.metricsHandler(recorder, req)
+	require.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"), "could not get prometheus format")
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`interactsh_interactions_total{protocol="dns",stream="session"} 1`,
+		`interactsh_interactions_total{protocol="dns",stream="tld"} 1`,
+		`interactsh_interactions_total{protocol="smb",stream="token"} 0`,
+		`interactsh_interactions_unknown_total{protocol="http"} 1`,
+		`interactsh_registrations_total 1`,
+		`interactsh_poll_duration_seconds_count{endpoint="poll"} 1`,
+		`interactsh_sessions 0`,
+	} {
+		require.Contains(t, body, line+"\n", "could not get metric")
+	}
+
+	// the JSON metrics are kept for other clients
+	recorder = httptest.NewRecorder()
+	h.metricsHandler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, recorder.Body.String(), `"active-session"`, "could not get json metrics")
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Record is a static dns record served by the dns server.
+type Record struct {
+	// Name is the name of the record relative to the domain, @ for the domain
+	// itself. Absolute names ending with a dot are only used to resolve the
+	// targets of CNAME records.
+	Name string `yaml:"name"`
+	// Type is the type of the record, such as A, AAAA, CNAME, TXT, MX, SRV or CAA.
+	Type string `yaml:"type"`
+	// Value is the data of the record in zone file format, such as
+	// "10 mail.example.com." for a MX record.
+	Value string `yaml:"value"`
+	// TTL is the time to live of the record in seconds, 3600 if unset.
+	TTL uint32 `yaml:"ttl,omitempty"`
+}
+
+// defaultRecordTTL is the time to live of the records without one.
+const defaultRecordTTL = 3600
+
+// maxCNAMEChain is the maximum number of CNAME records followed by a lookup.
+const maxCNAMEChain = 8
+
+// DefaultRecords contains the records served without a records file, and
+// along with its records otherwise, for the cloud metadata services.
+var DefaultRecords = []*Record{
+	{Name: "aws", Type: "A", Value: "169.254.169.254"},
+	{Name: "aws", Type: "AAAA", Value: "fd00:ec2::254"},
+	{Name: "alibaba", Type: "A", Value: "100.100.100.200"},
+	{Name: "gcp", Type: "A", Value: "169.254.169.254"},
+	{Name: "azure", Type: "A", Value: "169.254.169.254"},
+	{Name: "oracle", Type: "A", Value: "169.254.169.254"},
+	{Name: "digitalocean", Type: "A", Value: "169.254.169.254"},
+	{Name: "app", Type: "CNAME", Value: "projectdiscovery.github.io."},
+	{Name: "projectdiscovery.github.io.", Type: "A", Value: "185.199.108.153"},
+	{Name: "projectdiscovery.github.io.", Type: "A", Value: "185.199.110.153"},
+	{Name: "projectdiscovery.github.io.", Type: "A", Value: "185.199.111.153"},
+}
+
+// recordsFile is the format of the records file.
+type recordsFile struct {
+	Records []*Record `yaml:"records"`
+}
+
+// RecordStore contains the static records served by the dns server, the
+// default records along with the ones of its file if any. The records of
+// a name of the file replace the default records of the name.
+type RecordStore struct {
+	path   string
+	origin string
+
+	mutex   sync.RWMutex
+	records map[string][]dns.RR
+}
+
+// NewRecordStore creates a record store of the default records for a domain.
+func NewRecordStore(domain string) *RecordStore {
+	store := &RecordStore{origin: strings.ToLower(dns.Fqdn(domain))}
+	// the default records are valid
+	store.records, _ = store.parse(DefaultRecords)
+	return store
+}
+
+// LoadRecordStore loads a record store for a domain from a YAML records file.
+func LoadRecordStore(path, domain string) (*RecordStore, error) {
+	store := NewRecordStore(domain)
+	store.path = path
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reloads the records of the file of the store, keeping the current
+// records if it is not valid.
+func (s *RecordStore) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return errors.Wrap(err, "could not read records file")
+	}
+	file := &recordsFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return errors.Wrap(err, "could not parse records file")
+	}
+	records, err := s.parse(file.Records)
+	if err != nil {
+		return err
+	}
+	defaults, _ := s.parse(DefaultRecords)
+	for name, rrs := range defaults {
+		if _, ok := records[name]; !ok {
+			records[name] = rrs
+		}
+	}
+
+	s.mutex.Lock()
+	s.records = records
+	s.mutex.Unlock()
+	return nil
+}
+
+// parse parses records into dns records by lowercase fully qualified name.
+func (s *RecordStore) parse(records []*Record) (map[string][]dns.RR, error) {
+	parsed := make(map[string][]dns.RR)
+	for _, record := range records {
+		name := s.qualify(record.Name)
+		ttl := record.TTL
+		if ttl == 0 {
+			ttl = defaultRecordTTL
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, record.Type, record.Value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse %s record of %s", record.Type, record.Name)
+		}
+		if rr == nil {
+			return nil, errors.Errorf("no value specified for %s record of %s", record.Type, record.Name)
+		}
+		parsed[name] = append(parsed[name], rr)
+	}
+	return parsed, nil
+}
+
+// qualify returns the lowercase fully qualified name of a record name.
+func (s *RecordStore) qualify(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch {
+	case name == "" || name == "@":
+		return s.origin
+	case strings.HasSuffix(name, "."):
+		return name
+	default:
+		return name + "." + s.origin
+	}
+}
+
+// lookup returns the records of a query for a name of the domain, following
+// the CNAME records of the name, and whether the name has records of any
+// type. The domain itself is never reported as found since the server
+// answers its other records.
+func (s *RecordStore) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	if s == nil {
+		return nil, false
+	}
+	name = strings.ToLower(name)
+	if name != s.origin && !strings.HasSuffix(name, "."+s.origin) {
+		return nil, false
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, found := s.records[name]
+	found = found && name != s.origin
+	var answers []dns.RR
+	for i := 0; i < maxCNAMEChain; i++ {
+		var target string
+		for _, rr := range s.records[name] {
+			rrtype := rr.Header().Rrtype
+			if qtype == dns.TypeANY || rrtype == qtype {
+				answers = append(answers, dns.Copy(rr))
+			} else if cname, ok := rr.(*dns.CNAME); ok {
+				answers = append(answers, dns.Copy(rr))
+				target = strings.ToLower(cname.Target)
+			}
+		}
+		if target == "" {
+			break
+		}
+		name = target
+	}
+	return answers, found
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// lookupRecords returns the records of a query for a name of the store.
+func lookupRecords(store *RecordStore, name string, qtype uint16) []dns.RR {
+	answers, _ := store.lookup(name, qtype)
+	return answers
+}
+
+func TestRecordStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interactsh-records")
+	require.Nil(t, err, "could not create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "records.yaml")
+	err = ioutil.WriteFile(path, []byte(`records:
+  - name: aws
+    type: A
+    value: 10.0.0.1
+  - name: "@"
+    type: CAA
+    value: 0 issue "letsencrypt.org"
+  - name: _sip._tcp
+    type: SRV
+    value: 10 5 5060 sip.example.com.
+    ttl: 60
+`), 0600)
+	require.Nil(t, err, "could not write records file")
+
+	store, err := LoadRecordStore(path, "Example.com")
+	require.Nil(t, err, "could not load records file")
+
+	// records of the file replace the default records of their name
+	answers := lookupRecords(store, "AWS.example.com.", dns.TypeA)
+	require.Len(t, answers, 1, "could not lookup record")
+	require.Equal(t, "10.0.0.1", answers[0].(*dns.A).A.String(), "could not replace default record")
+	require.Empty(t, lookupRecords(store, "aws.example.com.", dns.TypeAAAA), "could keep replaced default record")
+	require.Len(t, lookupRecords(store, "example.com.", dns.TypeCAA), 1, "could not lookup apex record")
+	answers = lookupRecords(store, "_sip._tcp.example.com.", dns.TypeSRV)
+	require.Len(t, answers, 1, "could not lookup srv record")
+	require.Equal(t, uint32(60), answers[0].Header().Ttl, "could not set record ttl")
+
+	// cname records are followed to the records of their target
+	answers = lookupRecords(store, "app.example.com.", dns.TypeA)
+	require.Len(t, answers, 4, "could not follow cname record")
+	require.Equal(t, dns.TypeCNAME, answers[0].Header().Rrtype, "could not answer cname record first")
+	require.Empty(t, lookupRecords(store, "projectdiscovery.github.io.", dns.TypeA), "could lookup name outside of the domain")
+
+	// invalid files keep the current records
+	err = ioutil.WriteFile(path, []byte("records:\n  - name: www\n    type: A\n    value: invalid\n"), 0600)
+	require.Nil(t, err, "could not write records file")
+	require.NotNil(t, store.Reload(), "could reload invalid records file")
+	require.Len(t, lookupRecords(store, "_sip._tcp.example.com.", dns.TypeSRV), 1, "could not keep records of invalid file")
+
+	err = ioutil.WriteFile(path, []byte("records:\n  - name: www\n    type: AAAA\n    value: 2001:db8::1\n"), 0600)
+	require.Nil(t, err, "could not write records file")
+	require.Nil(t, store.Reload(), "could not reload records file")
+	require.Len(t, lookupRecords(store, "www.example.com.", dns.TypeAAAA), 1, "could not lookup reloaded record")
+	require.Empty(t, lookupRecords(store, "_sip._tcp.example.com.", dns.TypeSRV), "could keep removed record")
+	require.Len(t, lookupRecords(store, "aws.example.com.", dns.TypeAAAA), 1, "could not restore default record")
+
+	// names are found whatever the query type, except the domain itself
+	_, found := store.lookup("aws.example.com.", dns.TypeTXT)
+	require.True(t, found, "could not find name without records of query type")
+	_, found = store.lookup("other.example.com.", dns.TypeA)
+	require.False(t, found, "could find name without records")
+}
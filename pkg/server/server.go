@@ -1,9 +1,11 @@
 package server
 
 import (
+	"net"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/projectdiscovery/interactsh/pkg/storage"
 )
 
@@ -17,6 +19,8 @@ type Interaction struct {
 	FullId string `json:"full-id"`
 	// QType is the question type for the interaction
 	QType string `json:"q-type,omitempty"`
+	// Transport is the transport of the dns interaction, udp or tcp.
+	Transport string `json:"transport,omitempty"`
 	// RawRequest is the raw request received by the interactsh server.
 	RawRequest string `json:"raw-request,omitempty"`
 	// RawResponse is the raw response sent by the interactsh server.
@@ -35,20 +39,123 @@ type Options struct {
 	Domain string
 	// IPAddress is the IP address of the current server.
 	IPAddress string
+	// IPv6Address is the IPv6 address of the current server, answered to AAAA queries.
+	IPv6Address string
 	// ListenIP is the IP address to listen servers on
 	ListenIP string
+	// ListenIPv6 is the IPv6 address to listen servers on along with ListenIP.
+	ListenIPv6 string
+	// DNSListeners contains the addresses of the dns listeners, port 53 of ListenIP if nil.
+	DNSListeners []string
+	// HTTPListeners contains the addresses of the http listeners, port 80 of ListenIP if nil.
+	HTTPListeners []string
+	// HTTPSListeners contains the addresses of the https listeners, port 443 of ListenIP if nil.
+	HTTPSListeners []string
+	// SMTPListeners contains the addresses of the smtp listeners, ports 25 and 587 of ListenIP if nil.
+	SMTPListeners []string
+	// SMTPSListeners contains the addresses of the smtps listeners, port 465 of ListenIP if nil.
+	SMTPSListeners []string
+	// Records contains the static records served by the dns server.
+	Records *RecordStore
 	// Hostmaster is the hostmaster email for the server.
 	Hostmaster string
 	// Storage is a storage for interaction data storage
-	Storage *storage.Storage
+	Storage storage.Backend
 	// Auth requires client to authenticate
 	Auth bool
 	// Token required to retrieve interactions
 	Token string
+	// Tokens contains the named auth tokens with scopes accepted along with Token.
+	Tokens *TokenStore
 	// Enable root tld interactions
 	RootTLD bool
 	// OriginURL for the HTTP Server
 	OriginURL string
+	// PollMaxInteractions is the maximum number of interactions returned by a poll.
+	PollMaxInteractions int
+	// PollMaxSize is the maximum size in bytes of the interactions returned by a poll.
+	PollMaxSize int64
+	// PollMaxWait is the maximum duration a long poll waits for interactions.
+	PollMaxWait time.Duration
+	// Webhooks enables the delivery of interactions to the webhook registered by sessions.
+	Webhooks bool
+	// WebhookQueueSize is the maximum number of sessions waiting for a webhook delivery.
+	WebhookQueueSize int
+	// SharedRetention is the duration for which the interactions of the auth
+	// token and root tld are kept for the clients reading them.
+	SharedRetention time.Duration
+	// Metrics contains the counters of the servers exposed on /metrics.
+	Metrics *Metrics
+}
+
+// listenAddresses returns the addresses of the listeners of a protocol, the
+// default ports on the listen IPs if they are nil and none if they are empty.
+// Addresses without a host, such as :8080 or 8080, listen on the listen IPs.
+func (options *Options) listenAddresses(listeners []string, defaultPorts ...string) ([]string, error) {
+	if listeners == nil {
+		listeners = defaultPorts
+	}
+	addresses := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		if !strings.Contains(listener, ":") {
+			listener = ":" + listener
+		}
+		host, port, err := net.SplitHostPort(listener)
+		if err != nil || port == "" {
+			return nil, errors.Errorf("invalid listen address %s", listener)
+		}
+		if host != "" {
+			addresses = append(addresses, net.JoinHostPort(host, port))
+			continue
+		}
+		for _, host := range options.listenHosts() {
+			addresses = append(addresses, net.JoinHostPort(host, port))
+		}
+	}
+	return addresses, nil
+}
+
+// listenHosts returns the hosts of the listeners without host. Unspecified
+// listen IPs are listened on with a single dual-stack listener.
+func (options *Options) listenHosts() []string {
+	if isUnspecifiedIP(options.ListenIP) && (options.ListenIPv6 == "" || isUnspecifiedIP(options.ListenIPv6)) {
+		return []string{""}
+	}
+	hosts := []string{options.ListenIP}
+	if options.ListenIPv6 != "" {
+		hosts = append(hosts, options.ListenIPv6)
+	}
+	return hosts
+}
+
+// isUnspecifiedIP returns true if the IP is empty or unspecified, such as 0.0.0.0 or ::.
+func isUnspecifiedIP(value string) bool {
+	if value == "" {
+		return true
+	}
+	ip := net.ParseIP(value)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// listenNetwork returns the network of a listener on an address. Listeners
+// on an IP are restricted to its stack so that the ipv4 and ipv6 listeners
+// of a port don't conflict, only the ones without host being dual-stack.
+func listenNetwork(network, address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return network + "4"
+	default:
+		return network + "6"
+	}
+}
+
+// listen listens on a tcp address with the network of its stack.
+func listen(address string) (net.Listener, error) {
+	return net.Listen(listenNetwork("tcp", address), address)
 }
 
 // URLReflection returns a reversed part of the URL payload
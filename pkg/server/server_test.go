@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestListenAddresses(t *testing.T) {
+	options := &Options{ListenIP: "10.0.0.1"}
+
+	addresses, err := options.listenAddresses(nil, "25", "587")
+	require.Nil(t, err, "could not get default addresses")
+	require.Equal(t, []string{"10.0.0.1:25", "10.0.0.1:587"}, addresses, "could not get default addresses")
+
+	addresses, err = options.listenAddresses([]string{":8080", "8443", "127.0.0.1:80", "[::1]:53"}, "80")
+	require.Nil(t, err, "could not get addresses")
+	require.Equal(t, []string{"10.0.0.1:8080", "10.0.0.1:8443", "127.0.0.1:80", "[::1]:53"}, addresses, "could not get addresses")
+
+	addresses, err = options.listenAddresses([]string{}, "80")
+	require.Nil(t, err, "could not get disabled addresses")
+	require.Empty(t, addresses, "could get addresses of disabled listeners")
+
+	// listeners without host are bound on both stacks
+	options.ListenIPv6 = "::"
+	addresses, err = options.listenAddresses([]string{"53"}, "53")
+	require.Nil(t, err, "could not get dual-stack addresses")
+	require.Equal(t, []string{"10.0.0.1:53", "[::]:53"}, addresses, "could not get dual-stack addresses")
+	require.Equal(t, "udp4", listenNetwork("udp", addresses[0]), "could not get ipv4 network")
+	require.Equal(t, "udp6", listenNetwork("udp", addresses[1]), "could not get ipv6 network")
+
+	dualStack := &Options{ListenIP: "0.0.0.0", ListenIPv6: "::"}
+	addresses, err = dualStack.listenAddresses(nil, "80")
+	require.Nil(t, err, "could not get wildcard addresses")
+	require.Equal(t, []string{":80"}, addresses, "could not get single dual-stack wildcard address")
+	require.Equal(t, "tcp", listenNetwork("tcp", addresses[0]), "could not get dual-stack network")
+
+	_, err = options.listenAddresses([]string{"127.0.0.1:"}, "80")
+	require.NotNil(t, err, "could get address without port")
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	server, err := NewSMTPServer(&Options{Domain: "example.com", SMTPListeners: []string{"127.0.0.1:25"}, SMTPSListeners: []string{"127.0.0.1:465"}})
+	require.Nil(t, err, "could not create smtp server")
+	for _, srv := range append(server.servers, server.tlsservers...) {
+		require.Equal(t, smtpTimeout, srv.Timeout, "could not set timeout of %s", srv.Addr)
+	}
+}
+
+func TestSessionEvicted(t *testing.T) {
+	h := &HTTPServer{options: &Options{}, sharedCursors: newSharedCursors(0)}
+	store := storage.NewWithOptions(&storage.Options{EvictionTTL: 1 * time.Hour, OnEviction: h.SessionEvicted})
+	defer store.Close()
+	h.options.Storage = store
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	for _, correlationID := range []string{"evicted", "deregistered"} {
+		err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519})
+		require.Nil(t, err, "could not register correlation-id in storage")
+		h.sharedCursors.set(correlationID, 1, 2)
+	}
+
+	require.Nil(t, store.EvictSession("evicted"), "could not evict session")
+	require.Nil(t, store.RemoveID("deregistered", "secret"), "could not deregister session")
+	require.Empty(t, h.sharedCursors.cursors, "could keep shared cursors of removed sessions")
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+)
+
+const (
+	// SharedStreamToken is the stream of the interactions captured for the auth
+	// token, such as the ones of the smb and responder servers.
+	SharedStreamToken = "token"
+	// SharedStreamTLD is the stream of the interactions captured for the root tld.
+	SharedStreamTLD = "tld"
+)
+
+// sharedPoll contains the shared streams returned by a poll along with the
+// cursors of the client for each of them.
+//
+// Shared streams are delivered to every authenticated client, each one
+// following them with its own cursor.
+type sharedPoll struct {
+	token      bool
+	tokenAfter uint64
+	tld        bool
+	tldAfter   uint64
+	// legacy is true for clients which don't select the shared streams, their
+	// cursors are kept by the server for their correlation-id.
+	legacy bool
+}
+
+// parseSharedPoll parses the shared streams of a poll request.
+//
+// The shared parameter contains the streams returned by the poll, along with
+// the token-after and tld-after cursors of the client. All the streams are
+// returned with cursors kept by the server if it is not specified. Only the
+// streams the token of the request is granted the scope of are returned.
+func parseSharedPoll(req *http.Request) (*sharedPoll, error) {
+	shared, err := parseSharedStreams(req)
+	if err != nil {
+		return nil, err
+	}
+	if token := requestToken(req); token != nil {
+		shared.token = shared.token && token.Allows(ScopeViewSMB)
+		shared.tld = shared.tld && token.Allows(ScopeViewRootTLD)
+	}
+	return shared, nil
+}
+
+// parseSharedStreams parses the shared streams and cursors of a poll request.
+func parseSharedStreams(req *http.Request) (*sharedPoll, error) {
+	query := req.URL.Query()
+	if _, ok := query["shared"]; !ok {
+		return &sharedPoll{token: true, tld: true, legacy: true}, nil
+	}
+	shared := &sharedPoll{}
+	for _, stream := range strings.Split(query.Get("shared"), ",") {
+		switch strings.TrimSpace(stream) {
+		case SharedStreamToken:
+			shared.token = true
+		case SharedStreamTLD:
+			shared.tld = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown shared stream %s", stream)
+		}
+	}
+	var err error
+	if shared.tokenAfter, err = parseSharedCursor(query.Get("token-after")); err != nil {
+		return nil, err
+	}
+	if shared.tldAfter, err = parseSharedCursor(query.Get("tld-after")); err != nil {
+		return nil, err
+	}
+	return shared, nil
+}
+
+// parseSharedCursor parses the cursor of a shared stream, zero if unset.
+func parseSharedCursor(value string) (uint64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shared cursor %s", value)
+	}
+	return cursor, nil
+}
+
+// advance advances the cursors of the client to the ones of a response.
+func (s *sharedPoll) advance(response *PollResponse) {
+	if response.TokenCursor > s.tokenAfter {
+		s.tokenAfter = response.TokenCursor
+	}
+	if response.TLDCursor > s.tldAfter {
+		s.tldAfter = response.TLDCursor
+	}
+}
+
+// sharedInteractions contains the interactions of the shared streams returned by a poll.
+type sharedInteractions struct {
+	extra       []string
+	tld         []string
+	tokenCursor uint64
+	tldCursor   uint64
+	hasMore     bool
+}
+
+// sharedCursors keeps the cursors of the shared streams of legacy clients by
+// correlation-id.
+type sharedCursors struct {
+	// idle is the duration after which the cursors of a client are forgotten,
+	// the interactions it missed having expired by then.
+	idle time.Duration
+
+	mutex   sync.Mutex
+	cursors map[string]*sharedCursor
+	pruned  time.Time
+}
+
+// sharedCursor contains the cursors of a legacy client.
+type sharedCursor struct {
+	token, tld uint64
+	used       time.Time
+}
+
+// sharedCursorsIdle is the duration after which the cursors of legacy clients
+// are forgotten if the server doesn't expire the shared interactions.
+const sharedCursorsIdle = 24 * time.Hour
+
+// newSharedCursors creates the cursors of legacy clients for a shared retention.
+func newSharedCursors(retention time.Duration) *sharedCursors {
+	if retention <= 0 {
+		retention = sharedCursorsIdle
+	}
+	return &sharedCursors{idle: retention, cursors: make(map[string]*sharedCursor), pruned: time.Now()}
+}
+
+// get returns the cursors of a legacy client.
+func (c *sharedCursors) get(ID string) (uint64, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cursor, ok := c.cursors[ID]; ok {
+		return cursor.token, cursor.tld
+	}
+	return 0, 0
+}
+
+// set sets the cursors of a legacy client, forgetting the idle ones.
+func (c *sharedCursors) set(ID string, token, tld uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.cursors[ID] = &sharedCursor{token: token, tld: tld, used: now}
+	if now.Sub(c.pruned) < c.idle {
+		return
+	}
+	for id, cursor := range c.cursors {
+		if now.Sub(cursor.used) > c.idle {
+			delete(c.cursors, id)
+		}
+	}
+	c.pruned = now
+}
+
+// delete forgets the cursors of a legacy client.
+func (c *sharedCursors) delete(ID string) {
+	c.mutex.Lock()
+	delete(c.cursors, ID)
+	c.mutex.Unlock()
+}
+
+// pollShared returns the interactions of the shared streams of a poll for a
+// correlation ID matching the filter.
+func (h *HTTPServer) pollShared(ID string, shared *sharedPoll, filter *storage.Filter) *sharedInteractions {
+	tokenAfter, tldAfter := shared.tokenAfter, shared.tldAfter
+	if shared.legacy {
+		tokenAfter, tldAfter = h.sharedCursors.get(ID)
+	}
+	// continuations are cursors of the session, shared streams are paged by their own cursors
+	if filter != nil && filter.Continuation > 0 {
+		unpaged := *filter
+		unpaged.Continuation = 0
+		filter = &unpaged
+	}
+
+	result := &sharedInteractions{tokenCursor: tokenAfter, tldCursor: tldAfter}
+	if shared.token && h.options.Token != "" {
+		if interactions, err := h.options.Storage.GetInteractionsWithIdAfter(h.options.Token, tokenAfter, filter); err == nil {
+			result.extra = interactions.Data
+			result.tokenCursor = interactions.Cursor
+			result.hasMore = interactions.HasMore
+		}
+	}
+	if shared.tld && h.options.RootTLD {
+		if interactions, err := h.options.Storage.GetInteractionsWithIdAfter(h.options.Domain, tldAfter, filter); err == nil {
+			result.tld = interactions.Data
+			result.tldCursor = interactions.Cursor
+			result.hasMore = result.hasMore || interactions.HasMore
+		}
+	}
+	if shared.legacy && (result.tokenCursor != tokenAfter || result.tldCursor != tldAfter) {
+		h.sharedCursors.set(ID, result.tokenCursor, result.tldCursor)
+	}
+	return result
+}
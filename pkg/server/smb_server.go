@@ -93,7 +93,9 @@ func (h *SMBServer) ListenAndServe() error {
 						gologger.Warning().Msgf("Could not encode smb interaction: %s\n", err)
 					} else {
 						gologger.Debug().Msgf("SMB Interaction: \n%s\n", buffer.String())
-						if err := h.options.Storage.AddInteractionWithId(h.options.Token, buffer.Bytes()); err != nil {
+						err := h.options.Storage.AddInteractionWithId(h.options.Token, buffer.Bytes())
+						h.options.Metrics.recordInteraction("smb", SharedStreamToken, err)
+						if err != nil {
 							gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 						}
 					}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"git.mills.io/prologic/smtpd"
@@ -16,11 +17,15 @@ import (
 // SMTPServer is a smtp server instance that listens both
 // TLS and Non-TLS based servers.
 type SMTPServer struct {
-	options       *Options
-	port25server  smtpd.Server
-	port587server smtpd.Server
+	options    *Options
+	servers    []*smtpd.Server
+	tlsservers []*smtpd.Server
 }
 
+// smtpTimeout is the read and write timeout of smtp connections, the default
+// of smtpd which is only applied by its own ListenAndServe.
+const smtpTimeout = 5 * time.Minute
+
 // NewSMTPServer returns a new TLS & Non-TLS SMTP server.
 func NewSMTPServer(options *Options) (*SMTPServer, error) {
 	server := &SMTPServer{options: options}
@@ -31,49 +36,66 @@ func NewSMTPServer(options *Options) (*SMTPServer, error) {
 	rcptHandler := func(remoteAddr net.Addr, from string, to string) bool {
 		return true
 	}
-	server.port25server = smtpd.Server{
-		Addr:        options.ListenIP + ":25",
-		AuthHandler: authHandler,
-		HandlerRcpt: rcptHandler,
-		Hostname:    options.Domain,
-		Appname:     "interactsh",
-		Handler:     smtpd.Handler(server.defaultHandler),
+	addresses, err := options.listenAddresses(options.SMTPListeners, "25", "587")
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		server.servers = append(server.servers, &smtpd.Server{
+			Addr:        address,
+			AuthHandler: authHandler,
+			HandlerRcpt: rcptHandler,
+			Hostname:    options.Domain,
+			Appname:     "interactsh",
+			Handler:     smtpd.Handler(server.defaultHandler),
+			Timeout:     smtpTimeout,
+		})
+	}
+	tlsAddresses, err := options.listenAddresses(options.SMTPSListeners, "465")
+	if err != nil {
+		return nil, err
 	}
-	server.port587server = smtpd.Server{
-		Addr:        options.ListenIP + ":587",
-		AuthHandler: authHandler,
-		HandlerRcpt: rcptHandler,
-		Hostname:    options.Domain,
-		Appname:     "interactsh",
-		Handler:     smtpd.Handler(server.defaultHandler),
+	for _, address := range tlsAddresses {
+		server.tlsservers = append(server.tlsservers, &smtpd.Server{Addr: address, Handler: server.defaultHandler, Appname: "interactsh", Hostname: options.Domain, Timeout: smtpTimeout})
 	}
 	return server, nil
 }
 
 // ListenAndServe listens on smtp and/or smtps ports for the server.
 func (h *SMTPServer) ListenAndServe(autoTLS *acme.AutoTLS) {
-	go func() {
-		if autoTLS == nil {
-			return
-		}
-		srv := &smtpd.Server{Addr: h.options.ListenIP + ":465", Handler: h.defaultHandler, Appname: "interactsh", Hostname: h.options.Domain}
-		srv.TLSConfig = &tls.Config{}
-		srv.TLSConfig.GetCertificate = autoTLS.GetCertificateFunc()
-
-		err := srv.ListenAndServe()
-		if err != nil {
-			gologger.Error().Msgf("Could not serve smtp with tls on port 465: %s\n", err)
-		}
-	}()
+	var wg sync.WaitGroup
+	if autoTLS != nil {
+		for _, srv := range h.tlsservers {
+			srv.TLSConfig = &tls.Config{}
+			srv.TLSConfig.GetCertificate = autoTLS.GetCertificateFunc()
 
-	go func() {
-		if err := h.port25server.ListenAndServe(); err != nil {
-			gologger.Error().Msgf("Could not serve smtp on port 25: %s\n", err)
+			wg.Add(1)
+			go func(srv *smtpd.Server) {
+				defer wg.Done()
+				listener, err := listen(srv.Addr)
+				if err == nil {
+					err = srv.Serve(listener)
+				}
+				if err != nil {
+					gologger.Error().Msgf("Could not serve smtp with tls on %s: %s\n", srv.Addr, err)
+				}
+			}(srv)
 		}
-	}()
-	if err := h.port587server.ListenAndServe(); err != nil {
-		gologger.Error().Msgf("Could not serve smtp on port 587: %s\n", err)
 	}
+	for _, srv := range h.servers {
+		wg.Add(1)
+		go func(srv *smtpd.Server) {
+			defer wg.Done()
+			listener, err := listen(srv.Addr)
+			if err == nil {
+				err = srv.Serve(listener)
+			}
+			if err != nil {
+				gologger.Error().Msgf("Could not serve smtp on %s: %s\n", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
 }
 
 // defaultHandler is a handler for default collaborator requests
@@ -103,7 +125,9 @@ func (h *SMTPServer) defaultHandler(remoteAddr net.Addr, from string, to []strin
 				gologger.Warning().Msgf("Could not encode root tld SMTP interaction: %s\n", err)
 			} else {
 				gologger.Debug().Msgf("Root TLD SMTP Interaction: \n%s\n", buffer.String())
-				if err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes()); err != nil {
+				err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes())
+				h.options.Metrics.recordInteraction("smtp", SharedStreamTLD, err)
+				if err != nil {
 					gologger.Warning().Msgf("Could not store root tld smtp interaction: %s\n", err)
 				}
 			}
@@ -142,7 +166,9 @@ func (h *SMTPServer) defaultHandler(remoteAddr net.Addr, from string, to []strin
 			gologger.Warning().Msgf("Could not encode smtp interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("%s\n", buffer.String())
-			if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes())
+			h.options.Metrics.recordInteraction("smtp", streamSession, err)
+			if err != nil {
 				gologger.Warning().Msgf("Could not store smtp interaction: %s\n", err)
 			}
 		}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Scope is a permission granted to an auth token.
+type Scope string
+
+const (
+	// ScopeRegister allows registering and deregistering sessions.
+	ScopeRegister Scope = "register"
+	// ScopePoll allows polling the interactions of sessions.
+	ScopePoll Scope = "poll"
+	// ScopeViewRootTLD allows receiving the interactions of the root tld.
+	ScopeViewRootTLD Scope = "view-root-tld"
+	// ScopeViewSMB allows receiving the interactions of the smb and responder servers.
+	ScopeViewSMB Scope = "view-smb"
+	// ScopeMetrics allows reading the metrics of the server.
+	ScopeMetrics Scope = "metrics"
+	// ScopeAdmin allows managing the auth tokens and grants every other scope.
+	ScopeAdmin Scope = "admin"
+)
+
+// scopes contains the valid scopes.
+var scopes = map[Scope]struct{}{
+	ScopeRegister:    {},
+	ScopePoll:        {},
+	ScopeViewRootTLD: {},
+	ScopeViewSMB:     {},
+	ScopeMetrics:     {},
+	ScopeAdmin:       {},
+}
+
+// Token is a named auth token with the scopes it is granted.
+type Token struct {
+	// Name is the unique name of the token.
+	Name string `yaml:"name" json:"name"`
+	// Value is the value of the token sent in the Authorization header.
+	Value string `yaml:"token" json:"token,omitempty"`
+	// Scopes contains the scopes granted to the token.
+	Scopes []Scope `yaml:"scopes" json:"scopes"`
+	// Expiry is the time after which the token is rejected, if set.
+	Expiry time.Time `yaml:"expiry,omitempty" json:"expiry,omitempty"`
+}
+
+// Allows returns true if the token is granted a scope.
+func (t *Token) Allows(scope Scope) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// expired returns true if the token has expired at the provided time.
+func (t *Token) expired(now time.Time) bool {
+	return !t.Expiry.IsZero() && now.After(t.Expiry)
+}
+
+// masterTokenName is the name of the token of the server, which is reserved
+// so that the sessions it registers are not owned by another token.
+const masterTokenName = "default"
+
+// validate returns an error if the token is not valid.
+func (t *Token) validate() error {
+	if t.Name == "" {
+		return errors.New("no name specified for token")
+	}
+	if t.Name == masterTokenName {
+		return errors.Errorf("token name %s is reserved for the server token", t.Name)
+	}
+	if t.Value == "" {
+		return errors.Errorf("no token specified for %s", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return errors.Errorf("no scopes specified for %s", t.Name)
+	}
+	for _, scope := range t.Scopes {
+		if _, ok := scopes[scope]; !ok {
+			return errors.Errorf("unknown scope %s for %s", scope, t.Name)
+		}
+	}
+	return nil
+}
+
+// tokensFile is the format of the tokens file.
+type tokensFile struct {
+	Tokens []*Token `yaml:"tokens"`
+}
+
+// TokenStore contains the auth tokens accepted by the server. Tokens created
+// or revoked with the management API are written back to its file if any.
+type TokenStore struct {
+	path string
+
+	mutex  sync.RWMutex
+	tokens map[string]*Token
+}
+
+// NewTokenStore creates an empty token store, kept in memory only.
+func NewTokenStore() *TokenStore {
+	return &TokenStore{tokens: make(map[string]*Token)}
+}
+
+// LoadTokenStore loads a token store from a YAML tokens file, which is created
+// by the first change of the store if it doesn't exist.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	store := NewTokenStore()
+	store.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read tokens file")
+	}
+	file := &tokensFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, errors.Wrap(err, "could not parse tokens file")
+	}
+	for _, token := range file.Tokens {
+		if err := token.validate(); err != nil {
+			return nil, err
+		}
+		if store.byName(token.Name) != nil {
+			return nil, errors.Errorf("duplicate token %s", token.Name)
+		}
+		store.tokens[token.Value] = token
+	}
+	return store, nil
+}
+
+// Authenticate returns the non-expired token with the provided value, nil if none.
+func (s *TokenStore) Authenticate(value string) *Token {
+	if value == "" {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// tokens are compared in constant time as the map lookup alone would leak timing
+	for key, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(value)) == 1 {
+			if token.expired(time.Now()) {
+				return nil
+			}
+			return token
+		}
+	}
+	return nil
+}
+
+// Add adds a token to the store, with a random value if it has none.
+func (s *TokenStore) Add(token *Token) error {
+	if token.Value == "" {
+		value, err := randomToken()
+		if err != nil {
+			return err
+		}
+		token.Value = value
+	}
+	if err := token.validate(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.byName(token.Name) != nil {
+		return errors.Errorf("token %s already exists", token.Name)
+	}
+	if _, ok := s.tokens[token.Value]; ok {
+		return errors.New("token value already exists")
+	}
+	s.tokens[token.Value] = token
+	if err := s.save(); err != nil {
+		delete(s.tokens, token.Value)
+		return err
+	}
+	return nil
+}
+
+// Revoke removes the token with the provided name from the store.
+func (s *TokenStore) Revoke(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := s.byName(name)
+	if token == nil {
+		return errors.Errorf("could not find token %s", name)
+	}
+	delete(s.tokens, token.Value)
+	if err := s.save(); err != nil {
+		s.tokens[token.Value] = token
+		return err
+	}
+	return nil
+}
+
+// List returns the tokens of the store sorted by name, without their values.
+func (s *TokenStore) List() []*Token {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		listed := *token
+		listed.Value = ""
+		tokens = append(tokens, &listed)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// byName returns the token with the provided name. It is called with the lock held.
+func (s *TokenStore) byName(name string) *Token {
+	for _, token := range s.tokens {
+		if token.Name == name {
+			return token
+		}
+	}
+	return nil
+}
+
+// save writes the tokens of the store to its file if any. It is called with
+// the lock held.
+func (s *TokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	file := &tokensFile{}
+	for _, token := range s.tokens {
+		file.Tokens = append(file.Tokens, token)
+	}
+	sort.Slice(file.Tokens, func(i, j int) bool { return file.Tokens[i].Name < file.Tokens[j].Name })
+	data, err := yaml.Marshal(file)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal tokens")
+	}
+
+	// the file is replaced at once so that it is never left partially written
+	temp, err := ioutil.TempFile(filepath.Dir(s.path), ".tokens")
+	if err != nil {
+		return errors.Wrap(err, "could not create tokens file")
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return errors.Wrap(err, "could not write tokens file")
+	}
+	if err := temp.Close(); err != nil {
+		return errors.Wrap(err, "could not write tokens file")
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return errors.Wrap(err, "could not write tokens file")
+	}
+	return nil
+}
+
+// randomToken returns a new random token value.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate token")
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interactsh-tokens")
+	require.Nil(t, err, "could not create temporary directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.yaml")
+	err = ioutil.WriteFile(path, []byte(`tokens:
+  - name: scanner
+    token: scanner-token
+    scopes: [register, poll]
+  - name: expired
+    token: expired-token
+    scopes: [admin]
+    expiry: 2021-01-01T00:00:00Z
+`), 0600)
+	require.Nil(t, err, "could not write tokens file")
+
+	store, err := LoadTokenStore(path)
+	require.Nil(t, err, "could not load tokens file")
+	token := store.Authenticate("scanner-token")
+	require.NotNil(t, token, "could not authenticate token")
+	require.True(t, token.Allows(ScopePoll), "could not allow granted scope")
+	require.False(t, token.Allows(ScopeMetrics), "could allow missing scope")
+	require.Nil(t, store.Authenticate("expired-token"), "could authenticate expired token")
+	require.Nil(t, store.Authenticate("unknown-token"), "could authenticate unknown token")
+
+	created := &Token{Name: "monitoring", Scopes: []Scope{ScopeMetrics}}
+	require.Nil(t, store.Add(created), "could not add token")
+	require.NotEmpty(t, created.Value, "could not generate token value")
+	require.NotNil(t, store.Add(&Token{Name: "monitoring", Scopes: []Scope{ScopePoll}}), "could add duplicate token")
+	require.NotNil(t, store.Add(&Token{Name: "invalid", Scopes: []Scope{"unknown"}}), "could add token with unknown scope")
+	require.NotNil(t, store.Add(&Token{Name: masterTokenName, Scopes: []Scope{ScopePoll}}), "could add token with reserved name")
+	require.Nil(t, store.Revoke("scanner"), "could not revoke token")
+
+	// changes are written back to the tokens file
+	reloaded, err := LoadTokenStore(path)
+	require.Nil(t, err, "could not reload tokens file")
+	require.Nil(t, reloaded.Authenticate("scanner-token"), "could authenticate revoked token")
+	require.NotNil(t, reloaded.Authenticate(created.Value), "could not authenticate added token")
+	for _, listed := range reloaded.List() {
+		require.Empty(t, listed.Value, "could list token value")
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	tokens := NewTokenStore()
+	require.Nil(t, tokens.Add(&Token{Name: "scanner", Value: "scanner-token", Scopes: []Scope{ScopePoll}}), "could not add token")
+	h := &HTTPServer{options: &Options{Auth: true, Token: "admin-token", Tokens: tokens}}
+
+	handler := h.authMiddleware(ScopePoll, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		shared, err := parseSharedPoll(req)
+		require.Nil(t, err, "could not parse shared streams")
+		require.False(t, shared.token || shared.tld, "could get shared streams without scope")
+	}))
+	for value, code := range map[string]int{"scanner-token": http.StatusOK, "unknown-token": http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "/poll", nil)
+		req.Header.Set("Authorization", value)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		require.Equal(t, code, recorder.Code, "could not get correct status")
+	}
+
+	tokensHandler := h.authMiddleware(ScopeAdmin, http.HandlerFunc(h.tokensHandler))
+	create := func(value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"name":"monitoring","scopes":["metrics"],"ttl":60}`))
+		req.Header.Set("Authorization", value)
+		recorder := httptest.NewRecorder()
+		tokensHandler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	require.Equal(t, http.StatusForbidden, create("scanner-token").Code, "could manage tokens without admin scope")
+	require.Equal(t, http.StatusOK, create("admin-token").Code, "could not create token with server token")
+	created := tokens.byName("monitoring")
+	require.NotNil(t, created, "could not find created token")
+	require.WithinDuration(t, time.Now().Add(time.Minute), created.Expiry, 5*time.Second, "could not set token expiry")
+}
+
+func TestSessionOwner(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID := xid.New().String()
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519, Owner: "scanner"})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	tokens := NewTokenStore()
+	require.Nil(t, tokens.Add(&Token{Name: "scanner", Value: "scanner-token", Scopes: []Scope{ScopeRegister, ScopePoll}}), "could not add token")
+	require.Nil(t, tokens.Add(&Token{Name: "other", Value: "other-token", Scopes: []Scope{ScopeRegister, ScopePoll}}), "could not add token")
+	h := &HTTPServer{options: &Options{Auth: true, Token: "admin-token", Tokens: tokens, Storage: store, Metrics: NewMetrics()}, sharedCursors: newSharedCursors(0)}
+
+	request := func(scope Scope, handler http.HandlerFunc, method, target, body, value string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", value)
+		recorder := httptest.NewRecorder()
+		h.authMiddleware(scope, handler).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	poll := "/poll?id=" + correlationID + "&secret=secret"
+	require.Equal(t, http.StatusForbidden, request(ScopePoll, h.pollHandler, http.MethodGet, poll, "", "other-token"), "could poll session of another token")
+	require.Equal(t, http.StatusOK, request(ScopePoll, h.pollHandler, http.MethodGet, poll, "", "scanner-token"), "could not poll session of token")
+	require.Equal(t, http.StatusOK, request(ScopePoll, h.pollHandler, http.MethodGet, poll, "", "admin-token"), "could not poll session with admin token")
+
+	deregister := `{"correlation-id":"` + correlationID + `","secret-key":"secret"}`
+	require.Equal(t, http.StatusForbidden, request(ScopeRegister, h.deregisterHandler, http.MethodPost, "/deregister", deregister, "other-token"), "could deregister session of another token")
+	require.Equal(t, http.StatusOK, request(ScopeRegister, h.deregisterHandler, http.MethodPost, "/deregister", deregister, "scanner-token"), "could not deregister session of token")
+
+	// only missing sessions are left to be reported by the storage
+	other := tokens.Authenticate("other-token")
+	require.Nil(t, h.checkOwner(other, correlationID), "could not leave missing session to storage")
+	h.options.Storage = &sessionInfoFailure{Backend: store}
+	require.NotNil(t, h.checkOwner(other, correlationID), "could leave storage failure unchecked")
+}
+
+// sessionInfoFailure is a storage failing to get the details of sessions.
+type sessionInfoFailure struct {
+	storage.Backend
+}
+
+// GetSessionInfo returns an error for every session.
+func (s *sessionInfoFailure) GetSessionInfo(correlationID string) (*storage.SessionInfo, error) {
+	return nil, errors.New("storage is unavailable")
+}
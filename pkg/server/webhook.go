@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+)
+
+// WebhookSignatureHeader is the header containing the HMAC-SHA256 signature of
+// the body of a webhook request keyed with the secret key of the session.
+const WebhookSignatureHeader = "X-Interactsh-Signature"
+
+// WebhookRequest is the request posted to the webhook of a session with the
+// interactions captured for it, encrypted as for a poll.
+type WebhookRequest struct {
+	// CorrelationID is the correlation-id of the session.
+	CorrelationID string   `json:"correlation-id"`
+	Data          []string `json:"data"`
+	AESKey        string   `json:"aes_key"`
+	// Sequences contains the sequence number of each item in Data.
+	Sequences []uint64 `json:"sequences,omitempty"`
+	// Cursor is the sequence number of the last item in Data.
+	Cursor uint64 `json:"cursor,omitempty"`
+	// Version is the crypto version of the interaction envelope used for Data.
+	Version int `json:"version,omitempty"`
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// SignWebhook returns the signature of the body of a webhook request.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const (
+	// webhookWorkers is the number of concurrent webhook deliveries.
+	webhookWorkers = 8
+	// webhookTimeout is the timeout of a webhook request.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is the number of attempts to deliver interactions
+	// before waiting for the next ones, they are kept for polls meanwhile.
+	webhookMaxAttempts = 5
+	// webhookBackoff is the delay before the first retry of a failed delivery,
+	// doubled for each of the next ones.
+	webhookBackoff = time.Second
+)
+
+// States of the deliveries of a webhook.
+const (
+	// webhookIdle is the state of a webhook without pending delivery.
+	webhookIdle int32 = iota
+	// webhookQueued is the state of a webhook waiting in the delivery queue or
+	// being delivered.
+	webhookQueued
+	// webhookDirty is the state of a webhook notified while being delivered,
+	// which is delivered again once done.
+	webhookDirty
+)
+
+// webhook is the webhook registered for a session.
+type webhook struct {
+	correlationID string
+	secret        string
+	url           string
+	// state is the state of the deliveries of the webhook. A webhook is
+	// delivered by a single worker at a time, which owns its cursor and attempts.
+	state    int32
+	cursor   uint64
+	attempts int
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// stopped returns true once the webhook has been removed.
+func (hook *webhook) stopped() bool {
+	select {
+	case <-hook.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// webhookDispatcher posts the interactions of sessions to their webhook as
+// they are stored. Interactions are acknowledged in the storage only once
+// delivered, so that undelivered ones are retried and can still be polled.
+type webhookDispatcher struct {
+	storage    storage.Backend
+	httpClient *http.Client
+	queue      chan *webhook
+	// filter bounds the interactions posted by a webhook request.
+	filter *storage.Filter
+
+	mutex sync.Mutex
+	hooks map[string]*webhook
+}
+
+// newWebhookDispatcher creates a webhook dispatcher with a delivery queue of
+// the given size and starts its workers. The interactions of each webhook
+// request are bounded by the filter if any.
+func newWebhookDispatcher(store storage.Backend, queueSize int, filter *storage.Filter) *webhookDispatcher {
+	// webhooks are dialed without proxy so that each address can be checked
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: controlWebhookDial}
+	d := &webhookDispatcher{
+		storage: store,
+		httpClient: &http.Client{
+			Timeout:   webhookTimeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookTimeout},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue:  make(chan *webhook, queueSize),
+		filter: filter,
+		hooks:  make(map[string]*webhook),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// validateWebhook returns an error if the URL is not a valid webhook URL.
+func validateWebhook(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return errors.Wrap(err, "could not parse webhook URL")
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("webhook URL must be an absolute http(s) URL")
+	}
+	// names are checked once resolved when the webhook is dialed
+	if ip := net.ParseIP(parsed.Hostname()); ip != nil && !webhookAllowed(ip) {
+		return errors.Errorf("webhook address %s is not allowed", ip)
+	}
+	return nil
+}
+
+// webhookBlockedNetworks contains the networks webhooks can't be delivered
+// to, so that sessions can't reach the network of the server through them:
+// unspecified, loopback, private, shared, link-local, multicast and reserved
+// addresses.
+var webhookBlockedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// parseNetworks parses CIDR networks known to be valid.
+func parseNetworks(values ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(values))
+	for i, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// webhookAllowed returns true if webhooks can be delivered to an address.
+func webhookAllowed(ip net.IP) bool {
+	for _, network := range webhookBlockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// controlWebhookDial refuses the connections of webhooks to addresses they
+// can't be delivered to, including the ones of resolved names and redirects.
+func controlWebhookDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAllowed(ip) {
+		return errors.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// add registers the webhook of a session and delivers its interactions as
+// they are stored until it is removed.
+func (d *webhookDispatcher) add(correlationID, secret, URL string) *webhook {
+	hook := &webhook{correlationID: correlationID, secret: secret, url: URL, done: make(chan struct{})}
+
+	d.mutex.Lock()
+	previous := d.hooks[correlationID]
+	d.hooks[correlationID] = hook
+	d.mutex.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+
+	notify, cancel := d.storage.Subscribe(correlationID)
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-notify:
+				d.enqueue(hook)
+			case <-hook.done:
+				return
+			}
+		}
+	}()
+	return hook
+}
+
+// restore adds the webhooks registered by the sessions of the storage, so
+// that their deliveries resume once the storage is reopened or imported.
+func (d *webhookDispatcher) restore() error {
+	webhooks, err := d.storage.ListWebhooks()
+	if err != nil {
+		return errors.Wrap(err, "could not restore webhooks")
+	}
+	for _, hook := range webhooks {
+		// interactions stored while the server was down are delivered at once
+		d.enqueue(d.add(hook.CorrelationID, hook.SecretKey, hook.URL))
+	}
+	if len(webhooks) > 0 {
+		gologger.Info().Msgf("Restored %d webhooks from storage\n", len(webhooks))
+	}
+	return nil
+}
+
+// remove removes the webhook of a session if any.
+func (d *webhookDispatcher) remove(correlationID string) {
+	d.mutex.Lock()
+	hook := d.hooks[correlationID]
+	delete(d.hooks, correlationID)
+	d.mutex.Unlock()
+
+	if hook != nil {
+		hook.stop()
+	}
+}
+
+// removeHook removes a webhook unless it was replaced by another one.
+func (d *webhookDispatcher) removeHook(hook *webhook) {
+	d.mutex.Lock()
+	if d.hooks[hook.correlationID] == hook {
+		delete(d.hooks, hook.correlationID)
+	}
+	d.mutex.Unlock()
+
+	hook.stop()
+}
+
+// stop stops the deliveries of a webhook, a delivery in progress ending
+// after its current request.
+func (hook *webhook) stop() {
+	hook.stopOnce.Do(func() { close(hook.done) })
+}
+
+// enqueue queues a webhook for delivery unless it is already queued, or marks
+// it to be delivered again if it is being delivered. Once the queue is full,
+// pending interactions are delivered along with the next ones.
+func (d *webhookDispatcher) enqueue(hook *webhook) {
+	if !atomic.CompareAndSwapInt32(&hook.state, webhookIdle, webhookQueued) {
+		atomic.CompareAndSwapInt32(&hook.state, webhookQueued, webhookDirty)
+		return
+	}
+	select {
+	case d.queue <- hook:
+	default:
+		atomic.StoreInt32(&hook.state, webhookIdle)
+		gologger.Warning().Msgf("Webhook queue is full, delaying delivery for %s\n", hook.correlationID)
+	}
+}
+
+// work delivers the interactions of the queued webhooks.
+func (d *webhookDispatcher) work() {
+	for hook := range d.queue {
+		for {
+			d.deliver(hook)
+			// notifications received during the delivery deliver the webhook again
+			if atomic.CompareAndSwapInt32(&hook.state, webhookQueued, webhookIdle) {
+				break
+			}
+			atomic.StoreInt32(&hook.state, webhookQueued)
+		}
+	}
+}
+
+// deliver delivers the pending interactions of a webhook, retrying with an
+// exponential backoff if the delivery fails.
+func (d *webhookDispatcher) deliver(hook *webhook) {
+	if hook.stopped() {
+		return
+	}
+	gone, err := d.post(hook)
+	if gone {
+		gologger.Debug().Msgf("Removing webhook of session %s: %s\n", hook.correlationID, err)
+		go d.removeHook(hook)
+		return
+	}
+	if err == nil {
+		hook.attempts = 0
+		return
+	}
+
+	hook.attempts++
+	if hook.attempts >= webhookMaxAttempts {
+		gologger.Warning().Msgf("Could not deliver interactions to webhook for %s after %d attempts: %s\n", hook.correlationID, hook.attempts, err)
+		hook.attempts = 0
+		return
+	}
+	gologger.Debug().Msgf("Could not deliver interactions to webhook for %s: %s\n", hook.correlationID, err)
+	time.AfterFunc(webhookBackoff<<uint(hook.attempts-1), func() { d.enqueue(hook) })
+}
+
+// post posts the pending interactions of a webhook until none are left or it
+// is removed, and returns true if the session can't be read anymore.
+func (d *webhookDispatcher) post(hook *webhook) (bool, error) {
+	for !hook.stopped() {
+		// the interactions up to the cursor were delivered so they are acknowledged
+		interactions, err := d.storage.GetInteractionsAfter(hook.correlationID, hook.secret, hook.cursor, d.filter)
+		if err != nil {
+			return true, err
+		}
+		if len(interactions.Data) == 0 {
+			return false, nil
+		}
+		body, err := jsoniter.Marshal(&WebhookRequest{
+			CorrelationID: hook.correlationID,
+			Data:          interactions.Data,
+			AESKey:        interactions.AESKey,
+			Sequences:     interactions.Sequences,
+			Cursor:        interactions.Cursor,
+			Version:       interactions.Version,
+			Dropped:       interactions.Dropped,
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "could not marshal webhook request")
+		}
+		req, err := http.NewRequest(http.MethodPost, hook.url, bytes.NewReader(body))
+		if err != nil {
+			return false, errors.Wrap(err, "could not create webhook request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.secret, body))
+
+		resp, err := d.httpClient.Do(req)
+		if err != nil {
+			return false, errors.Wrap(err, "could not post webhook request")
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return false, errors.Errorf("webhook returned status %d", resp.StatusCode)
+		}
+		hook.cursor = interactions.Cursor
+	}
+	return false, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID, secret := xid.New().String(), "secret"
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	var attempts int32
+	requests := make(chan *WebhookRequest, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.Nil(t, err, "could not read webhook request")
+		require.Equal(t, SignWebhook(secret, body), req.Header.Get(WebhookSignatureHeader), "could not verify webhook signature")
+
+		// the first delivery fails and is retried
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		request := &WebhookRequest{}
+		require.Nil(t, jsoniter.Unmarshal(body, request), "could not decode webhook request")
+		requests <- request
+	}))
+	defer receiver.Close()
+
+	dispatcher := newWebhookDispatcher(store, 10, nil)
+	// the receiver listens on loopback which webhooks can't be dialed to
+	dispatcher.httpClient = receiver.Client()
+	dispatcher.add(correlationID, secret, receiver.URL)
+
+	err = store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`))
+	require.Nil(t, err, "could not add interaction")
+
+	select {
+	case request := <-requests:
+		require.Equal(t, correlationID, request.CorrelationID, "could not get correct correlation-id")
+		require.Len(t, request.Data, 1, "could not get interaction")
+		require.NotEmpty(t, request.AESKey, "could not get session key")
+	case <-time.After(5 * time.Second):
+		t.Fatal("could not receive webhook request")
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts), "could not retry failed delivery")
+
+	// delivered interactions are acknowledged
+	require.Eventually(t, func() bool {
+		interactions, err := store.GetInteractions(correlationID, secret, nil)
+		return err == nil && len(interactions.Data) == 0
+	}, 5*time.Second, 10*time.Millisecond, "could not acknowledge delivered interactions")
+
+	dispatcher.remove(correlationID)
+	err = store.AddInteraction(correlationID, []byte(`{"protocol":"http"}`))
+	require.Nil(t, err, "could not add interaction")
+	interactions, err := store.GetInteractions(correlationID, secret, nil)
+	require.Nil(t, err, "could not get interactions")
+	require.Len(t, interactions.Data, 1, "could not keep interactions of removed webhook")
+}
+
+func TestWebhookRestore(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID, secret := xid.New().String(), "secret"
+
+	requests := make(chan *WebhookRequest, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		request := &WebhookRequest{}
+		require.Nil(t, jsoniter.NewDecoder(req.Body).Decode(request), "could not decode webhook request")
+		requests <- request
+	}))
+	defer receiver.Close()
+
+	// the session and its interaction were stored before the server started
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519, Webhook: receiver.URL})
+	require.Nil(t, err, "could not register correlation-id in storage")
+	err = store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`))
+	require.Nil(t, err, "could not add interaction")
+
+	dispatcher := newWebhookDispatcher(store, 10, nil)
+	dispatcher.httpClient = receiver.Client()
+	require.Nil(t, dispatcher.restore(), "could not restore webhooks")
+
+	select {
+	case request := <-requests:
+		require.Equal(t, correlationID, request.CorrelationID, "could not get correct correlation-id")
+		require.Len(t, request.Data, 1, "could not deliver interaction stored before restore")
+	case <-time.After(5 * time.Second):
+		t.Fatal("could not receive webhook request of restored webhook")
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	store := storage.New(1 * time.Hour)
+	defer store.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	correlationID, secret := xid.New().String(), "secret"
+	err = store.Register(&storage.Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: storage.KeyTypeX25519})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	received, release := make(chan *WebhookRequest, 10), make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		request := &WebhookRequest{}
+		require.Nil(t, jsoniter.NewDecoder(req.Body).Decode(request), "could not decode webhook request")
+		received <- request
+		<-release
+	}))
+	defer receiver.Close()
+
+	dispatcher := newWebhookDispatcher(store, 10, &storage.Filter{Limit: 1})
+	dispatcher.httpClient = receiver.Client()
+	dispatcher.add(correlationID, secret, receiver.URL)
+	for i := 0; i < 2; i++ {
+		err = store.AddInteraction(correlationID, []byte(`{"protocol":"dns"}`))
+		require.Nil(t, err, "could not add interaction")
+	}
+
+	select {
+	case request := <-received:
+		require.Len(t, request.Data, 1, "could not bound webhook request")
+	case <-time.After(5 * time.Second):
+		t.Fatal("could not receive webhook request")
+	}
+	// the pending delivery doesn't block the other sessions nor the removal
+	removed := make(chan struct{})
+	go func() {
+		dispatcher.add(xid.New().String(), secret, receiver.URL)
+		dispatcher.remove(correlationID)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("could not remove webhook during delivery")
+	}
+	close(release)
+
+	// the removed webhook doesn't post the next interaction
+	select {
+	case <-received:
+		t.Fatal("could post interactions of removed webhook")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	for _, value := range []string{"https://example.com/hook", "http://93.184.216.34:8080/hook", "http://[2606:2800:220:1::]/hook"} {
+		require.Nil(t, validateWebhook(value), "could not validate %s", value)
+	}
+	for _, value := range []string{
+		"http://127.0.0.1:8080/", "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/", "http://172.16.0.1/",
+		"http://192.168.1.1/", "http://0.0.0.0/", "http://224.0.0.1/", "http://[::1]/", "http://[fe80::1]/",
+		"http://[fd00::1]/", "http://[::ffff:127.0.0.1]/", "ftp://example.com/",
+	} {
+		require.NotNil(t, validateWebhook(value), "could validate %s", value)
+	}
+
+	// names resolving to blocked addresses are refused when dialed
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer receiver.Close()
+	dispatcher := newWebhookDispatcher(storage.New(1*time.Hour), 1, nil)
+	_, port, err := net.SplitHostPort(receiver.Listener.Addr().String())
+	require.Nil(t, err, "could not get receiver port")
+	for _, value := range []string{receiver.URL, "http://localhost:" + port} {
+		_, err := dispatcher.httpClient.Post(value, "application/json", nil)
+		require.NotNil(t, err, "could post webhook to %s", value)
+		require.Contains(t, err.Error(), "not allowed", "could not refuse %s", value)
+	}
+}
@@ -0,0 +1,1167 @@
+package storage
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	sessionsBucket = []byte("sessions")
+	dataBucket     = []byte("data")
+	metadataBucket = []byte("metadata")
+)
+
+// DiskStorage is a persistent storage for interactsh interaction data
+// backed by an embedded key/value database, so that sessions and pending
+// interactions survive server restarts.
+//
+// Sessions are stored in the sessions bucket keyed by correlation-id while
+// the interactions of each session are kept in a nested bucket of the data
+// bucket keyed by an increasing sequence number. Their plaintext metadata is
+// kept under the same keys in a nested bucket of the metadata bucket.
+//
+// The decrypted AES keys of the sessions are only kept in memory, sessions
+// being persisted with their key sealed with the state key if provided.
+type DiskStorage struct {
+	db          *bolt.DB
+	evictionTTL time.Duration
+	quota       Quota
+	evictions   *evictionLog
+	subscribers *notifier
+	keys        *sessionKeys
+	dropped     int64
+	// sessions is the number of correlation-id sessions.
+	sessions int64
+	// size is the total size in bytes of the pending interactions.
+	size     int64
+	quitChan chan struct{}
+	// sharedRetention is the duration for which the interactions of id buckets are kept.
+	sharedRetention time.Duration
+}
+
+// diskSession is the on-disk representation of a correlation-id session.
+type diskSession struct {
+	// SecretKey is a secret key for original user verification
+	SecretKey string `json:"secret-key,omitempty"`
+	// AESKey is the AES encryption key in encrypted format.
+	AESKey string `json:"aes-key,omitempty"`
+	// SealedAESKey is the decrypted AES key sealed with the state key.
+	SealedAESKey []byte `json:"sealed-aes-key,omitempty"`
+	// Expiry is the time after which the session is evicted, zero for ids which never expire.
+	Expiry time.Time `json:"expiry"`
+	// TTL is the lifetime of the session.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Sliding refreshes the expiry of the session by its TTL on each poll.
+	Sliding bool `json:"sliding,omitempty"`
+	// Version is the crypto version of the interaction envelope.
+	Version int `json:"version,omitempty"`
+	// Count is the number of pending interactions.
+	Count int `json:"count,omitempty"`
+	// Size is the size in bytes of the pending interactions.
+	Size int64 `json:"size,omitempty"`
+	// Seen is the number of interactions received including dropped ones.
+	Seen uint64 `json:"seen,omitempty"`
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Created is the time at which the session was registered.
+	Created time.Time `json:"created,omitempty"`
+	// Owner is the name of the auth token which registered the session.
+	Owner string `json:"owner,omitempty"`
+	// Webhook is the URL the interactions of the session are posted to.
+	Webhook string `json:"webhook,omitempty"`
+	// Counters contains the counters of the session by key.
+	Counters map[string]uint64 `json:"counters,omitempty"`
+}
+
+// NewDisk creates a new on-disk storage instance for interactsh data
+// at the provided database path.
+func NewDisk(path string, options *Options) (*DiskStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open storage database")
+	}
+	s := &DiskStorage{
+		db:          db,
+		evictionTTL: options.EvictionTTL,
+		quota:       options.Quota,
+		evictions:   newEvictionLog(options.OnEviction),
+		subscribers: newNotifier(),
+		quitChan:    make(chan struct{}),
+
+		sharedRetention: options.SharedRetention,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if s.keys, err = newSessionKeys(tx, options.StateKey); err != nil {
+			return err
+		}
+		sessions, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(dataBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(metadataBucket); err != nil {
+			return err
+		}
+		// restore the size accounting of the pending interactions and the
+		// keys of the sessions, removing the ones whose key can't be opened
+		var removed []string
+		ids := make(map[string]*diskSession)
+		err = sessions.ForEach(func(k, v []byte) error {
+			session := &diskSession{}
+			if err := jsoniter.Unmarshal(v, session); err != nil {
+				return nil
+			}
+			s.size += session.Size
+			if session.AESKey == "" {
+				if session.Expiry.IsZero() {
+					ids[string(k)] = session
+				}
+				return nil
+			}
+			s.sessions++
+			raw, err := s.keys.open(session.SealedAESKey)
+			if err == nil {
+				err = s.keys.set(string(k), session.Version, raw)
+			}
+			if err != nil {
+				removed = append(removed, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range removed {
+			if err := s.deleteSession(tx, id); err != nil {
+				return err
+			}
+		}
+		// the ids are set again by the server, the other ones such as the
+		// ones of a previous server token expire like evicted sessions
+		if s.evictionTTL > 0 {
+			for id, session := range ids {
+				session.Expiry = time.Now().Add(s.evictionTTL)
+				if err := putDiskSession(tx, id, session); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "could not create storage buckets")
+	}
+	go s.cleanupWorker()
+	return s, nil
+}
+
+// SetIDPublicKey sets the correlation ID and publicKey into the storage for
+// further operations using the legacy crypto version.
+func (s *DiskStorage) SetIDPublicKey(correlationID, secretKey, publicKey string) error {
+	return s.Register(&Registration{CorrelationID: correlationID, SecretKey: secretKey, PublicKey: publicKey})
+}
+
+// Register registers a correlation ID with its publicKey into the storage for further operations.
+func (s *DiskStorage) Register(registration *Registration) error {
+	version, err := cryptoVersion(registration.Version)
+	if err != nil {
+		return err
+	}
+	aesKey, encryptedAESKey, err := newSessionKey(registration.KeyType, registration.PublicKey, version)
+	if err != nil {
+		return err
+	}
+	sealedAESKey, err := s.keys.seal(aesKey)
+	if err != nil {
+		return err
+	}
+	ttl := sessionTTL(registration.TTL, s.evictionTTL)
+	session := &diskSession{
+		SecretKey:    registration.SecretKey,
+		AESKey:       encryptedAESKey,
+		SealedAESKey: sealedAESKey,
+		Expiry:       time.Now().Add(ttl),
+		TTL:          ttl,
+		Sliding:      registration.Sliding,
+		Version:      version,
+		Created:      time.Now(),
+		Owner:        registration.Owner,
+		Webhook:      registration.Webhook,
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// If we already have this correlation ID, return.
+		if existing, _ := s.getDiskSession(tx, registration.CorrelationID); existing != nil {
+			return errors.New("correlation-id provided is invalid")
+		}
+		if err := s.deleteSession(tx, registration.CorrelationID); err != nil {
+			return err
+		}
+		if err := putDiskSession(tx, registration.CorrelationID, session); err != nil {
+			return err
+		}
+		if _, err := tx.Bucket(dataBucket).CreateBucket([]byte(registration.CorrelationID)); err != nil {
+			return err
+		}
+		return s.setKey(tx, registration.CorrelationID, version, aesKey)
+	})
+}
+
+// SetID sets an unencrypted id bucket into the storage which never expires.
+//
+// Interactions already stored for an existing id are preserved so that
+// they survive a server restart. The ids which are not set again once
+// the storage is opened expire after the eviction TTL.
+func (s *DiskStorage) SetID(ID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session := &diskSession{}
+		if existing := tx.Bucket(sessionsBucket).Get([]byte(ID)); existing != nil {
+			_ = jsoniter.Unmarshal(existing, session)
+		}
+		session.Expiry = time.Time{}
+		if err := putDiskSession(tx, ID, session); err != nil {
+			return err
+		}
+		_, err := tx.Bucket(dataBucket).CreateBucketIfNotExists([]byte(ID))
+		return err
+	})
+}
+
+// AddInteraction adds an interaction data to the correlation ID after encrypting
+// it with Public Key for the provided correlation ID.
+//
+// Interactions added concurrently are written in a single transaction so
+// that they share the sync of the database to the disk.
+func (s *DiskStorage) AddInteraction(correlationID string, data []byte) error {
+	// failing batched writes are retried on their own, so unknown ids are
+	// rejected beforehand
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, err := s.getDiskSession(tx, correlationID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	key := s.keys.get(correlationID)
+	if key == nil {
+		return ErrSessionNotFound
+	}
+	ct, err := key.cipher.encrypt(data)
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt event data")
+	}
+	metadata := parseMetadata(data)
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		return s.appendInteraction(tx, correlationID, session, ct, metadata)
+	})
+}
+
+// AddInteractionWithId adds an interaction data to the id bucket
+func (s *DiskStorage) AddInteractionWithId(id string, data []byte) error {
+	compressed, err := compress(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, id)
+		if err != nil {
+			return err
+		}
+		return s.appendInteraction(tx, id, session, compressed, sharedMetadata(data))
+	})
+}
+
+// GetInteractions returns the interactions for a correlationID matching the filter
+// and removes them from the storage. It also returns AES Encrypted Key for the IDs.
+func (s *DiskStorage) GetInteractions(correlationID, secret string, filter *Filter) (*Interactions, error) {
+	var data []string
+	var hasMore bool
+	var session *diskSession
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		session, err = s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(session.SecretKey, secret) {
+			return errors.New("invalid secret key passed for user")
+		}
+		if err := refreshDiskSession(tx, correlationID, session); err != nil {
+			return err
+		}
+		data, hasMore, err = s.drainInteractions(tx, correlationID, session, filter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Interactions{Data: decompressInteractions(data), AESKey: session.AESKey, Version: session.Version, Dropped: session.Dropped, HasMore: hasMore}, nil
+}
+
+// GetInteractionsAfter acknowledges the interactions for a correlationID matching the
+// filter up to and including the after cursor and returns the remaining matching ones
+// without removing them.
+func (s *DiskStorage) GetInteractionsAfter(correlationID, secret string, after uint64, filter *Filter) (*Interactions, error) {
+	var data []string
+	var sequences []uint64
+	var hasMore bool
+	var session *diskSession
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		session, err = s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(session.SecretKey, secret) {
+			return errors.New("invalid secret key passed for user")
+		}
+		if err := refreshDiskSession(tx, correlationID, session); err != nil {
+			return err
+		}
+		data, sequences, hasMore, err = s.interactionsAfter(tx, correlationID, session, after, filter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	interactions := newInteractions(decompressInteractions(data), sequences, filter.start(after), session.AESKey, session.Version)
+	interactions.Dropped = session.Dropped
+	interactions.HasMore = hasMore
+	return interactions, nil
+}
+
+// GetInteractionsWithId returns the interactions for a id matching the filter and removes them from the bucket
+func (s *DiskStorage) GetInteractionsWithId(id string, filter *Filter) (*Interactions, error) {
+	var data []string
+	var hasMore bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, id)
+		if err != nil {
+			return err
+		}
+		data, hasMore, err = s.drainInteractions(tx, id, session, filter)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Interactions{Data: decompressInteractions(data), HasMore: hasMore}, nil
+}
+
+// GetInteractionsWithIdAfter returns the interactions for an id matching the filter
+// after the after cursor without removing them from the bucket.
+func (s *DiskStorage) GetInteractionsWithIdAfter(id string, after uint64, filter *Filter) (*Interactions, error) {
+	var data []string
+	var sequences []uint64
+	var hasMore bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if _, err := s.getDiskSession(tx, id); err != nil {
+			return err
+		}
+		data, sequences, hasMore = readDiskInteractions(tx, id, filter.start(after), filter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	interactions := newInteractions(decompressInteractions(data), sequences, filter.start(after), "", 0)
+	interactions.HasMore = hasMore
+	return interactions, nil
+}
+
+// RemoveID removes data for a correlation ID and data related to it.
+func (s *DiskStorage) RemoveID(correlationID, secret string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(session.SecretKey, secret) {
+			return errors.New("invalid secret key passed for deregister")
+		}
+		tx.OnCommit(func() {
+			s.evictions.record(correlationID, EvictionDeregister)
+		})
+		return s.deleteSession(tx, correlationID)
+	})
+}
+
+// GetSession returns the lifetime of a correlation ID session.
+func (s *DiskStorage) GetSession(correlationID, secret string) (*Session, error) {
+	var session *diskSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		session, err = s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(session.SecretKey, secret) {
+			return errors.New("invalid secret key passed for user")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Expiry: session.Expiry, TTL: session.TTL, Sliding: session.Sliding}, nil
+}
+
+// ListSessions returns the details of the registered correlation ID sessions
+// sorted by registration time.
+func (s *DiskStorage) ListSessions() ([]*SessionInfo, error) {
+	var sessions []*SessionInfo
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			session := &diskSession{}
+			// unencrypted ids are not sessions of clients
+			if err := jsoniter.Unmarshal(v, session); err != nil || session.AESKey == "" || session.expired(now) {
+				return nil
+			}
+			sessions = append(sessions, session.info(string(k)))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list sessions")
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// GetSessionInfo returns the details of a correlation ID session.
+func (s *DiskStorage) GetSessionInfo(correlationID string) (*SessionInfo, error) {
+	var info *SessionInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if session.AESKey == "" {
+			return ErrSessionNotFound
+		}
+		info = session.info(correlationID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ListWebhooks returns the webhooks registered by the correlation ID sessions.
+func (s *DiskStorage) ListWebhooks() ([]*Webhook, error) {
+	var webhooks []*Webhook
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			session := &diskSession{}
+			if err := jsoniter.Unmarshal(v, session); err != nil || session.Webhook == "" || session.expired(now) {
+				return nil
+			}
+			webhooks = append(webhooks, &Webhook{CorrelationID: string(k), SecretKey: session.SecretKey, URL: session.Webhook})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list webhooks")
+	}
+	return webhooks, nil
+}
+
+// EvictSession evicts a correlation ID session without its secret key.
+func (s *DiskStorage) EvictSession(correlationID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if session.AESKey == "" {
+			return ErrSessionNotFound
+		}
+		tx.OnCommit(func() {
+			atomic.AddInt64(&s.dropped, 1)
+			s.evictions.record(correlationID, EvictionAdmin)
+		})
+		return s.deleteSession(tx, correlationID)
+	})
+}
+
+// PurgeSession removes the pending interactions of a correlation ID session
+// without its secret key, keeping the session registered along with the
+// sequence number of its interactions so that the cursors of its clients
+// remain valid.
+func (s *DiskStorage) PurgeSession(correlationID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if session.AESKey == "" {
+			return ErrSessionNotFound
+		}
+		var sequence uint64
+		data := tx.Bucket(dataBucket)
+		if bucket := data.Bucket([]byte(correlationID)); bucket != nil {
+			sequence = bucket.Sequence()
+		}
+		if err := data.DeleteBucket([]byte(correlationID)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if err := tx.Bucket(metadataBucket).DeleteBucket([]byte(correlationID)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		bucket, err := data.CreateBucket([]byte(correlationID))
+		if err != nil {
+			return err
+		}
+		if err := bucket.SetSequence(sequence); err != nil {
+			return err
+		}
+		s.account(tx, -session.Size)
+		session.Count = 0
+		session.Size = 0
+		return putDiskSession(tx, correlationID, session)
+	})
+}
+
+// IncrementCounter increments the counter of a key for a correlation ID
+// session and returns its new value, the counters being removed with the session.
+func (s *DiskStorage) IncrementCounter(correlationID, key string) (uint64, error) {
+	var count uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		session, err := s.getDiskSession(tx, correlationID)
+		if err != nil {
+			return err
+		}
+		if session.AESKey == "" {
+			return ErrSessionNotFound
+		}
+		if session.Counters == nil {
+			session.Counters = make(map[string]uint64)
+		}
+		if _, ok := session.Counters[key]; !ok && len(session.Counters) >= maxSessionCounters {
+			return ErrTooManyCounters
+		}
+		session.Counters[key]++
+		count = session.Counters[key]
+		return putDiskSession(tx, correlationID, session)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// info returns the details of the session of a correlation-id.
+func (session *diskSession) info(correlationID string) *SessionInfo {
+	return &SessionInfo{
+		CorrelationID: correlationID,
+		Created:       session.Created,
+		Expiry:        session.Expiry,
+		TTL:           session.TTL,
+		Sliding:       session.Sliding,
+		Pending:       session.Count,
+		Size:          session.Size,
+		Dropped:       session.Dropped,
+		Owner:         session.Owner,
+		Webhook:       session.Webhook,
+	}
+}
+
+// Export returns a snapshot of the registered sessions of the storage.
+func (s *DiskStorage) Export() (*Snapshot, error) {
+	snapshot := &Snapshot{Created: time.Now()}
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			session := &diskSession{}
+			// unencrypted ids are set again by the server at startup
+			if err := jsoniter.Unmarshal(v, session); err != nil || session.AESKey == "" || session.expired(now) {
+				return nil
+			}
+			key := s.keys.get(string(k))
+			if key == nil {
+				return nil
+			}
+			exported := &SessionSnapshot{
+				CorrelationID: string(k),
+				SecretKey:     session.SecretKey,
+				AESKey:        session.AESKey,
+				Version:       session.Version,
+				Expiry:        session.Expiry,
+				TTL:           int64(session.TTL),
+				Sliding:       session.Sliding,
+				Seen:          session.Seen,
+				Dropped:       session.Dropped,
+				Created:       session.Created,
+				Owner:         session.Owner,
+				Webhook:       session.Webhook,
+				RawAESKey:     key.raw,
+			}
+			if bucket := tx.Bucket(dataBucket).Bucket(k); bucket != nil {
+				metadata := tx.Bucket(metadataBucket).Bucket(k)
+				exported.LastSequence = bucket.Sequence()
+				err := bucket.ForEach(func(key, value []byte) error {
+					exported.Data = append(exported.Data, append([]byte(nil), value...))
+					exported.Sequences = append(exported.Sequences, binary.BigEndian.Uint64(key))
+					exported.Metadata = append(exported.Metadata, getDiskMetadata(metadata, key))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			snapshot.Sessions = append(snapshot.Sessions, exported)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not export sessions")
+	}
+	return snapshot, nil
+}
+
+// Import imports the sessions of a snapshot into the storage. Expired
+// sessions and sessions whose correlation-id is already registered are
+// skipped, so that importing a snapshot again does not overwrite them.
+func (s *DiskStorage) Import(snapshot *Snapshot) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, imported := range snapshot.Sessions {
+			if now.After(imported.Expiry) {
+				continue
+			}
+			if len(imported.Sequences) != len(imported.Data) {
+				return errors.Errorf("invalid sequences for %s", imported.CorrelationID)
+			}
+			if imported.Metadata != nil && len(imported.Metadata) != len(imported.Data) {
+				return errors.Errorf("invalid metadata for %s", imported.CorrelationID)
+			}
+			if tx.Bucket(sessionsBucket).Get([]byte(imported.CorrelationID)) != nil {
+				continue
+			}
+			bucket, err := tx.Bucket(dataBucket).CreateBucket([]byte(imported.CorrelationID))
+			if err != nil {
+				return err
+			}
+			sealedAESKey, err := s.keys.seal(imported.RawAESKey)
+			if err != nil {
+				return err
+			}
+			session := &diskSession{
+				SecretKey:    imported.SecretKey,
+				AESKey:       imported.AESKey,
+				SealedAESKey: sealedAESKey,
+				Expiry:       imported.Expiry,
+				TTL:          time.Duration(imported.TTL),
+				Sliding:      imported.Sliding,
+				Version:      imported.Version,
+				Seen:         imported.Seen,
+				Dropped:      imported.Dropped,
+				Created:      imported.Created,
+				Owner:        imported.Owner,
+				Webhook:      imported.Webhook,
+			}
+			for i, item := range imported.Data {
+				key := make([]byte, 8)
+				binary.BigEndian.PutUint64(key, imported.Sequences[i])
+				if err := bucket.Put(key, item); err != nil {
+					return err
+				}
+				if imported.Metadata != nil {
+					if err := putDiskMetadata(tx, imported.CorrelationID, key, &imported.Metadata[i]); err != nil {
+						return err
+					}
+				}
+				session.Count++
+				session.Size += int64(len(item))
+			}
+			if err := bucket.SetSequence(imported.LastSequence); err != nil {
+				return err
+			}
+			s.account(tx, session.Size)
+			if err := putDiskSession(tx, imported.CorrelationID, session); err != nil {
+				return err
+			}
+			if err := s.setKey(tx, imported.CorrelationID, imported.Version, imported.RawAESKey); err != nil {
+				return errors.Wrapf(err, "could not set session key for %s", imported.CorrelationID)
+			}
+		}
+		return nil
+	})
+}
+
+// Subscribe returns a channel notified when interactions are added for any of
+// the ids along with a function to cancel the subscription.
+func (s *DiskStorage) Subscribe(ids ...string) (<-chan struct{}, func()) {
+	return s.subscribers.subscribe(ids...)
+}
+
+// GetCacheMetrics returns the session metrics of the storage.
+func (s *DiskStorage) GetCacheMetrics() *CacheMetrics {
+	metrics := &CacheMetrics{
+		Dropped:   int(atomic.LoadInt64(&s.dropped)),
+		Size:      atomic.LoadInt64(&s.size),
+		Evictions: s.evictions.metrics(),
+	}
+	metrics.Sessions = int(atomic.LoadInt64(&s.sessions))
+	return metrics
+}
+
+// Close stops the cleanup worker and closes the underlying database.
+func (s *DiskStorage) Close() error {
+	close(s.quitChan)
+	return s.db.Close()
+}
+
+// cleanupWorker periodically removes expired sessions from the storage.
+func (s *DiskStorage) cleanupWorker() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.removeExpired()
+		case <-s.quitChan:
+			return
+		}
+	}
+}
+
+// removeExpired removes all the sessions whose expiry has passed along with
+// the interactions of id buckets older than the shared retention.
+func (s *DiskStorage) removeExpired() {
+	now := time.Now()
+	_ = s.db.Update(func(tx *bolt.Tx) error {
+		var expired []string
+		ids := make(map[string]*diskSession)
+		err := tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			session := &diskSession{}
+			if err := jsoniter.Unmarshal(v, session); err != nil || session.expired(now) {
+				expired = append(expired, string(k))
+			} else if session.Expiry.IsZero() {
+				ids[string(k)] = session
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := s.deleteSession(tx, id); err != nil {
+				return err
+			}
+		}
+		if s.sharedRetention > 0 {
+			for id, session := range ids {
+				if err := s.removeBefore(tx, id, session, now.Add(-s.sharedRetention)); err != nil {
+					return err
+				}
+			}
+		}
+		tx.OnCommit(func() {
+			atomic.AddInt64(&s.dropped, int64(len(expired)))
+			for _, id := range expired {
+				s.evictions.record(id, EvictionTTL)
+			}
+		})
+		return nil
+	})
+}
+
+// account adjusts the size accounting of the pending interactions by
+// delta bytes once the transaction is committed.
+func (s *DiskStorage) account(tx *bolt.Tx, delta int64) {
+	if delta != 0 {
+		tx.OnCommit(func() {
+			atomic.AddInt64(&s.size, delta)
+		})
+	}
+}
+
+// getDiskSession returns a non-expired session for an id from the sessions bucket.
+func (s *DiskStorage) getDiskSession(tx *bolt.Tx, id string) (*diskSession, error) {
+	value := tx.Bucket(sessionsBucket).Get([]byte(id))
+	if value == nil {
+		return nil, s.evictions.notFound(id)
+	}
+	session := &diskSession{}
+	if err := jsoniter.Unmarshal(value, session); err != nil {
+		return nil, errors.New("invalid correlation-id storage value found")
+	}
+	if session.expired(time.Now()) {
+		return nil, &SessionEvictedError{Reason: EvictionTTL}
+	}
+	return session, nil
+}
+
+// expired returns true if the session has expired at the provided time.
+func (session *diskSession) expired(now time.Time) bool {
+	return !session.Expiry.IsZero() && now.After(session.Expiry)
+}
+
+// refreshDiskSession extends the expiry of a sliding session by its TTL.
+func refreshDiskSession(tx *bolt.Tx, id string, session *diskSession) error {
+	if !session.Sliding {
+		return nil
+	}
+	session.Expiry = time.Now().Add(session.TTL)
+	return putDiskSession(tx, id, session)
+}
+
+// putDiskSession writes a session for an id to the sessions bucket.
+func putDiskSession(tx *bolt.Tx, id string, session *diskSession) error {
+	value, err := jsoniter.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal session")
+	}
+	return tx.Bucket(sessionsBucket).Put([]byte(id), value)
+}
+
+// deleteSession deletes a session and its interactions if it exists.
+func (s *DiskStorage) deleteSession(tx *bolt.Tx, id string) error {
+	sessions := tx.Bucket(sessionsBucket)
+	value := sessions.Get([]byte(id))
+	if value == nil {
+		return nil
+	}
+	session := &diskSession{}
+	if err := jsoniter.Unmarshal(value, session); err == nil {
+		s.account(tx, -session.Size)
+	}
+	if err := sessions.Delete([]byte(id)); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		if session.AESKey != "" {
+			atomic.AddInt64(&s.sessions, -1)
+		}
+		s.keys.delete(id)
+	})
+	if err := tx.Bucket(dataBucket).DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	if err := tx.Bucket(metadataBucket).DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+// setKey sets the key of a new session once the transaction is committed,
+// checking that a cipher can be created for it beforehand.
+func (s *DiskStorage) setKey(tx *bolt.Tx, id string, version int, raw []byte) error {
+	if _, err := newSessionCipher(version, raw); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		_ = s.keys.set(id, version, raw)
+		atomic.AddInt64(&s.sessions, 1)
+	})
+	return nil
+}
+
+// putDiskMetadata writes the metadata of an interaction of an id.
+func putDiskMetadata(tx *bolt.Tx, id string, key []byte, metadata *Metadata) error {
+	bucket, err := tx.Bucket(metadataBucket).CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	value, err := jsoniter.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal metadata")
+	}
+	return bucket.Put(key, value)
+}
+
+// getDiskMetadata returns the metadata of an interaction from the metadata
+// bucket of an id, interactions stored before metadata was kept have none.
+func getDiskMetadata(bucket *bolt.Bucket, key []byte) Metadata {
+	metadata := Metadata{}
+	if bucket != nil {
+		if value := bucket.Get(key); value != nil {
+			_ = jsoniter.Unmarshal(value, &metadata)
+		}
+	}
+	return metadata
+}
+
+// matchDiskItem returns true if the interaction stored under a key matches the filter.
+func matchDiskItem(filter *Filter, metadata *bolt.Bucket, key []byte) bool {
+	if !filter.active() {
+		return true
+	}
+	item := getDiskMetadata(metadata, key)
+	return filter.match(&item)
+}
+
+// deleteDiskItems deletes the interactions stored under the keys of an id.
+func deleteDiskItems(bucket, metadata *bolt.Bucket, keys [][]byte) error {
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		if metadata == nil {
+			continue
+		}
+		if err := metadata.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendInteraction appends an interaction to the bucket of an id after enforcing
+// the quota and updates the session accordingly, notifying the subscribers of the
+// id once the transaction is committed.
+func (s *DiskStorage) appendInteraction(tx *bolt.Tx, id string, session *diskSession, value string, metadata Metadata) error {
+	bucket, err := tx.Bucket(dataBucket).CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	size := int64(len(value))
+	session.Seen++
+	queue := &diskQueue{s: s, tx: tx, id: id, bucket: bucket, session: session}
+	dropped, admitted, err := s.quota.admit(queue, size, session.Seen, atomic.LoadInt64(&s.size))
+	if err != nil {
+		return err
+	}
+	session.Dropped += uint64(dropped)
+
+	if admitted {
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := bucket.Put(key, []byte(value)); err != nil {
+			return err
+		}
+		if err := putDiskMetadata(tx, id, key, &metadata); err != nil {
+			return err
+		}
+		session.Count++
+		session.Size += size
+		s.account(tx, size)
+		tx.OnCommit(func() {
+			s.subscribers.notify(id)
+		})
+	}
+	return putDiskSession(tx, id, session)
+}
+
+// interactionsAfter removes the interactions for an id matching the filter up to
+// and including the after sequence number and returns the remaining matching ones
+// within the limits of the filter with their sequence numbers and whether matching
+// ones were left.
+func (s *DiskStorage) interactionsAfter(tx *bolt.Tx, id string, session *diskSession, after uint64, filter *Filter) ([]string, []uint64, bool, error) {
+	bucket := tx.Bucket(dataBucket).Bucket([]byte(id))
+	if bucket == nil {
+		return []string{}, []uint64{}, false, nil
+	}
+	metadata := tx.Bucket(metadataBucket).Bucket([]byte(id))
+
+	var acknowledged [][]byte
+	var released, size int64
+	var hasMore bool
+	data := []string{}
+	sequences := []uint64{}
+	start := filter.start(after)
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if !matchDiskItem(filter, metadata, k) {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(k)
+		if seq <= after {
+			acknowledged = append(acknowledged, append([]byte(nil), k...))
+			released += int64(len(v))
+			continue
+		}
+		if seq <= start {
+			continue
+		}
+		// keys are ordered so no interaction left can be acknowledged
+		if filter.full(len(data), size+int64(len(v))) {
+			hasMore = true
+			break
+		}
+		data = append(data, string(v))
+		sequences = append(sequences, seq)
+		size += int64(len(v))
+	}
+	if len(acknowledged) == 0 {
+		return data, sequences, hasMore, nil
+	}
+	if err := deleteDiskItems(bucket, metadata, acknowledged); err != nil {
+		return nil, nil, false, err
+	}
+	session.Count -= len(acknowledged)
+	session.Size -= released
+	s.account(tx, -released)
+	return data, sequences, hasMore, putDiskSession(tx, id, session)
+}
+
+// drainInteractions returns the interactions for an id matching the filter within
+// its limits and removes them, along with whether matching ones were left.
+func (s *DiskStorage) drainInteractions(tx *bolt.Tx, id string, session *diskSession, filter *Filter) ([]string, bool, error) {
+	bucket := tx.Bucket(dataBucket).Bucket([]byte(id))
+	if bucket == nil {
+		return []string{}, false, nil
+	}
+	metadata := tx.Bucket(metadataBucket).Bucket([]byte(id))
+
+	var drained [][]byte
+	var released int64
+	var hasMore bool
+	var data []string
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if !matchDiskItem(filter, metadata, k) {
+			continue
+		}
+		if filter.full(len(data), released+int64(len(v))) {
+			hasMore = true
+			break
+		}
+		data = append(data, string(v))
+		drained = append(drained, append([]byte(nil), k...))
+		released += int64(len(v))
+	}
+	if len(data) == 0 {
+		return data, hasMore, nil
+	}
+	if err := deleteDiskItems(bucket, metadata, drained); err != nil {
+		return nil, false, err
+	}
+	session.Count -= len(drained)
+	session.Size -= released
+	s.account(tx, -released)
+	return data, hasMore, putDiskSession(tx, id, session)
+}
+
+// readDiskInteractions returns the interactions for an id matching the filter after
+// the start sequence number within the limits of the filter without removing them,
+// along with their sequence numbers and whether matching ones were left.
+func readDiskInteractions(tx *bolt.Tx, id string, start uint64, filter *Filter) ([]string, []uint64, bool) {
+	bucket := tx.Bucket(dataBucket).Bucket([]byte(id))
+	if bucket == nil {
+		return []string{}, []uint64{}, false
+	}
+	metadata := tx.Bucket(metadataBucket).Bucket([]byte(id))
+
+	var size int64
+	var hasMore bool
+	data := []string{}
+	sequences := []uint64{}
+	seek := make([]byte, 8)
+	binary.BigEndian.PutUint64(seek, start+1)
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek(seek); k != nil; k, v = cursor.Next() {
+		if !matchDiskItem(filter, metadata, k) {
+			continue
+		}
+		if filter.full(len(data), size+int64(len(v))) {
+			hasMore = true
+			break
+		}
+		data = append(data, string(v))
+		sequences = append(sequences, binary.BigEndian.Uint64(k))
+		size += int64(len(v))
+	}
+	return data, sequences, hasMore
+}
+
+// removeBefore removes the interactions of an id received before the cutoff.
+func (s *DiskStorage) removeBefore(tx *bolt.Tx, id string, session *diskSession, cutoff time.Time) error {
+	bucket := tx.Bucket(dataBucket).Bucket([]byte(id))
+	if bucket == nil {
+		return nil
+	}
+	metadata := tx.Bucket(metadataBucket).Bucket([]byte(id))
+
+	var expired [][]byte
+	var released int64
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		// interactions stored before metadata was kept have no timestamp
+		if item := getDiskMetadata(metadata, k); !item.Timestamp.Before(cutoff) {
+			break
+		}
+		expired = append(expired, append([]byte(nil), k...))
+		released += int64(len(v))
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if err := deleteDiskItems(bucket, metadata, expired); err != nil {
+		return err
+	}
+	session.Count -= len(expired)
+	session.Size -= released
+	s.account(tx, -released)
+	return putDiskSession(tx, id, session)
+}
+
+// diskQueue is the pending queue of a correlation-id within a transaction.
+type diskQueue struct {
+	s       *DiskStorage
+	tx      *bolt.Tx
+	id      string
+	bucket  *bolt.Bucket
+	session *diskSession
+}
+
+func (q *diskQueue) len() int {
+	return q.session.Count
+}
+
+func (q *diskQueue) size() int64 {
+	return q.session.Size
+}
+
+// remove removes the i-th pending interaction, walking the cursor to its key
+// from the closest end of the queue.
+func (q *diskQueue) remove(i int) error {
+	if i < 0 || i >= q.session.Count {
+		return errors.New("could not find pending interaction")
+	}
+	cursor := q.bucket.Cursor()
+	var k, v []byte
+	if i < q.session.Count/2 {
+		k, v = cursor.First()
+		for j := 0; j < i && k != nil; j++ {
+			k, v = cursor.Next()
+		}
+	} else {
+		k, v = cursor.Last()
+		for j := q.session.Count - 1; j > i && k != nil; j-- {
+			k, v = cursor.Prev()
+		}
+	}
+	if k == nil {
+		return errors.New("could not find pending interaction")
+	}
+	size := int64(len(v))
+	if err := deleteDiskItems(q.bucket, q.tx.Bucket(metadataBucket).Bucket([]byte(q.id)), [][]byte{append([]byte(nil), k...)}); err != nil {
+		return err
+	}
+	q.session.Count--
+	q.session.Size -= size
+	q.s.account(q.tx, -size)
+	return nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestDiskStoragePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interactsh.db")
+	storage, err := NewDisk(path, &Options{EvictionTTL: 1 * time.Hour, StateKey: "state-key"})
+	require.Nil(t, err, "could not create disk storage")
+
+	secret := uuid.New().String()
+	correlationID := xid.New().String()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "could not generate rsa key")
+
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(priv.Public())
+	require.Nil(t, err, "could not marshal public key")
+
+	pubkeyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: pubkeyBytes,
+	})
+	encoded := base64.StdEncoding.EncodeToString(pubkeyPem)
+
+	err = storage.SetIDPublicKey(correlationID, secret, encoded)
+	require.Nil(t, err, "could not set correlation-id and rsa public key in storage")
+
+	err = storage.SetIDPublicKey(correlationID, secret, encoded)
+	require.NotNil(t, err, "could set already registered correlation-id in storage")
+
+	hooked := xid.New().String()
+	err = storage.Register(&Registration{CorrelationID: hooked, SecretKey: secret, PublicKey: encoded, Webhook: "https://example.com/hook"})
+	require.Nil(t, err, "could not register correlation-id with webhook in storage")
+
+	err = storage.AddInteraction(correlationID, []byte("hello world"))
+	require.Nil(t, err, "could not add interaction to storage")
+	require.Nil(t, storage.Close(), "could not close disk storage")
+
+	// Reopen the storage and make sure the session and interaction survived
+	storage, err = NewDisk(path, &Options{EvictionTTL: 1 * time.Hour, StateKey: "state-key"})
+	require.Nil(t, err, "could not reopen disk storage")
+	defer storage.Close()
+
+	require.Equal(t, 2, storage.GetCacheMetrics().Sessions, "could not get correct session count")
+
+	webhooks, err := storage.ListWebhooks()
+	require.Nil(t, err, "could not list webhooks")
+	require.Equal(t, []*Webhook{{CorrelationID: hooked, SecretKey: secret, URL: "https://example.com/hook"}}, webhooks, "could not get persisted webhook")
+
+	_, err = storage.GetInteractions(correlationID, "wrong-secret", nil)
+	require.NotNil(t, err, "could get interactions with invalid secret")
+
+	interactions, err := storage.GetInteractions(correlationID, secret, nil)
+	require.Nil(t, err, "could not get interactions from storage")
+	require.Len(t, interactions.Data, 1, "could not get persisted interaction")
+	require.NotEmpty(t, interactions.AESKey, "could not get persisted aes key")
+
+	interactions, err = storage.GetInteractions(correlationID, secret, nil)
+	require.Nil(t, err, "could not get interactions from storage")
+	require.Empty(t, interactions.Data, "could get already polled interactions")
+
+	err = storage.RemoveID(correlationID, secret)
+	require.Nil(t, err, "could not remove correlation-id from storage")
+	require.Equal(t, 1, storage.GetCacheMetrics().Sessions, "could not get correct session count")
+}
+
+func TestDiskStorageSessionKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interactsh.db")
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	register := func(options *Options) string {
+		storage, err := NewDisk(path, options)
+		require.Nil(t, err, "could not create disk storage")
+		defer storage.Close()
+
+		correlationID := xid.New().String()
+		err = storage.Register(&Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD})
+		require.Nil(t, err, "could not register correlation-id in storage")
+		err = storage.AddInteraction(correlationID, []byte("hello world"))
+		require.Nil(t, err, "could not add interaction to storage")
+
+		key := storage.keys.get(correlationID)
+		require.NotNil(t, key, "could not keep session key")
+		err = storage.db.View(func(tx *bolt.Tx) error {
+			value := tx.Bucket(sessionsBucket).Get([]byte(correlationID))
+			require.False(t, bytes.Contains(value, key.raw), "could persist plaintext session key")
+			require.NotContains(t, string(value), base64.StdEncoding.EncodeToString(key.raw), "could persist plaintext session key")
+			return nil
+		})
+		require.Nil(t, err, "could not read session")
+		return correlationID
+	}
+
+	// without a state key sessions are removed when the storage is reopened
+	correlationID := register(&Options{EvictionTTL: 1 * time.Hour})
+	storage, err := NewDisk(path, &Options{EvictionTTL: 1 * time.Hour})
+	require.Nil(t, err, "could not reopen disk storage")
+	_, err = storage.GetInteractions(correlationID, "secret", nil)
+	require.NotNil(t, err, "could get interactions of session without key")
+	require.Equal(t, int64(0), storage.GetCacheMetrics().Size, "could keep size of removed session")
+	require.Nil(t, storage.Close(), "could not close disk storage")
+
+	correlationID = register(&Options{EvictionTTL: 1 * time.Hour, StateKey: "state-key"})
+	_, err = NewDisk(path, &Options{EvictionTTL: 1 * time.Hour, StateKey: "wrong-key"})
+	require.NotNil(t, err, "could open disk storage with invalid state key")
+
+	storage, err = NewDisk(path, &Options{EvictionTTL: 1 * time.Hour, StateKey: "state-key"})
+	require.Nil(t, err, "could not reopen disk storage")
+	defer storage.Close()
+	err = storage.AddInteraction(correlationID, []byte("after restart"))
+	require.Nil(t, err, "could not add interaction to reopened session")
+	interactions, err := storage.GetInteractions(correlationID, "secret", nil)
+	require.Nil(t, err, "could not get interactions from storage")
+	require.Len(t, interactions.Data, 2, "could not get interactions of reopened session")
+}
+
+func TestDiskStorageExpiry(t *testing.T) {
+	storage, err := NewDisk(filepath.Join(t.TempDir(), "interactsh.db"), &Options{EvictionTTL: -1 * time.Second})
+	require.Nil(t, err, "could not create disk storage")
+	defer storage.Close()
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+
+	correlationID := xid.New().String()
+	err = storage.Register(&Registration{CorrelationID: correlationID, PublicKey: base64.StdEncoding.EncodeToString(pub[:]), KeyType: KeyTypeX25519})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	err = storage.AddInteraction(correlationID, []byte("data"))
+	require.NotNil(t, err, "could add interaction to expired correlation-id")
+
+	// Unencrypted ids never expire
+	err = storage.SetID("token")
+	require.Nil(t, err, "could not set id in storage")
+
+	err = storage.AddInteractionWithId("token", []byte("data"))
+	require.Nil(t, err, "could not add interaction to id")
+
+	storage.removeExpired()
+	metrics := storage.GetCacheMetrics()
+	require.Equal(t, 0, metrics.Sessions, "could not remove expired session")
+	require.Equal(t, 1, metrics.Dropped, "could not count expired session")
+}
+
+func TestDiskStorageStaleIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interactsh.db")
+	storage, err := NewDisk(path, &Options{EvictionTTL: 100 * time.Millisecond})
+	require.Nil(t, err, "could not create disk storage")
+	for _, id := range []string{"previous-token", "domain"} {
+		require.Nil(t, storage.SetID(id), "could not set id in storage")
+		require.Nil(t, storage.AddInteractionWithId(id, []byte("data")), "could not add interaction to id")
+	}
+	require.Nil(t, storage.Close(), "could not close disk storage")
+
+	// the ids which are not set again once reopened expire
+	storage, err = NewDisk(path, &Options{EvictionTTL: 100 * time.Millisecond})
+	require.Nil(t, err, "could not reopen disk storage")
+	defer storage.Close()
+	for _, id := range []string{"token", "domain"} {
+		require.Nil(t, storage.SetID(id), "could not set id in storage")
+	}
+	time.Sleep(200 * time.Millisecond)
+	storage.removeExpired()
+
+	require.NotNil(t, storage.AddInteractionWithId("previous-token", []byte("data")), "could keep id of previous token")
+	interactions, err := storage.GetInteractionsWithIdAfter("domain", 0, nil)
+	require.Nil(t, err, "could not get interactions of id set again")
+	require.Len(t, interactions.Data, 1, "could not keep interactions of id set again")
+}
+
+func TestDiskQueueRemove(t *testing.T) {
+	storage, err := NewDisk(filepath.Join(t.TempDir(), "interactsh.db"), &Options{EvictionTTL: 1 * time.Hour})
+	require.Nil(t, err, "could not create disk storage")
+	defer storage.Close()
+
+	require.Nil(t, storage.SetID("id"), "could not set id in storage")
+	for i := 1; i <= 10; i++ {
+		err = storage.AddInteractionWithId("id", []byte(strconv.Itoa(i)))
+		require.Nil(t, err, "could not add interaction to id")
+	}
+
+	remove := func(i int) {
+		err := storage.db.Update(func(tx *bolt.Tx) error {
+			session, err := storage.getDiskSession(tx, "id")
+			if err != nil {
+				return err
+			}
+			queue := &diskQueue{s: storage, tx: tx, id: "id", bucket: tx.Bucket(dataBucket).Bucket([]byte("id")), session: session}
+			if err := queue.remove(i); err != nil {
+				return err
+			}
+			return putDiskSession(tx, "id", session)
+		})
+		require.Nil(t, err, "could not remove pending interaction")
+	}
+	remove(3)
+	remove(3)
+	remove(0)
+	remove(6)
+	// keys are not evenly spread once interactions were removed from the middle
+	remove(4)
+
+	interactions, err := storage.GetInteractionsWithIdAfter("id", 0, nil)
+	require.Nil(t, err, "could not get interactions from storage")
+	require.Equal(t, []uint64{2, 3, 6, 7, 9}, interactions.Sequences, "could not remove pending interactions")
+	require.Equal(t, 0, storage.GetCacheMetrics().Sessions, "could count id as session")
+}
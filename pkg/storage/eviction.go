@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EvictionReason is the reason for which a correlation-id session was evicted.
+type EvictionReason string
+
+const (
+	// EvictionTTL is used for sessions which have expired.
+	EvictionTTL EvictionReason = "ttl"
+	// EvictionCapacity is used for sessions evicted to keep the storage within its capacity.
+	EvictionCapacity EvictionReason = "capacity"
+	// EvictionDeregister is used for sessions removed by their client.
+	EvictionDeregister EvictionReason = "deregister"
+	// EvictionAdmin is used for sessions evicted by an administrator.
+	EvictionAdmin EvictionReason = "admin"
+)
+
+// EvictionEvent is emitted when a correlation-id session is evicted.
+type EvictionEvent struct {
+	// CorrelationID is the correlation-id of the evicted session.
+	CorrelationID string
+	// Reason is the reason for which the session was evicted.
+	Reason EvictionReason
+	// Time is the time at which the session was evicted.
+	Time time.Time
+}
+
+// EvictionCallback is a callback function for evicted sessions.
+type EvictionCallback func(event *EvictionEvent)
+
+// ErrSessionNotFound is returned for a correlation-id without a session.
+var ErrSessionNotFound = errors.New("could not get correlation-id from storage")
+
+// SessionEvictedError is returned for a correlation-id whose session was evicted.
+type SessionEvictedError struct {
+	// Reason is the reason for which the session was evicted.
+	Reason EvictionReason
+}
+
+// Error returns the error message for the evicted session.
+func (e *SessionEvictedError) Error() string {
+	return fmt.Sprintf("correlation-id session was evicted (%s)", e.Reason)
+}
+
+// IsSessionEvicted returns true if err reports a correlation-id without a
+// session along with the reason of the eviction if it is known.
+func IsSessionEvicted(err error) (EvictionReason, bool) {
+	switch err := errors.Cause(err).(type) {
+	case *SessionEvictedError:
+		return err.Reason, true
+	default:
+		return "", err == ErrSessionNotFound
+	}
+}
+
+// maxEvictionRecords is the maximum number of evicted sessions remembered.
+const maxEvictionRecords = 100000
+
+// evictionLog records the recently evicted sessions so that later requests
+// for them can report why the session is gone.
+type evictionLog struct {
+	mutex    sync.Mutex
+	reasons  map[string]EvictionReason
+	order    []string
+	counts   map[EvictionReason]int64
+	callback EvictionCallback
+}
+
+// newEvictionLog creates a new eviction log calling callback on each eviction.
+func newEvictionLog(callback EvictionCallback) *evictionLog {
+	return &evictionLog{
+		reasons:  make(map[string]EvictionReason),
+		counts:   make(map[EvictionReason]int64),
+		callback: callback,
+	}
+}
+
+// record records the eviction of a correlation-id session.
+func (l *evictionLog) record(correlationID string, reason EvictionReason) {
+	l.mutex.Lock()
+	if _, ok := l.reasons[correlationID]; !ok {
+		if len(l.order) >= maxEvictionRecords {
+			delete(l.reasons, l.order[0])
+			l.order = l.order[1:]
+		}
+		l.order = append(l.order, correlationID)
+	}
+	l.reasons[correlationID] = reason
+	l.counts[reason]++
+	l.mutex.Unlock()
+
+	if l.callback != nil {
+		l.callback(&EvictionEvent{CorrelationID: correlationID, Reason: reason, Time: time.Now()})
+	}
+}
+
+// notFound returns the error for a correlation-id without a session.
+func (l *evictionLog) notFound(correlationID string) error {
+	l.mutex.Lock()
+	reason, ok := l.reasons[correlationID]
+	l.mutex.Unlock()
+
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return &SessionEvictedError{Reason: reason}
+}
+
+// metrics returns the number of evicted sessions for each reason.
+func (l *evictionLog) metrics() map[EvictionReason]int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	counts := make(map[EvictionReason]int64, len(l.counts))
+	for reason, count := range l.counts {
+		counts[reason] = count
+	}
+	return counts
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Metadata is the plaintext metadata kept along with an encrypted
+// interaction so that polls can be filtered by the server.
+type Metadata struct {
+	// Protocol is the protocol of the interaction.
+	Protocol string `json:"protocol,omitempty"`
+	// FullID is the full subdomain which received the interaction.
+	FullID string `json:"full-id,omitempty"`
+	// Timestamp is the time at which the interaction was received.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// parseMetadata returns the metadata of a JSON encoded interaction.
+func parseMetadata(data []byte) Metadata {
+	metadata := Metadata{}
+	_ = jsoniter.Unmarshal(data, &metadata)
+	return metadata
+}
+
+// sharedMetadata returns the metadata of an interaction of an id bucket, which
+// are kept until their retention based on the time at which they are received.
+func sharedMetadata(data []byte) Metadata {
+	metadata := parseMetadata(data)
+	if metadata.Timestamp.IsZero() {
+		metadata.Timestamp = time.Now()
+	}
+	return metadata
+}
+
+// Filter selects the interactions returned by a poll. Interactions which
+// don't match the filter are kept for later polls.
+type Filter struct {
+	// Protocols contains the protocols of the interactions to return.
+	Protocols []string
+	// Since is the time after which the interactions to return were received.
+	Since time.Time
+	// FullIDPrefix is the prefix of the full subdomain of the interactions to return.
+	FullIDPrefix string
+	// Limit is the maximum number of interactions to return.
+	Limit int
+	// MaxSize is the maximum size in bytes of the stored interactions to
+	// return, the first interaction is returned regardless of its size.
+	MaxSize int64
+	// Continuation is the sequence number of the last interaction returned by a
+	// previous page of a cursor based poll. Only later interactions are returned
+	// without acknowledging the interactions up to it.
+	Continuation uint64
+}
+
+// active returns true if the filter selects a subset of the interactions.
+func (f *Filter) active() bool {
+	return f != nil && (len(f.Protocols) > 0 || !f.Since.IsZero() || f.FullIDPrefix != "" || f.Limit > 0 || f.MaxSize > 0 || f.Continuation > 0)
+}
+
+// match returns true if an interaction with the provided metadata matches the filter.
+func (f *Filter) match(metadata *Metadata) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Protocols) > 0 {
+		matched := false
+		for _, protocol := range f.Protocols {
+			if strings.EqualFold(protocol, metadata.Protocol) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && metadata.Timestamp.Before(f.Since) {
+		return false
+	}
+	// subdomains are case insensitive
+	return len(metadata.FullID) >= len(f.FullIDPrefix) && strings.EqualFold(metadata.FullID[:len(f.FullIDPrefix)], f.FullIDPrefix)
+}
+
+// full returns true if no interaction can be added to count interactions
+// without exceeding the limits of the filter, size being the total size of
+// the interactions including the one to add.
+func (f *Filter) full(count int, size int64) bool {
+	if f == nil {
+		return false
+	}
+	return (f.Limit > 0 && count >= f.Limit) || (f.MaxSize > 0 && count > 0 && size > f.MaxSize)
+}
+
+// start returns the sequence number after which interactions are returned
+// by a cursor based poll acknowledging the interactions up to after.
+func (f *Filter) start(after uint64) uint64 {
+	if f != nil && f.Continuation > after {
+		return f.Continuation
+	}
+	return after
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	configBucket = []byte("config")
+	// keySaltKey is the key of the salt of the state key in the config bucket.
+	keySaltKey = []byte("key-salt")
+	// keyCheckKey is the key of a value sealed with the state key in the
+	// config bucket, used to detect a state key different from the one the
+	// session keys were sealed with.
+	keyCheckKey = []byte("key-check")
+)
+
+// keyCheckValue is the plaintext of the value sealed to check the state key.
+var keyCheckValue = []byte("interactsh-session-keys")
+
+// sessionKeys contains the decrypted AES keys of the sessions of the disk
+// storage. They are only kept in memory, the database containing them
+// sealed with the state key if any.
+type sessionKeys struct {
+	mutex sync.RWMutex
+	keys  map[string]*sessionKey
+	// sealer seals the keys persisted along with their session, nil if the
+	// keys are not persisted.
+	sealer cipher.AEAD
+}
+
+// sessionKey is the decrypted AES key of a session along with its cipher.
+type sessionKey struct {
+	raw    []byte
+	cipher *sessionCipher
+}
+
+// newSessionKeys creates the session keys of a database, deriving the key
+// sealing them from the state key if provided.
+func newSessionKeys(tx *bolt.Tx, stateKey string) (*sessionKeys, error) {
+	keys := &sessionKeys{keys: make(map[string]*sessionKey)}
+	if stateKey == "" {
+		return keys, nil
+	}
+	config, err := tx.CreateBucketIfNotExists(configBucket)
+	if err != nil {
+		return nil, err
+	}
+	salt := config.Get(keySaltKey)
+	if salt == nil {
+		salt = make([]byte, snapshotSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, errors.Wrap(err, "could not generate state key salt")
+		}
+		if err := config.Put(keySaltKey, salt); err != nil {
+			return nil, err
+		}
+	}
+	if keys.sealer, err = newSnapshotCipher(stateKey, salt); err != nil {
+		return nil, err
+	}
+
+	if check := config.Get(keyCheckKey); check != nil {
+		value, err := keys.open(check)
+		if err != nil || !bytes.Equal(value, keyCheckValue) {
+			return nil, errors.New("could not open session keys, invalid state key")
+		}
+		return keys, nil
+	}
+	check, err := keys.seal(keyCheckValue)
+	if err != nil {
+		return nil, err
+	}
+	return keys, config.Put(keyCheckKey, check)
+}
+
+// get returns the key of a session, nil if it is unknown.
+func (k *sessionKeys) get(id string) *sessionKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	return k.keys[id]
+}
+
+// set sets the key of a session.
+func (k *sessionKeys) set(id string, version int, raw []byte) error {
+	sessionCipher, err := newSessionCipher(version, raw)
+	if err != nil {
+		return errors.Wrap(err, "could not create session cipher")
+	}
+	k.mutex.Lock()
+	k.keys[id] = &sessionKey{raw: raw, cipher: sessionCipher}
+	k.mutex.Unlock()
+	return nil
+}
+
+// delete deletes the key of a session.
+func (k *sessionKeys) delete(id string) {
+	k.mutex.Lock()
+	delete(k.keys, id)
+	k.mutex.Unlock()
+}
+
+// seal seals a key with the state key, returning nil if keys aren't persisted.
+func (k *sessionKeys) seal(raw []byte) ([]byte, error) {
+	if k.sealer == nil {
+		return nil, nil
+	}
+	nonce := make([]byte, k.sealer.NonceSize(), k.sealer.NonceSize()+len(raw)+k.sealer.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+	return k.sealer.Seal(nonce, nonce, raw, nil), nil
+}
+
+// open opens a key sealed with seal.
+func (k *sessionKeys) open(sealed []byte) ([]byte, error) {
+	if k.sealer == nil {
+		return nil, errors.New("no state key provided")
+	}
+	if len(sealed) < k.sealer.NonceSize() {
+		return nil, errors.New("invalid sealed key")
+	}
+	nonceSize := k.sealer.NonceSize()
+	return k.sealer.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// notifier notifies the subscribers of an id when interactions are added for it.
+type notifier struct {
+	// count is the number of subscriptions, checked before taking the lock
+	// so that interactions for ids without subscribers don't contend on it.
+	count       int64
+	mutex       sync.RWMutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+// newNotifier creates a new notifier without subscribers.
+func newNotifier() *notifier {
+	return &notifier{subscribers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// subscribe returns a channel notified when interactions are added for any
+// of the ids along with a function to cancel the subscription. Notifications
+// are coalesced while the subscriber is busy.
+func (n *notifier) subscribe(ids ...string) (<-chan struct{}, func()) {
+	notify := make(chan struct{}, 1)
+
+	n.mutex.Lock()
+	for _, id := range ids {
+		subscribers, ok := n.subscribers[id]
+		if !ok {
+			subscribers = make(map[chan struct{}]struct{})
+			n.subscribers[id] = subscribers
+		}
+		subscribers[notify] = struct{}{}
+	}
+	atomic.AddInt64(&n.count, 1)
+	n.mutex.Unlock()
+
+	var once sync.Once
+	return notify, func() {
+		once.Do(func() {
+			n.mutex.Lock()
+			for _, id := range ids {
+				subscribers := n.subscribers[id]
+				delete(subscribers, notify)
+				if len(subscribers) == 0 {
+					delete(n.subscribers, id)
+				}
+			}
+			atomic.AddInt64(&n.count, -1)
+			n.mutex.Unlock()
+		})
+	}
+}
+
+// notify notifies the subscribers of an id.
+func (n *notifier) notify(id string) {
+	if atomic.LoadInt64(&n.count) == 0 {
+		return
+	}
+	n.mutex.RLock()
+	for notify := range n.subscribers[id] {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+	n.mutex.RUnlock()
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// DropPolicy is the policy used to drop interactions once a quota is exceeded.
+type DropPolicy string
+
+const (
+	// DropOldest drops the oldest pending interactions to make room for new ones.
+	DropOldest DropPolicy = "oldest"
+	// DropNewest drops new interactions until pending ones are polled.
+	DropNewest DropPolicy = "newest"
+	// DropSample keeps an uniformly distributed sample of all the interactions
+	// received by dropping random pending or new ones (reservoir sampling).
+	DropSample DropPolicy = "sample"
+)
+
+// ParseDropPolicy parses a drop policy from its name.
+func ParseDropPolicy(value string) (DropPolicy, error) {
+	switch policy := DropPolicy(value); policy {
+	case DropOldest, DropNewest, DropSample:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid drop policy %s", value)
+	}
+}
+
+// Quota contains the limits applied to the interactions stored by the storage.
+//
+// A zero value for any of the limits means unlimited.
+type Quota struct {
+	// MaxInteractions is the maximum number of pending interactions for a correlation-id.
+	MaxInteractions int
+	// MaxBytes is the maximum size in bytes of the pending interactions for a correlation-id.
+	MaxBytes int64
+	// MaxTotalBytes is the maximum size in bytes of the pending interactions for all ids.
+	MaxTotalBytes int64
+	// DropPolicy is the policy used once the limits of a correlation-id are exceeded.
+	DropPolicy DropPolicy
+}
+
+// pendingQueue is a queue of pending interactions on which a quota is enforced.
+type pendingQueue interface {
+	// len returns the number of pending interactions.
+	len() int
+	// size returns the size in bytes of the pending interactions.
+	size() int64
+	// remove removes the i-th pending interaction.
+	remove(i int) error
+}
+
+// exceeded returns true if a correlation-id holding count interactions of size bytes exceeds the quota.
+func (q *Quota) exceeded(count int, size int64) bool {
+	return (q.MaxInteractions > 0 && count > q.MaxInteractions) || (q.MaxBytes > 0 && size > q.MaxBytes)
+}
+
+// admit enforces the quota before a new interaction of size bytes is appended to
+// the queue of a correlation-id, which has seen interactions in total including the
+// new one, while all the ids hold totalSize bytes. Pending interactions are evicted
+// according to the drop policy. It returns the number of dropped interactions and
+// whether the new interaction should be stored.
+func (q *Quota) admit(queue pendingQueue, size int64, seen uint64, totalSize int64) (int, bool, error) {
+	if q.MaxTotalBytes > 0 && totalSize+size > q.MaxTotalBytes {
+		return 1, false, nil
+	}
+	if !q.exceeded(queue.len()+1, queue.size()+size) {
+		return 0, true, nil
+	}
+	if q.MaxBytes > 0 && size > q.MaxBytes {
+		return 1, false, nil
+	}
+
+	switch q.DropPolicy {
+	case DropNewest:
+		return 1, false, nil
+	case DropSample:
+		// keep the new interaction with a probability of held / seen
+		if seen == 0 || rand.Int63n(int64(seen)) >= int64(queue.len()) {
+			return 1, false, nil
+		}
+	}
+
+	dropped := 0
+	for queue.len() > 0 && q.exceeded(queue.len()+1, queue.size()+size) {
+		var i int
+		if q.DropPolicy == DropSample {
+			i = rand.Intn(queue.len())
+		}
+		if err := queue.remove(i); err != nil {
+			return dropped, false, err
+		}
+		dropped++
+	}
+	return dropped, true, nil
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is the number of shards of the session map, it must be a power of two.
+const shardCount = 256
+
+// sessionMap is a map of correlation-id sessions striped over a number of
+// shards, each protected by its own lock, so that the lookups done for every
+// new interaction do not contend on a single lock.
+type sessionMap struct {
+	// count is the number of sessions of the map.
+	count       int64
+	maxPerShard int
+	shards      [shardCount]sessionShard
+}
+
+// sessionShard is a shard of the session map.
+type sessionShard struct {
+	mutex   sync.RWMutex
+	entries map[string]*CorrelationData
+}
+
+// newSessionMap creates a new session map holding at most maxSize sessions.
+func newSessionMap(maxSize int) *sessionMap {
+	m := &sessionMap{maxPerShard: maxSize / shardCount}
+	if m.maxPerShard < 1 {
+		m.maxPerShard = 1
+	}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]*CorrelationData)
+	}
+	return m
+}
+
+// shard returns the shard of a key using the FNV-1a hash of the key.
+func (m *sessionMap) shard(key string) *sessionShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &m.shards[hash&(shardCount-1)]
+}
+
+// get returns the session of a key marking it as accessed.
+func (m *sessionMap) get(key string) *CorrelationData {
+	shard := m.shard(key)
+	shard.mutex.RLock()
+	value := shard.entries[key]
+	shard.mutex.RUnlock()
+
+	if value != nil {
+		atomic.StoreInt64(&value.accessed, time.Now().UnixNano())
+	}
+	return value
+}
+
+// has returns true if a key has a session, without marking it as accessed.
+func (m *sessionMap) has(key string) bool {
+	shard := m.shard(key)
+	shard.mutex.RLock()
+	_, ok := shard.entries[key]
+	shard.mutex.RUnlock()
+	return ok
+}
+
+// set sets the session of a key. It returns the session replaced by the
+// new one and the least recently accessed session of the shard evicted
+// to keep it within its capacity, if any.
+func (m *sessionMap) set(key string, value *CorrelationData) (replaced, evicted *CorrelationData) {
+	atomic.StoreInt64(&value.accessed, time.Now().UnixNano())
+
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	replaced = shard.entries[key]
+	if replaced == nil && len(shard.entries) >= m.maxPerShard {
+		var oldest string
+		for k, v := range shard.entries {
+			if evicted == nil || atomic.LoadInt64(&v.accessed) < atomic.LoadInt64(&evicted.accessed) {
+				oldest, evicted = k, v
+			}
+		}
+		delete(shard.entries, oldest)
+		atomic.AddInt64(&m.count, -1)
+	}
+	if replaced == nil {
+		atomic.AddInt64(&m.count, 1)
+	}
+	shard.entries[key] = value
+	return replaced, evicted
+}
+
+// add sets the session of a key unless the key already has a session which
+// has not expired, returning false in that case. It returns the expired
+// session replaced by the new one and the least recently accessed session
+// of the shard evicted to keep it within its capacity, if any.
+func (m *sessionMap) add(key string, value *CorrelationData) (added bool, expired, evicted *CorrelationData) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&value.accessed, now)
+
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if existing, ok := shard.entries[key]; ok {
+		if !existing.expired(now) {
+			return false, nil, nil
+		}
+		shard.entries[key] = value
+		return true, existing, nil
+	}
+	if len(shard.entries) >= m.maxPerShard {
+		var oldest string
+		for k, v := range shard.entries {
+			if evicted == nil || atomic.LoadInt64(&v.accessed) < atomic.LoadInt64(&evicted.accessed) {
+				oldest, evicted = k, v
+			}
+		}
+		delete(shard.entries, oldest)
+		atomic.AddInt64(&m.count, -1)
+	}
+	atomic.AddInt64(&m.count, 1)
+	shard.entries[key] = value
+	return true, nil, evicted
+}
+
+// delete deletes the session of a key if it is still the provided one.
+func (m *sessionMap) delete(key string, value *CorrelationData) bool {
+	shard := m.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.entries[key] != value {
+		return false
+	}
+	delete(shard.entries, key)
+	atomic.AddInt64(&m.count, -1)
+	return true
+}
+
+// deleteFunc deletes all the sessions for which matches returns true and returns them.
+func (m *sessionMap) deleteFunc(matches func(key string, value *CorrelationData) bool) []*CorrelationData {
+	var deleted []*CorrelationData
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mutex.Lock()
+		for key, value := range shard.entries {
+			if matches(key, value) {
+				delete(shard.entries, key)
+				atomic.AddInt64(&m.count, -1)
+				deleted = append(deleted, value)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return deleted
+}
+
+// len returns the number of sessions of the map.
+func (m *sessionMap) len() int {
+	return int(atomic.LoadInt64(&m.count))
+}
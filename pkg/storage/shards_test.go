@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karlseguin/ccache/v2"
+	"github.com/klauspost/compress/zlib"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestSessionMapCapacity(t *testing.T) {
+	sessions := newSessionMap(shardCount)
+
+	// Keys are spread over the shards so look for two keys of the same shard
+	first := "id-0"
+	var second string
+	for i := 1; second == ""; i++ {
+		if key := "id-" + strconv.Itoa(i); sessions.shard(key) == sessions.shard(first) {
+			second = key
+		}
+	}
+
+	value := &CorrelationData{}
+	replaced, evicted := sessions.set(first, value)
+	require.Nil(t, replaced, "could replace missing session")
+	require.Nil(t, evicted, "could evict session below capacity")
+
+	replaced, evicted = sessions.set(first, &CorrelationData{})
+	require.Equal(t, value, replaced, "could not replace existing session")
+	require.Nil(t, evicted, "could evict session when replacing")
+
+	_, evicted = sessions.set(second, &CorrelationData{})
+	require.NotNil(t, evicted, "could not evict session above capacity")
+	require.Nil(t, sessions.get(first), "could get evicted session")
+	require.NotNil(t, sessions.get(second), "could not get new session")
+	require.Equal(t, 1, sessions.len(), "could not get correct session count")
+
+	require.False(t, sessions.delete(second, value), "could delete replaced session")
+	require.True(t, sessions.delete(second, sessions.get(second)), "could not delete session")
+	require.Equal(t, 0, sessions.len(), "could not get correct session count")
+}
+
+func TestStorageConcurrentRegister(t *testing.T) {
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	storage := New(1 * time.Hour)
+	correlationID := xid.New().String()
+
+	var registered int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(secret string) {
+			defer wg.Done()
+			err := storage.Register(&Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD})
+			if err == nil {
+				atomic.AddInt64(&registered, 1)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), registered, "could register correlation-id more than once")
+
+	// expired sessions can be registered again
+	expired := xid.New().String()
+	err = storage.Register(&Registration{CorrelationID: expired, PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD, TTL: 1 * time.Millisecond})
+	require.Nil(t, err, "could not register correlation-id in storage")
+	time.Sleep(10 * time.Millisecond)
+	err = storage.Register(&Registration{CorrelationID: expired, PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD})
+	require.Nil(t, err, "could not register expired correlation-id again")
+}
+
+// newBenchmarkStorage returns a storage with registered sessions of a crypto version.
+func newBenchmarkStorage(b *testing.B, count, version int) (*Storage, []string) {
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(b, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	// pending interactions are bounded to keep the memory usage stable
+	storage := NewWithOptions(&Options{EvictionTTL: 1 * time.Hour, Quota: Quota{MaxInteractions: 1000}})
+	correlationIDs := make([]string, count)
+	for i := range correlationIDs {
+		correlationIDs[i] = xid.New().String()
+		err := storage.Register(&Registration{CorrelationID: correlationIDs[i], PublicKey: encoded, KeyType: KeyTypeX25519, Version: version})
+		require.Nil(b, err, "could not register correlation-id in storage")
+	}
+	return storage, correlationIDs
+}
+
+var benchmarkInteraction = []byte(`{"protocol":"dns","unique-id":"c23b2la0kl1krjcrdj10cndmnioyyyyyn","full-id":"c23b2la0kl1krjcrdj10cndmnioyyyyyn","q-type":"A","raw-request":";; opcode: QUERY, status: NOERROR, id: 30224","remote-address":"172.253.226.100","timestamp":"2021-09-15T12:00:00Z"}`)
+
+func BenchmarkStorageAddInteraction(b *testing.B) {
+	for name, version := range map[string]int{"legacy": CryptoVersionLegacy, "aead": CryptoVersionAEAD} {
+		b.Run(name, func(b *testing.B) {
+			storage, correlationIDs := newBenchmarkStorage(b, 1024, version)
+			defer storage.Close()
+
+			var counter uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					correlationID := correlationIDs[atomic.AddUint64(&counter, 1)%uint64(len(correlationIDs))]
+					if err := storage.AddInteraction(correlationID, benchmarkInteraction); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStorageAddInteractionFull adds interactions to a session holding
+// its maximum number of interactions, dropping the oldest one for each.
+func BenchmarkStorageAddInteractionFull(b *testing.B) {
+	storage, correlationIDs := newBenchmarkStorage(b, 1, CryptoVersionAEAD)
+	defer storage.Close()
+	for i := 0; i < 1000; i++ {
+		_ = storage.AddInteraction(correlationIDs[0], benchmarkInteraction)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storage.AddInteraction(correlationIDs[0], benchmarkInteraction); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStorageLookup(b *testing.B) {
+	storage, correlationIDs := newBenchmarkStorage(b, 1024, CryptoVersionAEAD)
+	defer storage.Close()
+
+	var counter uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			correlationID := correlationIDs[atomic.AddUint64(&counter, 1)%uint64(len(correlationIDs))]
+			if _, err := storage.getCorrelationData(correlationID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStorageAddInteractionWithId(b *testing.B) {
+	storage := NewWithOptions(&Options{EvictionTTL: 1 * time.Hour, Quota: Quota{MaxInteractions: 1000}})
+	defer storage.Close()
+	_ = storage.SetID("token")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := storage.AddInteractionWithId("token", benchmarkInteraction); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStorageGetCacheMetrics(b *testing.B) {
+	storage, _ := newBenchmarkStorage(b, 1024, CryptoVersionAEAD)
+	defer storage.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = storage.GetCacheMetrics()
+		}
+	})
+}
+
+// cacheStorage is the storage of sessions in a ccache cache used before the
+// sharded session map, kept as the baseline of the storage benchmarks.
+type cacheStorage struct {
+	cache   *ccache.Cache
+	zippers sync.Pool
+}
+
+// cacheSession is a session of the cache storage.
+type cacheSession struct {
+	data   []string
+	mutex  sync.Mutex
+	aesKey []byte
+}
+
+// newBenchmarkCache returns a cache storage with registered sessions.
+func newBenchmarkCache(count int) (*cacheStorage, []string) {
+	storage := &cacheStorage{
+		cache:   ccache.New(ccache.Configure().MaxSize(1000000)),
+		zippers: sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }},
+	}
+	correlationIDs := make([]string, count)
+	for i := range correlationIDs {
+		correlationIDs[i] = xid.New().String()
+		storage.cache.Set(correlationIDs[i], &cacheSession{aesKey: []byte(xid.New().String() + "abcdefghijkl")}, 1*time.Hour)
+	}
+	return storage, correlationIDs
+}
+
+// addInteraction adds an interaction the way the cache storage did, creating
+// the cipher of the session and compressing the interaction for each one.
+func (s *cacheStorage) addInteraction(correlationID string, data []byte) error {
+	item := s.cache.Get(correlationID)
+	if item == nil {
+		return ErrSessionNotFound
+	}
+	value := item.Value().(*cacheSession)
+
+	block, err := aes.NewCipher(value.aesKey)
+	if err != nil {
+		return err
+	}
+	cipherText := make([]byte, aes.BlockSize+len(data))
+	iv := cipherText[:aes.BlockSize]
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return err
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(cipherText[aes.BlockSize:], data)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(cipherText)))
+	base64.StdEncoding.Encode(encoded, cipherText)
+
+	buffer := &bytes.Buffer{}
+	gz := s.zippers.Get().(*zlib.Writer)
+	defer s.zippers.Put(gz)
+	gz.Reset(buffer)
+	if _, err := gz.Write(encoded); err != nil {
+		return err
+	}
+	_ = gz.Close()
+
+	value.mutex.Lock()
+	value.data = append(value.data, buffer.String())
+	// pending interactions are bounded as for the storage
+	if len(value.data) > 1000 {
+		value.data = value.data[1:]
+	}
+	value.mutex.Unlock()
+	return nil
+}
+
+func BenchmarkCacheAddInteraction(b *testing.B) {
+	storage, correlationIDs := newBenchmarkCache(1024)
+	defer storage.cache.Stop()
+
+	var counter uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			correlationID := correlationIDs[atomic.AddUint64(&counter, 1)%uint64(len(correlationIDs))]
+			if err := storage.addInteraction(correlationID, benchmarkInteraction); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheLookup(b *testing.B) {
+	storage, correlationIDs := newBenchmarkCache(1024)
+	defer storage.cache.Stop()
+
+	var counter uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			correlationID := correlationIDs[atomic.AddUint64(&counter, 1)%uint64(len(correlationIDs))]
+			if item := storage.cache.Get(correlationID); item == nil {
+				b.Fatal(ErrSessionNotFound)
+			}
+		}
+	})
+}
+
+func BenchmarkCacheGetCacheMetrics(b *testing.B) {
+	storage, _ := newBenchmarkCache(1024)
+	defer storage.cache.Stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = &CacheMetrics{Sessions: storage.cache.ItemCount(), Dropped: storage.cache.GetDropped()}
+		}
+	})
+}
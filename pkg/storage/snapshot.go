@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// snapshotMagic identifies an encrypted storage snapshot and its format version.
+var snapshotMagic = []byte("interactsh-snapshot-v1\n")
+
+const snapshotSaltSize = 16
+
+// Snapshot is a snapshot of the sessions of a storage along with their
+// pending interactions, used to migrate them to another server.
+type Snapshot struct {
+	// Created is the time at which the snapshot was taken.
+	Created time.Time `json:"created"`
+	// Sessions contains the registered sessions of the storage.
+	Sessions []*SessionSnapshot `json:"sessions"`
+}
+
+// SessionSnapshot is the snapshot of a correlation-id session.
+type SessionSnapshot struct {
+	CorrelationID string `json:"correlation-id"`
+	SecretKey     string `json:"secret-key"`
+	// AESKey is the AES encryption key in encrypted format.
+	AESKey string `json:"aes-key"`
+	// RawAESKey is the decrypted AES key used to encrypt new interactions.
+	RawAESKey []byte    `json:"raw-aes-key"`
+	Version   int       `json:"version"`
+	Expiry    time.Time `json:"expiry"`
+	TTL       int64     `json:"ttl"`
+	Sliding   bool      `json:"sliding,omitempty"`
+	// Created is the time at which the session was registered.
+	Created time.Time `json:"created,omitempty"`
+	// Owner is the name of the auth token which registered the session.
+	Owner string `json:"owner,omitempty"`
+	// Webhook is the URL the interactions of the session are posted to.
+	Webhook string `json:"webhook,omitempty"`
+	// Data contains the compressed pending interactions, as bytes since
+	// they are not valid UTF-8 strings.
+	Data [][]byte `json:"data,omitempty"`
+	// Sequences contains the sequence number of each pending interaction.
+	Sequences []uint64 `json:"sequences,omitempty"`
+	// Metadata contains the plaintext metadata of each pending interaction.
+	Metadata     []Metadata `json:"metadata,omitempty"`
+	LastSequence uint64     `json:"last-sequence"`
+	Seen         uint64     `json:"seen,omitempty"`
+	Dropped      uint64     `json:"dropped,omitempty"`
+}
+
+// Export returns a snapshot of the registered sessions of the storage.
+func (s *Storage) Export() (*Snapshot, error) {
+	snapshot := &Snapshot{Created: time.Now()}
+	for i := range s.sessions.shards {
+		shard := &s.sessions.shards[i]
+		shard.mutex.RLock()
+		for key, value := range shard.entries {
+			// unencrypted ids are set again by the server at startup
+			if value.id == "" {
+				continue
+			}
+			snapshot.Sessions = append(snapshot.Sessions, value.snapshot(key))
+		}
+		shard.mutex.RUnlock()
+	}
+	return snapshot, nil
+}
+
+// snapshot returns the snapshot of the correlation-id session.
+func (c *CorrelationData) snapshot(correlationID string) *SessionSnapshot {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	snapshot := &SessionSnapshot{
+		CorrelationID: correlationID,
+		SecretKey:     c.secretKey,
+		AESKey:        c.AESKey,
+		RawAESKey:     c.aesKey,
+		Version:       c.version,
+		Expiry:        c.expiry(),
+		TTL:           int64(c.ttl),
+		Sliding:       c.sliding,
+		Created:       c.created,
+		Owner:         c.owner,
+		Webhook:       c.webhook,
+		Data:          make([][]byte, len(c.Data)),
+		Sequences:     append([]uint64(nil), c.sequences...),
+		Metadata:      append([]Metadata(nil), c.metadata...),
+		LastSequence:  c.lastSequence,
+		Seen:          c.seen,
+		Dropped:       c.dropped,
+	}
+	for i, item := range c.Data {
+		snapshot.Data[i] = []byte(item)
+	}
+	return snapshot
+}
+
+// Import imports the sessions of a snapshot into the storage. Expired
+// sessions and sessions whose correlation-id is already registered are
+// skipped, so that importing a snapshot again does not overwrite them.
+func (s *Storage) Import(snapshot *Snapshot) error {
+	now := time.Now()
+	for _, session := range snapshot.Sessions {
+		if now.After(session.Expiry) {
+			continue
+		}
+		sessionCipher, err := newSessionCipher(session.Version, session.RawAESKey)
+		if err != nil {
+			return errors.Wrapf(err, "could not create session cipher for %s", session.CorrelationID)
+		}
+		if len(session.Sequences) != len(session.Data) {
+			return errors.Errorf("invalid sequences for %s", session.CorrelationID)
+		}
+		// snapshots taken before metadata was stored have none
+		if session.Metadata == nil {
+			session.Metadata = make([]Metadata, len(session.Data))
+		}
+		if len(session.Metadata) != len(session.Data) {
+			return errors.Errorf("invalid metadata for %s", session.CorrelationID)
+		}
+		data := &CorrelationData{
+			expires:      session.Expiry.UnixNano(),
+			Data:         make([]string, len(session.Data)),
+			dataMutex:    &sync.Mutex{},
+			sequences:    session.Sequences,
+			metadata:     session.Metadata,
+			lastSequence: session.LastSequence,
+			totalSize:    &s.size,
+			seen:         session.Seen,
+			dropped:      session.Dropped,
+			secretKey:    session.SecretKey,
+			AESKey:       session.AESKey,
+			aesKey:       session.RawAESKey,
+			cipher:       sessionCipher,
+			version:      session.Version,
+			ttl:          time.Duration(session.TTL),
+			sliding:      session.Sliding,
+			id:           session.CorrelationID,
+			created:      session.Created,
+			owner:        session.Owner,
+			webhook:      session.Webhook,
+		}
+		for i, item := range session.Data {
+			data.Data[i] = string(item)
+		}
+		if !s.add(session.CorrelationID, data) {
+			continue
+		}
+		for _, item := range session.Data {
+			data.account(int64(len(item)))
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes a snapshot encrypted with a key derived from the
+// operator supplied passphrase using scrypt and AES-256-GCM.
+func WriteSnapshot(w io.Writer, snapshot *Snapshot, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("no snapshot key provided")
+	}
+	plaintext := &bytes.Buffer{}
+	gz := gzip.NewWriter(plaintext)
+	if err := jsoniter.NewEncoder(gz).Encode(snapshot); err != nil {
+		return errors.Wrap(err, "could not encode snapshot")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "could not compress snapshot")
+	}
+
+	salt := make([]byte, snapshotSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return errors.Wrap(err, "could not generate snapshot salt")
+	}
+	gcm, err := newSnapshotCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "could not generate snapshot nonce")
+	}
+
+	header := make([]byte, 0, len(snapshotMagic)+len(salt)+len(nonce))
+	header = append(append(append(header, snapshotMagic...), salt...), nonce...)
+	// the header is authenticated along with the encrypted snapshot
+	ciphertext := gcm.Seal(nil, nonce, plaintext.Bytes(), header)
+
+	if _, err := w.Write(header); err != nil {
+		return errors.Wrap(err, "could not write snapshot")
+	}
+	if _, err := w.Write(ciphertext); err != nil {
+		return errors.Wrap(err, "could not write snapshot")
+	}
+	return nil
+}
+
+// ReadSnapshot reads a snapshot encrypted with WriteSnapshot.
+func ReadSnapshot(r io.Reader, passphrase string) (*Snapshot, error) {
+	if passphrase == "" {
+		return nil, errors.New("no snapshot key provided")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read snapshot")
+	}
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return nil, errors.New("invalid snapshot format")
+	}
+	salt := data[len(snapshotMagic):]
+	if len(salt) < snapshotSaltSize {
+		return nil, errors.New("invalid snapshot format")
+	}
+	salt = salt[:snapshotSaltSize]
+
+	gcm, err := newSnapshotCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(snapshotMagic) + snapshotSaltSize + gcm.NonceSize()
+	if len(data) < headerSize {
+		return nil, errors.New("invalid snapshot format")
+	}
+	header := data[:headerSize]
+	plaintext, err := gcm.Open(nil, header[headerSize-gcm.NonceSize():], data[headerSize:], header)
+	if err != nil {
+		return nil, errors.New("could not decrypt snapshot, invalid key")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decompress snapshot")
+	}
+	defer gz.Close()
+
+	snapshot := &Snapshot{}
+	if err := jsoniter.NewDecoder(gz).Decode(snapshot); err != nil {
+		return nil, errors.Wrap(err, "could not decode snapshot")
+	}
+	return snapshot, nil
+}
+
+// newSnapshotCipher derives the snapshot encryption key from a passphrase.
+func newSnapshotCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not derive snapshot key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
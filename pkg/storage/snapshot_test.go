@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestStorageSnapshot(t *testing.T) {
+	disk, err := NewDisk(filepath.Join(t.TempDir(), "interactsh.db"), &Options{EvictionTTL: 1 * time.Hour})
+	require.Nil(t, err, "could not create disk storage")
+	defer disk.Close()
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	migrations := map[string][2]Backend{
+		"memory-to-disk": {New(1 * time.Hour), disk},
+		"disk-to-memory": {disk, New(1 * time.Hour)},
+	}
+	for name, backends := range migrations {
+		t.Run(name, func(t *testing.T) {
+			source, destination := backends[0], backends[1]
+
+			correlationID := xid.New().String()
+			err := source.Register(&Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD, Sliding: true, Webhook: "https://example.com/hook"})
+			require.Nil(t, err, "could not register correlation-id in storage")
+			_ = source.SetID("token")
+
+			for _, data := range []string{"first", "second"} {
+				err = source.AddInteraction(correlationID, []byte(data))
+				require.Nil(t, err, "could not add interaction to storage")
+			}
+			// acknowledge the first interaction so that the sequences don't start at one
+			_, err = source.GetInteractionsAfter(correlationID, "secret", 1, nil)
+			require.Nil(t, err, "could not get interactions from storage")
+
+			snapshot, err := source.Export()
+			require.Nil(t, err, "could not export storage")
+
+			buffer := &bytes.Buffer{}
+			err = WriteSnapshot(buffer, snapshot, "operator-key")
+			require.Nil(t, err, "could not write snapshot")
+
+			_, err = ReadSnapshot(bytes.NewReader(buffer.Bytes()), "wrong-key")
+			require.NotNil(t, err, "could read snapshot with invalid key")
+
+			snapshot, err = ReadSnapshot(buffer, "operator-key")
+			require.Nil(t, err, "could not read snapshot")
+
+			err = destination.Import(snapshot)
+			require.Nil(t, err, "could not import snapshot")
+
+			err = destination.AddInteraction(correlationID, []byte("third"))
+			require.Nil(t, err, "could not add interaction to imported session")
+
+			// importing the snapshot again keeps the existing session
+			err = destination.Import(snapshot)
+			require.Nil(t, err, "could not import snapshot again")
+
+			interactions, err := destination.GetInteractionsAfter(correlationID, "secret", 1, nil)
+			require.Nil(t, err, "could not get interactions from imported session")
+			require.Equal(t, []uint64{2, 3}, interactions.Sequences, "could not keep sequences of imported session")
+
+			sealed, err := base64.StdEncoding.DecodeString(interactions.AESKey)
+			require.Nil(t, err, "could not decode key")
+			key, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+			require.True(t, ok, "could not open sealed key")
+
+			block, err := aes.NewCipher(key)
+			require.Nil(t, err, "could not create aes cipher")
+			gcm, err := cipher.NewGCM(block)
+			require.Nil(t, err, "could not create gcm cipher")
+
+			for i, expected := range []string{"second", "third"} {
+				ciphertext, err := base64.StdEncoding.DecodeString(interactions.Data[i])
+				require.Nil(t, err, "could not decode interaction")
+				plaintext, err := gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+				require.Nil(t, err, "could not decrypt interaction")
+				require.Equal(t, expected, string(plaintext), "could not get correct interaction")
+			}
+
+			session, err := destination.GetSession(correlationID, "secret")
+			require.Nil(t, err, "could not get imported session")
+			require.True(t, session.Sliding, "could not keep sliding expiry of imported session")
+
+			webhooks, err := destination.ListWebhooks()
+			require.Nil(t, err, "could not list webhooks")
+			require.Contains(t, webhooks, &Webhook{CorrelationID: correlationID, SecretKey: "secret", URL: "https://example.com/hook"}, "could not keep webhook of imported session")
+		})
+	}
+}
@@ -12,57 +12,576 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/karlseguin/ccache/v2"
 	"github.com/klauspost/compress/zlib"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/box"
 )
 
-// Storage is an storage for interactsh interaction data as well
+// Backend is a storage backend for interactsh interaction data as well
 // as correlation-id -> rsa-public-key data.
+type Backend interface {
+	// Register registers a correlation ID with its publicKey into the storage for further operations.
+	Register(registration *Registration) error
+	// SetID sets an unencrypted id bucket into the storage.
+	SetID(ID string) error
+	// AddInteraction adds an encrypted interaction data to the correlation ID.
+	AddInteraction(correlationID string, data []byte) error
+	// AddInteractionWithId adds an unencrypted interaction data to the id bucket.
+	AddInteractionWithId(id string, data []byte) error
+	// GetInteractions returns the interactions for a correlationID matching the
+	// filter, if any, along with the AES Encrypted Key for the ID and removes them
+	// from the storage.
+	GetInteractions(correlationID, secret string, filter *Filter) (*Interactions, error)
+	// GetInteractionsAfter acknowledges the interactions for a correlationID matching
+	// the filter, if any, up to and including the after cursor, removing them from the
+	// storage, and returns the remaining matching ones without removing them.
+	GetInteractionsAfter(correlationID, secret string, after uint64, filter *Filter) (*Interactions, error)
+	// GetInteractionsWithId returns the interactions for an id bucket matching the
+	// filter, if any, and removes them from the storage.
+	GetInteractionsWithId(id string, filter *Filter) (*Interactions, error)
+	// GetInteractionsWithIdAfter returns the interactions for an id bucket matching the
+	// filter, if any, after the after cursor without removing them, so that each reader
+	// of the id follows them with its own cursor.
+	GetInteractionsWithIdAfter(id string, after uint64, filter *Filter) (*Interactions, error)
+	// GetSession returns the lifetime of a correlation ID session.
+	GetSession(correlationID, secret string) (*Session, error)
+	// Subscribe returns a channel notified when interactions are added for any of the
+	// correlation IDs or id buckets along with a function to cancel the subscription.
+	Subscribe(ids ...string) (<-chan struct{}, func())
+	// RemoveID removes data for a correlation ID and data related to it.
+	RemoveID(correlationID, secret string) error
+	// GetCacheMetrics returns the session metrics of the storage.
+	GetCacheMetrics() *CacheMetrics
+	// ListSessions returns the details of the registered correlation ID sessions.
+	ListSessions() ([]*SessionInfo, error)
+	// GetSessionInfo returns the details of a correlation ID session.
+	GetSessionInfo(correlationID string) (*SessionInfo, error)
+	// ListWebhooks returns the webhooks registered by the correlation ID sessions.
+	ListWebhooks() ([]*Webhook, error)
+	// EvictSession evicts a correlation ID session without its secret key.
+	EvictSession(correlationID string) error
+	// PurgeSession removes the pending interactions of a correlation ID session
+	// without its secret key, keeping the session registered.
+	PurgeSession(correlationID string) error
+	// IncrementCounter increments the counter of a key for a correlation ID
+	// session and returns its new value, the counters being removed with the session.
+	IncrementCounter(correlationID, key string) (uint64, error)
+	// Export returns a snapshot of the registered sessions of the storage.
+	Export() (*Snapshot, error)
+	// Import imports the sessions of a snapshot into the storage.
+	Import(snapshot *Snapshot) error
+	// Close closes the storage releasing any held resources.
+	Close() error
+}
+
+// Crypto versions of the interaction envelope negotiated at registration.
+const (
+	// CryptoVersionLegacy is the unauthenticated AES-CFB envelope kept for older clients.
+	CryptoVersionLegacy = 1
+	// CryptoVersionAEAD is the authenticated AES-256-GCM envelope with a random key.
+	CryptoVersionAEAD = 2
+)
+
+// Key types of the client public key used to seal the session key.
+const (
+	// KeyTypeRSA is a base64 encoded PEM RSA public key, the session key is sealed with RSA-OAEP.
+	KeyTypeRSA = "rsa"
+	// KeyTypeX25519 is a base64 encoded raw X25519 public key, the session key
+	// is sealed with an ephemeral X25519 key exchange in a NaCl anonymous box.
+	KeyTypeX25519 = "x25519"
+)
+
+// Registration contains the parameters of a correlation-id registration.
+type Registration struct {
+	// CorrelationID is the correlation-id to register.
+	CorrelationID string
+	// SecretKey is the secret key for original user verification.
+	SecretKey string
+	// PublicKey is the base64 encoded public key of the client.
+	PublicKey string
+	// KeyType is the type of the public key, RSA if unset.
+	KeyType string
+	// Version is the crypto version of the interaction envelope, legacy if unset.
+	Version int
+	// TTL is the requested lifetime of the session, bounded by the eviction TTL
+	// of the storage which is also used if unset.
+	TTL time.Duration
+	// Sliding refreshes the expiry of the session by its TTL on each poll.
+	Sliding bool
+	// Owner is the name of the auth token which registered the session, if any.
+	Owner string
+	// Webhook is the URL the interactions of the session are posted to, if any.
+	Webhook string
+}
+
+// Webhook is the webhook registered by a correlation-id session, kept with
+// the session so that its deliveries are resumed when the storage is reopened
+// or imported.
+type Webhook struct {
+	CorrelationID string
+	// SecretKey is the secret key of the session signing the webhook requests.
+	SecretKey string
+	// URL is the URL the interactions of the session are posted to.
+	URL string
+}
+
+// Session contains the lifetime of a correlation-id session.
+type Session struct {
+	// Expiry is the time after which the session is evicted.
+	Expiry time.Time
+	// TTL is the lifetime of the session.
+	TTL time.Duration
+	// Sliding is true if the expiry is refreshed on each poll.
+	Sliding bool
+}
+
+// SessionInfo contains the details of a correlation-id session for its administration.
+type SessionInfo struct {
+	CorrelationID string
+	// Created is the time at which the session was registered.
+	Created time.Time
+	// Expiry is the time after which the session is evicted.
+	Expiry time.Time
+	// TTL is the lifetime of the session.
+	TTL time.Duration
+	// Sliding is true if the expiry is refreshed on each poll.
+	Sliding bool
+	// Pending is the number of pending interactions.
+	Pending int
+	// Size is the size in bytes of the pending interactions.
+	Size int64
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64
+	// Owner is the name of the auth token which registered the session, if any.
+	Owner string
+	// Webhook is the URL the interactions of the session are posted to, if any.
+	Webhook string
+}
+
+// sessionTTL returns the requested session lifetime bounded by the maximum one.
+func sessionTTL(requested, max time.Duration) time.Duration {
+	if requested <= 0 || requested > max {
+		return max
+	}
+	return requested
+}
+
+// Storage is an in-memory storage for interactsh interaction data as well
+// as correlation-id -> rsa-public-key data.
+//
+// Sessions are kept in a sharded map so that concurrent interactions for
+// different correlation-ids only contend on the lock of their shard and
+// their own session.
 type Storage struct {
-	cache       *ccache.Cache
+	// size is the total size in bytes of the pending interactions.
+	size int64
+	// dropped is the number of sessions evicted by the storage.
+	dropped     int64
+	sessions    *sessionMap
 	evictionTTL time.Duration
+	quota       Quota
+	evictions   *evictionLog
+	subscribers *notifier
+	quitChan    chan struct{}
+	// sharedRetention is the duration for which the interactions of id buckets are kept.
+	sharedRetention time.Duration
+	// ids contains the id buckets of the storage.
+	ids      map[string]struct{}
+	idsMutex sync.Mutex
+}
+
+// Options contains configuration options for the storage.
+type Options struct {
+	// EvictionTTL is the duration after which sessions are evicted.
+	EvictionTTL time.Duration
+	// SharedRetention is the duration for which the interactions of id buckets
+	// are kept for their readers, until dropped by the quota if unset.
+	SharedRetention time.Duration
+	// Quota contains the limits applied to the stored interactions.
+	Quota Quota
+	// OnEviction is called when a correlation-id session is evicted.
+	OnEviction EvictionCallback
+	// StateKey is the passphrase sealing the AES keys of the sessions
+	// persisted by the disk storage. Without one the keys are only kept in
+	// memory and the sessions are removed when the storage is reopened.
+	StateKey string
 }
 
 // CorrelationData is the data for a correlation-id.
 type CorrelationData struct {
+	// expires is the expiry of the session in unix nanoseconds.
+	expires int64
+	// accessed is the last access of the session in unix nanoseconds.
+	accessed int64
 	// data contains data for a correlation-id in AES encrypted json format.
 	Data []string `json:"data"`
 	// dataMutex is a mutex for the data slice.
 	dataMutex *sync.Mutex
+	// sequences contains the sequence number of each data item.
+	sequences []uint64
+	// metadata contains the plaintext metadata of each data item.
+	metadata []Metadata
+	// lastSequence is the sequence number of the last added data item.
+	lastSequence uint64
+	// size is the size in bytes of the data items.
+	size int64
+	// totalSize is the total size in bytes of the data items of the storage.
+	totalSize *int64
+	// seen is the number of data items received including dropped ones.
+	seen uint64
+	// dropped is the number of data items dropped because of the storage quota.
+	dropped uint64
 	// secretkey is a secret key for original user verification
 	secretKey string
 	// AESKey is the AES encryption key in encrypted format.
 	AESKey string `json:"aes-key"`
-	aesKey []byte // decrypted AES key for signing
+	aesKey []byte // decrypted AES key for encrypting interactions
+	// cipher encrypts the data items with the AES key.
+	cipher *sessionCipher
+	// version is the crypto version of the interaction envelope.
+	version int
+	// ttl is the lifetime of the session, zero for ids which never expire.
+	ttl time.Duration
+	// sliding refreshes the expiry of the session by its ttl on each poll.
+	sliding bool
+	// id is the correlation-id of the session.
+	id string
+	// created is the time at which the session was registered.
+	created time.Time
+	// owner is the name of the auth token which registered the session.
+	owner string
+	// webhook is the URL the interactions of the session are posted to.
+	webhook string
+	// counters contains the counters of the session by key.
+	counters map[string]uint64
+	// evicted is true once the session has been removed from the storage.
+	evicted bool
+}
+
+// Interactions is a set of interactions returned by a cursor based poll.
+type Interactions struct {
+	// Data contains the uncompressed interactions.
+	Data []string
+	// Sequences contains the monotonically increasing sequence number of each interaction.
+	Sequences []uint64
+	// Cursor is the sequence number of the last returned interaction, or the
+	// acknowledged cursor if no interaction was returned.
+	Cursor uint64
+	// AESKey is the AES encryption key in encrypted format.
+	AESKey string
+	// Version is the crypto version of the interaction envelope.
+	Version int
+	// Dropped is the number of interactions dropped because of the storage quota.
+	Dropped uint64
+	// HasMore is true if interactions matching the filter of the poll were
+	// not returned because of its limits.
+	HasMore bool
 }
 
 type CacheMetrics struct {
 	Sessions int `json:"active-session"`
 	Dropped  int `json:"evicted-session"`
+	// Size is the total size in bytes of the pending interactions.
+	Size int64 `json:"storage-size"`
+	// Evictions is the number of evicted sessions for each reason.
+	Evictions map[EvictionReason]int64 `json:"evictions,omitempty"`
 }
 
 func (s *Storage) GetCacheMetrics() *CacheMetrics {
+	// id buckets are not sessions of clients
+	sessions := s.sessions.len()
+	s.idsMutex.Lock()
+	for id := range s.ids {
+		if s.sessions.has(id) {
+			sessions--
+		}
+	}
+	s.idsMutex.Unlock()
+
 	return &CacheMetrics{
-		Sessions: s.cache.ItemCount(),
-		Dropped:  s.cache.GetDropped(),
+		Sessions:  sessions,
+		Dropped:   int(atomic.LoadInt64(&s.dropped)),
+		Size:      atomic.LoadInt64(&s.size),
+		Evictions: s.evictions.metrics(),
 	}
 }
 
 // GetInteractions returns the uncompressed interactions for a correlation-id
 func (c *CorrelationData) GetInteractions() []string {
+	data, _ := c.takeInteractions(nil)
+	return data
+}
+
+// takeInteractions removes the interactions matching the filter within its limits
+// and returns them uncompressed, along with whether matching ones were left.
+func (c *CorrelationData) takeInteractions(filter *Filter) ([]string, bool) {
 	c.dataMutex.Lock()
-	data := c.Data
-	c.Data = make([]string, 0)
+	var data []string
+	var hasMore bool
+	if !filter.active() {
+		data = c.Data
+		c.Data = make([]string, 0)
+		c.sequences = nil
+		c.metadata = nil
+		c.account(-c.size)
+	} else {
+		var size int64
+		kept := 0
+		for i, item := range c.Data {
+			if filter.match(&c.metadata[i]) {
+				if !hasMore && !filter.full(len(data), size+int64(len(item))) {
+					data = append(data, item)
+					size += int64(len(item))
+					c.account(-int64(len(item)))
+					continue
+				}
+				hasMore = true
+			}
+			c.keep(kept, i)
+			kept++
+		}
+		c.truncate(kept)
+	}
+	c.dataMutex.Unlock()
+
+	return decompressInteractions(data), hasMore
+}
+
+// keep moves the data item at index i to index kept.
+func (c *CorrelationData) keep(kept, i int) {
+	c.Data[kept] = c.Data[i]
+	c.sequences[kept] = c.sequences[i]
+	c.metadata[kept] = c.metadata[i]
+}
+
+// truncate truncates the data items to the first n ones.
+func (c *CorrelationData) truncate(n int) {
+	c.Data = c.Data[:n]
+	c.sequences = c.sequences[:n]
+	c.metadata = c.metadata[:n]
+}
+
+// clear removes all the data items of an evicted correlation-id.
+func (c *CorrelationData) clear() {
+	c.dataMutex.Lock()
+	c.evicted = true
+	c.Data = nil
+	c.sequences = nil
+	c.metadata = nil
+	c.account(-c.size)
+	c.dataMutex.Unlock()
+}
+
+// account adjusts the size accounting of the data items by delta bytes.
+func (c *CorrelationData) account(delta int64) {
+	c.size += delta
+	if c.totalSize != nil {
+		atomic.AddInt64(c.totalSize, delta)
+	}
+}
+
+// GetInteractionsAfter removes the interactions up to and including the after
+// sequence number and returns the uncompressed remaining ones along with
+// their sequence numbers.
+func (c *CorrelationData) GetInteractionsAfter(after uint64) ([]string, []uint64) {
+	data, sequences, _ := c.interactionsAfter(after, nil)
+	return data, sequences
+}
+
+// interactionsAfter removes the interactions matching the filter up to and
+// including the after sequence number and returns the uncompressed remaining
+// matching ones within the limits of the filter along with their sequence
+// numbers and whether matching ones were left.
+func (c *CorrelationData) interactionsAfter(after uint64, filter *Filter) ([]string, []uint64, bool) {
+	c.dataMutex.Lock()
+	if !filter.active() {
+		acknowledged := 0
+		for acknowledged < len(c.sequences) && c.sequences[acknowledged] <= after {
+			acknowledged++
+		}
+		for _, item := range c.Data[:acknowledged] {
+			c.account(-int64(len(item)))
+		}
+		c.Data = c.Data[acknowledged:]
+		c.sequences = c.sequences[acknowledged:]
+		c.metadata = c.metadata[acknowledged:]
+
+		data := make([]string, len(c.Data))
+		copy(data, c.Data)
+		sequences := make([]uint64, len(c.sequences))
+		copy(sequences, c.sequences)
+		c.dataMutex.Unlock()
+
+		return decompressInteractions(data), sequences, false
+	}
+
+	var data []string
+	var sequences []uint64
+	var size int64
+	var hasMore bool
+	start := filter.start(after)
+	kept := 0
+	for i, item := range c.Data {
+		if !filter.match(&c.metadata[i]) {
+			c.keep(kept, i)
+			kept++
+			continue
+		}
+		if c.sequences[i] <= after {
+			c.account(-int64(len(item)))
+			continue
+		}
+		if c.sequences[i] > start && !hasMore {
+			if filter.full(len(data), size+int64(len(item))) {
+				hasMore = true
+			} else {
+				data = append(data, item)
+				sequences = append(sequences, c.sequences[i])
+				size += int64(len(item))
+			}
+		}
+		c.keep(kept, i)
+		kept++
+	}
+	c.truncate(kept)
 	c.dataMutex.Unlock()
 
-	// Decompress the data and return a new slice
+	return decompressInteractions(data), sequences, hasMore
+}
+
+// readInteractions returns the uncompressed interactions matching the filter
+// after the after sequence number within the limits of the filter without
+// removing them, along with their sequence numbers and whether matching ones
+// were left.
+func (c *CorrelationData) readInteractions(after uint64, filter *Filter) ([]string, []uint64, bool) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	var data []string
+	var sequences []uint64
+	var size int64
+	var hasMore bool
+	start := filter.start(after)
+	i := sort.Search(len(c.sequences), func(i int) bool { return c.sequences[i] > start })
+	for ; i < len(c.Data); i++ {
+		if !filter.match(&c.metadata[i]) {
+			continue
+		}
+		item := c.Data[i]
+		if filter.full(len(data), size+int64(len(item))) {
+			hasMore = true
+			break
+		}
+		data = append(data, item)
+		sequences = append(sequences, c.sequences[i])
+		size += int64(len(item))
+	}
+	return decompressInteractions(data), sequences, hasMore
+}
+
+// removeBefore removes the data items received before the cutoff.
+func (c *CorrelationData) removeBefore(cutoff time.Time) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	expired := 0
+	for expired < len(c.metadata) && c.metadata[expired].Timestamp.Before(cutoff) {
+		c.account(-int64(len(c.Data[expired])))
+		expired++
+	}
+	c.Data = c.Data[expired:]
+	c.sequences = c.sequences[expired:]
+	c.metadata = c.metadata[expired:]
+}
+
+// appendData appends compressed data items along with their metadata assigning
+// them the next sequence numbers after enforcing the quota for the correlation-id.
+func (c *CorrelationData) appendData(quota *Quota, items []string, metadata []Metadata) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	// the session may have been evicted since it was looked up
+	if c.evicted {
+		return
+	}
+	for i, item := range items {
+		var totalSize int64
+		if c.totalSize != nil {
+			totalSize = atomic.LoadInt64(c.totalSize)
+		}
+		size := int64(len(item))
+		c.seen++
+		dropped, admitted, _ := quota.admit(&correlationQueue{c}, size, c.seen, totalSize)
+		c.dropped += uint64(dropped)
+		if !admitted {
+			continue
+		}
+
+		c.lastSequence++
+		c.Data = append(c.Data, item)
+		c.sequences = append(c.sequences, c.lastSequence)
+		c.metadata = append(c.metadata, metadata[i])
+		c.account(size)
+	}
+}
+
+// expired returns true if the session has expired at the provided unix nanoseconds.
+func (c *CorrelationData) expired(now int64) bool {
+	return c.ttl > 0 && now > atomic.LoadInt64(&c.expires)
+}
+
+// expiry returns the time after which the session is evicted.
+func (c *CorrelationData) expiry() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.expires))
+}
+
+// refresh extends the expiry of a sliding session by its ttl.
+func (c *CorrelationData) refresh() {
+	if c.sliding {
+		atomic.StoreInt64(&c.expires, time.Now().Add(c.ttl).UnixNano())
+	}
+}
+
+// correlationQueue is the pending queue of a correlation-id with its mutex held.
+type correlationQueue struct {
+	c *CorrelationData
+}
+
+func (q *correlationQueue) len() int {
+	return len(q.c.Data)
+}
+
+func (q *correlationQueue) size() int64 {
+	return q.c.size
+}
+
+// remove removes the i-th data item. The oldest item is removed by
+// reslicing so that dropping the oldest items of a full correlation-id
+// doesn't copy all of them, the next appends reallocating the slices.
+func (q *correlationQueue) remove(i int) error {
+	q.c.account(-int64(len(q.c.Data[i])))
+	if i == 0 {
+		q.c.Data[0] = ""
+		q.c.Data, q.c.sequences, q.c.metadata = q.c.Data[1:], q.c.sequences[1:], q.c.metadata[1:]
+		return nil
+	}
+	q.c.Data = append(q.c.Data[:i], q.c.Data[i+1:]...)
+	q.c.sequences = append(q.c.sequences[:i], q.c.sequences[i+1:]...)
+	q.c.metadata = append(q.c.metadata[:i], q.c.metadata[i+1:]...)
+	return nil
+}
+
+// decompressInteractions decompresses zlib compressed interactions returning a new slice
+func decompressInteractions(data []string) []string {
 	if len(data) == 0 {
 		return []string{}
 	}
@@ -95,154 +614,531 @@ func (c *CorrelationData) GetInteractions() []string {
 	return results
 }
 
-const defaultCacheMaxSize = 1000000
+const (
+	// defaultCacheMaxSize is the maximum number of sessions of the storage.
+	defaultCacheMaxSize = 1000000
+	// cleanupInterval is the interval at which expired sessions are removed.
+	cleanupInterval = 1 * time.Minute
+	// maxSessionCounters is the maximum number of counters of a session.
+	maxSessionCounters = 1024
+)
+
+// ErrTooManyCounters is returned when a new counter exceeds the counters of a session.
+var ErrTooManyCounters = errors.New("could not add counter to session")
 
 // New creates a new storage instance for interactsh data.
 func New(evictionTTL time.Duration) *Storage {
-	return &Storage{cache: ccache.New(ccache.Configure().MaxSize(defaultCacheMaxSize)), evictionTTL: evictionTTL}
+	return NewWithOptions(&Options{EvictionTTL: evictionTTL})
+}
+
+// NewWithOptions creates a new storage instance for interactsh data with options.
+func NewWithOptions(options *Options) *Storage {
+	s := &Storage{
+		evictionTTL: options.EvictionTTL,
+		quota:       options.Quota,
+		evictions:   newEvictionLog(options.OnEviction),
+		sessions:    newSessionMap(defaultCacheMaxSize),
+		subscribers: newNotifier(),
+		quitChan:    make(chan struct{}),
+		ids:         make(map[string]struct{}),
+
+		sharedRetention: options.SharedRetention,
+	}
+	go s.cleanupWorker()
+	return s
+}
+
+// cleanupWorker periodically removes expired sessions from the storage.
+func (s *Storage) cleanupWorker() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.removeExpired()
+		case <-s.quitChan:
+			return
+		}
+	}
 }
 
-// SetIDPublicKey sets the correlation ID and publicKey into the cache for further operations.
+// removeExpired removes all the sessions whose expiry has passed along with
+// the interactions of id buckets older than the shared retention.
+func (s *Storage) removeExpired() {
+	now := time.Now().UnixNano()
+	expired := s.sessions.deleteFunc(func(key string, value *CorrelationData) bool {
+		return value.expired(now)
+	})
+	for _, value := range expired {
+		s.evicted(value, EvictionTTL)
+	}
+
+	if s.sharedRetention <= 0 {
+		return
+	}
+	cutoff := time.Unix(0, now).Add(-s.sharedRetention)
+	s.idsMutex.Lock()
+	ids := make([]string, 0, len(s.ids))
+	for id := range s.ids {
+		ids = append(ids, id)
+	}
+	s.idsMutex.Unlock()
+	for _, id := range ids {
+		if value := s.sessions.get(id); value != nil {
+			value.removeBefore(cutoff)
+		}
+	}
+}
+
+// evict removes a session from the storage recording the reason of its eviction.
+func (s *Storage) evict(correlationID string, value *CorrelationData, reason EvictionReason) {
+	if s.sessions.delete(correlationID, value) {
+		s.evicted(value, reason)
+	}
+}
+
+// evicted clears a session removed from the storage and records its eviction.
+func (s *Storage) evicted(value *CorrelationData, reason EvictionReason) {
+	value.clear()
+	if reason != EvictionDeregister {
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	s.evictions.record(value.id, reason)
+}
+
+// set sets the session of an id into the storage.
+func (s *Storage) set(ID string, value *CorrelationData) {
+	replaced, evicted := s.sessions.set(ID, value)
+	if replaced != nil {
+		replaced.clear()
+	}
+	if evicted != nil {
+		s.evicted(evicted, EvictionCapacity)
+	}
+}
+
+// add sets the session of an id into the storage unless the id already
+// has a session which has not expired, returning false in that case.
+func (s *Storage) add(ID string, value *CorrelationData) bool {
+	added, expired, evicted := s.sessions.add(ID, value)
+	if expired != nil {
+		s.evicted(expired, EvictionTTL)
+	}
+	if evicted != nil {
+		s.evicted(evicted, EvictionCapacity)
+	}
+	return added
+}
+
+// SetIDPublicKey sets the correlation ID and publicKey into the storage for
+// further operations using the legacy crypto version.
 func (s *Storage) SetIDPublicKey(correlationID, secretKey string, publicKey string) error {
-	// If we already have this correlation ID, return.
-	if s.cache.Get(correlationID) != nil {
-		return errors.New("correlation-id provided is invalid")
+	return s.Register(&Registration{CorrelationID: correlationID, SecretKey: secretKey, PublicKey: publicKey})
+}
+
+// Register registers a correlation ID with its publicKey into the storage for further operations.
+func (s *Storage) Register(registration *Registration) error {
+	version, err := cryptoVersion(registration.Version)
+	if err != nil {
+		return err
 	}
-	publicKeyData, err := parseB64RSAPublicKeyFromPEM(publicKey)
+	aesKey, encryptedAESKey, err := newSessionKey(registration.KeyType, registration.PublicKey, version)
 	if err != nil {
-		return errors.Wrap(err, "could not read public Key")
+		return err
 	}
-	aesKey := uuid.New().String()[:32]
-
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKeyData, []byte(aesKey), []byte(""))
+	sessionCipher, err := newSessionCipher(version, aesKey)
 	if err != nil {
-		return errors.New("could not encrypt event data")
+		return errors.Wrap(err, "could not create session cipher")
 	}
 
 	data := &CorrelationData{
 		Data:      make([]string, 0),
-		secretKey: secretKey,
+		secretKey: registration.SecretKey,
 		dataMutex: &sync.Mutex{},
-		aesKey:    []byte(aesKey),
-		AESKey:    base64.StdEncoding.EncodeToString(ciphertext),
+		aesKey:    aesKey,
+		cipher:    sessionCipher,
+		AESKey:    encryptedAESKey,
+		version:   version,
+		totalSize: &s.size,
+		ttl:       sessionTTL(registration.TTL, s.evictionTTL),
+		sliding:   registration.Sliding,
+		id:        registration.CorrelationID,
+		created:   time.Now(),
+		owner:     registration.Owner,
+		webhook:   registration.Webhook,
+	}
+	data.expires = time.Now().Add(data.ttl).UnixNano()
+	// If we already have this correlation ID, return.
+	if !s.add(registration.CorrelationID, data) {
+		return errors.New("correlation-id provided is invalid")
 	}
-	s.cache.Set(correlationID, data, s.evictionTTL)
 	return nil
 }
 
+// SetID sets an unencrypted id bucket into the storage which never expires.
 func (s *Storage) SetID(ID string) error {
 	data := &CorrelationData{
 		Data:      make([]string, 0),
 		dataMutex: &sync.Mutex{},
+		totalSize: &s.size,
 	}
-	s.cache.Set(ID, data, s.evictionTTL)
+	s.set(ID, data)
+	s.idsMutex.Lock()
+	s.ids[ID] = struct{}{}
+	s.idsMutex.Unlock()
 	return nil
 }
 
 // AddInteraction adds an interaction data to the correlation ID after encrypting
 // it with Public Key for the provided correlation ID.
 func (s *Storage) AddInteraction(correlationID string, data []byte) error {
-	item := s.cache.Get(correlationID)
-	if item == nil {
-		return errors.New("could not get correlation-id from cache")
-	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return errors.New("invalid correlation-id cache value found")
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return err
 	}
 
-	ct, err := aesEncrypt(value.aesKey, data)
+	ct, err := value.cipher.encrypt(data)
 	if err != nil {
 		return errors.Wrap(err, "could not encrypt event data")
 	}
-	value.dataMutex.Lock()
-	value.Data = append(value.Data, ct)
-	value.dataMutex.Unlock()
+	value.appendData(&s.quota, []string{ct}, []Metadata{parseMetadata(data)})
+	s.subscribers.notify(correlationID)
 	return nil
 }
 
 // AddInteractionWithId adds an interaction data to the id bucket
 func (s *Storage) AddInteractionWithId(id string, data []byte) error {
-	item := s.cache.Get(id)
-	if item == nil {
+	value := s.sessions.get(id)
+	if value == nil {
 		return errors.New("could not get correlation-id from cache")
 	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return errors.New("invalid correlation-id cache value found")
-	}
-
-	// Gzip compress to save memory for storage
-	buffer := &bytes.Buffer{}
-
-	gz := zippers.Get().(*zlib.Writer)
-	defer zippers.Put(gz)
-	gz.Reset(buffer)
 
-	if _, err := gz.Write(data); err != nil {
-		_ = gz.Close()
+	compressed, err := compress(data)
+	if err != nil {
 		return err
 	}
-	_ = gz.Close()
 
-	value.dataMutex.Lock()
-	value.Data = append(value.Data, buffer.String())
-	value.dataMutex.Unlock()
+	value.appendData(&s.quota, []string{compressed}, []Metadata{sharedMetadata(data)})
+	s.subscribers.notify(id)
 	return nil
 }
 
-// GetInteractions returns the interactions for a correlationID and removes
-// it from the storage. It also returns AES Encrypted Key for the IDs.
-func (s *Storage) GetInteractions(correlationID, secret string) ([]string, string, error) {
-	item := s.cache.Get(correlationID)
-	if item == nil {
-		return nil, "", errors.New("could not get correlation-id from cache")
+// GetInteractions returns the interactions for a correlationID matching the filter
+// and removes them from the storage. It also returns AES Encrypted Key for the IDs.
+func (s *Storage) GetInteractions(correlationID, secret string, filter *Filter) (*Interactions, error) {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return nil, err
 	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return nil, "", errors.New("invalid correlation-id cache value found")
+	if !strings.EqualFold(value.secretKey, secret) {
+		return nil, errors.New("invalid secret key passed for user")
+	}
+	value.refresh()
+	data, hasMore := value.takeInteractions(filter)
+	return &Interactions{Data: data, AESKey: value.AESKey, Version: value.version, Dropped: value.droppedCount(), HasMore: hasMore}, nil
+}
+
+// GetInteractionsAfter acknowledges the interactions for a correlationID matching the
+// filter up to and including the after cursor and returns the remaining matching ones
+// without removing them.
+func (s *Storage) GetInteractionsAfter(correlationID, secret string, after uint64, filter *Filter) (*Interactions, error) {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return nil, err
 	}
 	if !strings.EqualFold(value.secretKey, secret) {
-		return nil, "", errors.New("invalid secret key passed for user")
+		return nil, errors.New("invalid secret key passed for user")
+	}
+	value.refresh()
+	data, sequences, hasMore := value.interactionsAfter(after, filter)
+	interactions := newInteractions(data, sequences, filter.start(after), value.AESKey, value.version)
+	interactions.Dropped = value.droppedCount()
+	interactions.HasMore = hasMore
+	return interactions, nil
+}
+
+// droppedCount returns the number of data items dropped because of the storage quota.
+func (c *CorrelationData) droppedCount() uint64 {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+	return c.dropped
+}
+
+// newInteractions returns the result of a cursor based poll.
+func newInteractions(data []string, sequences []uint64, after uint64, aesKey string, version int) *Interactions {
+	cursor := after
+	if len(sequences) > 0 {
+		cursor = sequences[len(sequences)-1]
 	}
-	data := value.GetInteractions()
-	return data, value.AESKey, nil
+	return &Interactions{Data: data, Sequences: sequences, Cursor: cursor, AESKey: aesKey, Version: version}
 }
 
-// GetInteractions returns the interactions for a id and empty the cache
-func (s *Storage) GetInteractionsWithId(id string) ([]string, error) {
-	item := s.cache.Get(id)
-	if item == nil {
+// GetInteractions returns the interactions for a id matching the filter and removes them from the cache
+func (s *Storage) GetInteractionsWithId(id string, filter *Filter) (*Interactions, error) {
+	value := s.sessions.get(id)
+	if value == nil {
 		return nil, errors.New("could not get id from cache")
 	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return nil, errors.New("invalid id cache value found")
+	data, hasMore := value.takeInteractions(filter)
+	return &Interactions{Data: data, HasMore: hasMore}, nil
+}
+
+// GetInteractionsWithIdAfter returns the interactions for an id matching the filter
+// after the after cursor without removing them from the cache.
+func (s *Storage) GetInteractionsWithIdAfter(id string, after uint64, filter *Filter) (*Interactions, error) {
+	value := s.sessions.get(id)
+	if value == nil {
+		return nil, errors.New("could not get id from cache")
 	}
-	data := value.GetInteractions()
-	return data, nil
+	data, sequences, hasMore := value.readInteractions(after, filter)
+	interactions := newInteractions(data, sequences, filter.start(after), "", 0)
+	interactions.HasMore = hasMore
+	return interactions, nil
 }
 
 // RemoveID removes data for a correlation ID and data related to it.
 func (s *Storage) RemoveID(correlationID, secret string) error {
-	item := s.cache.Get(correlationID)
-	if item == nil {
-		return errors.New("could not get correlation-id from cache")
-	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return errors.New("invalid correlation-id cache value found")
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return err
 	}
 	if !strings.EqualFold(value.secretKey, secret) {
 		return errors.New("invalid secret key passed for deregister")
 	}
+	s.evict(correlationID, value, EvictionDeregister)
+	return nil
+}
+
+// GetSession returns the lifetime of a correlation ID session.
+func (s *Storage) GetSession(correlationID, secret string) (*Session, error) {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(value.secretKey, secret) {
+		return nil, errors.New("invalid secret key passed for user")
+	}
+	return &Session{Expiry: value.expiry(), TTL: value.ttl, Sliding: value.sliding}, nil
+}
+
+// ListSessions returns the details of the registered correlation ID sessions
+// sorted by registration time.
+func (s *Storage) ListSessions() ([]*SessionInfo, error) {
+	now := time.Now().UnixNano()
+	var sessions []*SessionInfo
+	for i := range s.sessions.shards {
+		shard := &s.sessions.shards[i]
+		shard.mutex.RLock()
+		for key, value := range shard.entries {
+			// unencrypted ids are not sessions of clients
+			if value.id == "" || value.expired(now) {
+				continue
+			}
+			sessions = append(sessions, value.info(key))
+		}
+		shard.mutex.RUnlock()
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// GetSessionInfo returns the details of a correlation ID session.
+func (s *Storage) GetSessionInfo(correlationID string) (*SessionInfo, error) {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return nil, err
+	}
+	if value.id == "" {
+		return nil, ErrSessionNotFound
+	}
+	return value.info(correlationID), nil
+}
+
+// ListWebhooks returns the webhooks registered by the correlation ID sessions.
+func (s *Storage) ListWebhooks() ([]*Webhook, error) {
+	now := time.Now().UnixNano()
+	var webhooks []*Webhook
+	for i := range s.sessions.shards {
+		shard := &s.sessions.shards[i]
+		shard.mutex.RLock()
+		for key, value := range shard.entries {
+			if value.webhook == "" || value.expired(now) {
+				continue
+			}
+			webhooks = append(webhooks, &Webhook{CorrelationID: key, SecretKey: value.secretKey, URL: value.webhook})
+		}
+		shard.mutex.RUnlock()
+	}
+	return webhooks, nil
+}
+
+// EvictSession evicts a correlation ID session without its secret key.
+func (s *Storage) EvictSession(correlationID string) error {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return err
+	}
+	if value.id == "" {
+		return ErrSessionNotFound
+	}
+	s.evict(correlationID, value, EvictionAdmin)
+	return nil
+}
+
+// PurgeSession removes the pending interactions of a correlation ID session
+// without its secret key, keeping the session registered.
+func (s *Storage) PurgeSession(correlationID string) error {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return err
+	}
+	if value.id == "" {
+		return ErrSessionNotFound
+	}
+	value.purge()
+	return nil
+}
+
+// IncrementCounter increments the counter of a key for a correlation ID
+// session and returns its new value, the counters being removed with the session.
+func (s *Storage) IncrementCounter(correlationID, key string) (uint64, error) {
+	value, err := s.getCorrelationData(correlationID)
+	if err != nil {
+		return 0, err
+	}
+	if value.id == "" {
+		return 0, ErrSessionNotFound
+	}
 	value.dataMutex.Lock()
-	value.Data = nil
-	value.dataMutex.Unlock()
-	s.cache.Delete(correlationID)
+	defer value.dataMutex.Unlock()
+
+	if value.counters == nil {
+		value.counters = make(map[string]uint64)
+	}
+	if _, ok := value.counters[key]; !ok && len(value.counters) >= maxSessionCounters {
+		return 0, ErrTooManyCounters
+	}
+	value.counters[key]++
+	return value.counters[key], nil
+}
+
+// info returns the details of the correlation-id session.
+func (c *CorrelationData) info(correlationID string) *SessionInfo {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	return &SessionInfo{
+		CorrelationID: correlationID,
+		Created:       c.created,
+		Expiry:        c.expiry(),
+		TTL:           c.ttl,
+		Sliding:       c.sliding,
+		Pending:       len(c.Data),
+		Size:          c.size,
+		Dropped:       c.dropped,
+		Owner:         c.owner,
+		Webhook:       c.webhook,
+	}
+}
+
+// purge removes all the data items of the correlation-id, keeping their
+// sequence numbers so that the cursors of its clients remain valid.
+func (c *CorrelationData) purge() {
+	c.dataMutex.Lock()
+	c.Data = make([]string, 0)
+	c.sequences = nil
+	c.metadata = nil
+	c.account(-c.size)
+	c.dataMutex.Unlock()
+}
+
+// sortSessions sorts the details of sessions by registration time.
+func sortSessions(sessions []*SessionInfo) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Created.Equal(sessions[j].Created) {
+			return sessions[i].CorrelationID < sessions[j].CorrelationID
+		}
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+}
+
+// Subscribe returns a channel notified when interactions are added for any of
+// the ids along with a function to cancel the subscription.
+func (s *Storage) Subscribe(ids ...string) (<-chan struct{}, func()) {
+	return s.subscribers.subscribe(ids...)
+}
+
+// getCorrelationData returns the data of a non-expired correlation-id.
+func (s *Storage) getCorrelationData(correlationID string) (*CorrelationData, error) {
+	value := s.sessions.get(correlationID)
+	if value == nil {
+		return nil, s.evictions.notFound(correlationID)
+	}
+	if value.expired(time.Now().UnixNano()) {
+		s.evict(correlationID, value, EvictionTTL)
+		return nil, &SessionEvictedError{Reason: EvictionTTL}
+	}
+	return value, nil
+}
+
+// Close stops the background workers of the storage.
+func (s *Storage) Close() error {
+	close(s.quitChan)
 	return nil
 }
 
+// cryptoVersion validates a requested crypto version defaulting to the legacy one.
+func cryptoVersion(version int) (int, error) {
+	switch version {
+	case 0:
+		return CryptoVersionLegacy, nil
+	case CryptoVersionLegacy, CryptoVersionAEAD:
+		return version, nil
+	default:
+		return 0, fmt.Errorf("unsupported crypto version %d", version)
+	}
+}
+
+// newSessionKey generates a new AES key for a session and returns it
+// along with its base64 encoded form sealed with the client public key.
+func newSessionKey(keyType, publicKey string, version int) ([]byte, string, error) {
+	var aesKey []byte
+	if version == CryptoVersionLegacy {
+		aesKey = []byte(uuid.New().String()[:32])
+	} else {
+		aesKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+			return nil, "", errors.Wrap(err, "could not generate aes key")
+		}
+	}
+
+	var ciphertext []byte
+	switch keyType {
+	case "", KeyTypeRSA:
+		publicKeyData, err := parseB64RSAPublicKeyFromPEM(publicKey)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "could not read public Key")
+		}
+		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKeyData, aesKey, []byte(""))
+		if err != nil {
+			return nil, "", errors.New("could not encrypt event data")
+		}
+	case KeyTypeX25519:
+		publicKeyData, err := parseB64X25519PublicKey(publicKey)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "could not read public Key")
+		}
+		ciphertext, err = box.SealAnonymous(nil, aesKey, publicKeyData, rand.Reader)
+		if err != nil {
+			return nil, "", errors.New("could not encrypt event data")
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %s", keyType)
+	}
+	return aesKey, base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
 // parseB64RSAPublicKeyFromPEM parses a base64 encoded rsa pem to a public key structure
 func parseB64RSAPublicKeyFromPEM(pubPEM string) (*rsa.PublicKey, error) {
 	decoded, err := base64.StdEncoding.DecodeString(pubPEM)
@@ -269,21 +1165,86 @@ func parseB64RSAPublicKeyFromPEM(pubPEM string) (*rsa.PublicKey, error) {
 	return nil, errors.New("Key type is not RSA")
 }
 
+// parseB64X25519PublicKey parses a base64 encoded raw x25519 public key
+func parseB64X25519PublicKey(publicKey string) (*[32]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 32 {
+		return nil, errors.New("invalid x25519 key size")
+	}
+	key := new([32]byte)
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// zippers is a pool of zlib writers compressing the plaintext interactions
+// of the id buckets with the fastest level.
 var zippers = sync.Pool{New: func() interface{} {
-	return zlib.NewWriter(nil)
+	w, _ := zlib.NewWriterLevel(nil, zlib.BestSpeed)
+	return w
 }}
 
-// aesEncrypt encrypts a message using AES and puts IV at the beginning of ciphertext.
-func aesEncrypt(key []byte, message []byte) (string, error) {
+// storers is a pool of zlib writers storing encrypted interactions without
+// compressing them, since their base64 encoded ciphertext doesn't get any
+// smaller with the fastest level, so that clients still decompress them.
+var storers = sync.Pool{New: func() interface{} {
+	w, _ := zlib.NewWriterLevel(nil, zlib.NoCompression)
+	return w
+}}
+
+// sessionCipher encrypts messages with the envelope of a crypto version
+// using the ciphers set up once for the key of a session.
+type sessionCipher struct {
+	block cipher.Block
+	gcm   cipher.AEAD
+}
+
+// newSessionCipher creates a new cipher for a session key and crypto version.
+func newSessionCipher(version int, key []byte) (*sessionCipher, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
+		return nil, err
+	}
+	c := &sessionCipher{block: block}
+	if version == CryptoVersionAEAD {
+		if c.gcm, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// encrypt encrypts a message with the envelope of the session.
+func (c *sessionCipher) encrypt(message []byte) (string, error) {
+	if c.gcm != nil {
+		return aesGCMEncrypt(c.gcm, message)
+	}
+	return aesEncrypt(c.block, message)
+}
+
+// aesGCMEncrypt encrypts and authenticates a message using AES-GCM and
+// puts the nonce at the beginning of ciphertext.
+func aesGCMEncrypt(gcm cipher.AEAD, message []byte) (string, error) {
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(message)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
+	cipherText := gcm.Seal(nonce, nonce, message, nil)
+
+	encMessage := make([]byte, base64.StdEncoding.EncodedLen(len(cipherText)))
+	base64.StdEncoding.Encode(encMessage, cipherText)
+
+	return deflate(&storers, encMessage)
+}
 
+// aesEncrypt encrypts a message using AES and puts IV at the beginning of ciphertext.
+func aesEncrypt(block cipher.Block, message []byte) (string, error) {
 	// It's common to put IV at the beginning of the ciphertext.
 	cipherText := make([]byte, aes.BlockSize+len(message))
 	iv := cipherText[:aes.BlockSize]
-	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return "", err
 	}
 
@@ -293,14 +1254,23 @@ func aesEncrypt(key []byte, message []byte) (string, error) {
 	encMessage := make([]byte, base64.StdEncoding.EncodedLen(len(cipherText)))
 	base64.StdEncoding.Encode(encMessage, cipherText)
 
-	// Gzip compress to save memory for storage
+	return deflate(&storers, encMessage)
+}
+
+// compress zlib compresses data to save memory for storage
+func compress(data []byte) (string, error) {
+	return deflate(&zippers, data)
+}
+
+// deflate zlib encodes data with a writer of a pool.
+func deflate(pool *sync.Pool, data []byte) (string, error) {
 	buffer := &bytes.Buffer{}
 
-	gz := zippers.Get().(*zlib.Writer)
-	defer zippers.Put(gz)
+	gz := pool.Get().(*zlib.Writer)
+	defer pool.Put(gz)
 	gz.Reset(buffer)
 
-	if _, err := gz.Write(encMessage); err != nil {
+	if _, err := gz.Write(data); err != nil {
 		_ = gz.Close()
 		return "", err
 	}
@@ -308,16 +1278,3 @@ func aesEncrypt(key []byte, message []byte) (string, error) {
 
 	return buffer.String(), nil
 }
-
-// GetCacheItem returns an item as is
-func (s *Storage) GetCacheItem(token string) (*CorrelationData, error) {
-	item := s.cache.Get(token)
-	if item == nil {
-		return nil, errors.New("could not get token from cache")
-	}
-	value, ok := item.Value().(*CorrelationData)
-	if !ok {
-		return nil, errors.New("invalid token cache value found")
-	}
-	return value, nil
-}
@@ -9,6 +9,8 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -18,8 +20,25 @@ import (
 	"github.com/klauspost/compress/zlib"
 	"github.com/rs/xid"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
 )
 
+// forEachBackend runs a test against the memory and disk storages created
+// with the options, closing them once the test is done.
+func forEachBackend(t *testing.T, options *Options, test func(t *testing.T, storage Backend)) {
+	t.Run("memory", func(t *testing.T) {
+		storage := NewWithOptions(options)
+		t.Cleanup(func() { _ = storage.Close() })
+		test(t, storage)
+	})
+	t.Run("disk", func(t *testing.T) {
+		storage, err := NewDisk(filepath.Join(t.TempDir(), "interactsh.db"), options)
+		require.Nil(t, err, "could not create disk storage")
+		t.Cleanup(func() { _ = storage.Close() })
+		test(t, storage)
+	})
+}
+
 func TestStorageSetIDPublicKey(t *testing.T) {
 	storage := New(1 * time.Hour)
 
@@ -45,11 +64,8 @@ func TestStorageSetIDPublicKey(t *testing.T) {
 	err = storage.SetIDPublicKey(correlationID, secret, encoded)
 	require.Nil(t, err, "could not set correlation-id and rsa public key in storage")
 
-	item := storage.cache.Get(correlationID)
-	require.NotNil(t, item, "could not get correlation-id item from storage")
-
-	value, ok := item.Value().(*CorrelationData)
-	require.True(t, ok, "could not assert item value type as correlation data")
+	value, err := storage.getCorrelationData(correlationID)
+	require.Nil(t, err, "could not get correlation-id item from storage")
 
 	require.Equal(t, secret, value.secretKey, "could not get correct secret key")
 }
@@ -83,8 +99,9 @@ func TestStorageAddGetInteractions(t *testing.T) {
 	err = storage.AddInteraction(correlationID, dataOriginal)
 	require.Nil(t, err, "could not add interaction to storage")
 
-	data, key, err := storage.GetInteractions(correlationID, secret)
+	interactions, err := storage.GetInteractions(correlationID, secret, nil)
 	require.Nil(t, err, "could not get interaction from storage")
+	data, key := interactions.Data, interactions.AESKey
 
 	decodedKey, err := base64.StdEncoding.DecodeString(key)
 	require.Nil(t, err, "could not decode key")
@@ -130,3 +147,512 @@ func TestGetInteractions(t *testing.T) {
 	decompressed := data.GetInteractions()
 	require.ElementsMatch(t, []string{"test", "another"}, decompressed, "could not get correct decompressed list")
 }
+
+func TestGetInteractionsAfter(t *testing.T) {
+	forEachBackend(t, &Options{EvictionTTL: 1 * time.Hour}, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		for _, data := range []string{"first", "second", "third"} {
+			err = storage.AddInteractionWithId("id", []byte(data))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+
+		interactions, err := storage.GetInteractionsAfter("id", "", 0, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{"first", "second", "third"}, interactions.Data, "could not get correct interactions")
+		require.Equal(t, []uint64{1, 2, 3}, interactions.Sequences, "could not get correct sequences")
+		require.Equal(t, uint64(3), interactions.Cursor, "could not get correct cursor")
+
+		// Unacknowledged interactions are returned again
+		interactions, err = storage.GetInteractionsAfter("id", "", 1, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{"second", "third"}, interactions.Data, "could not get unacknowledged interactions")
+
+		interactions, err = storage.GetInteractionsAfter("id", "", 3, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Empty(t, interactions.Data, "could get acknowledged interactions")
+		require.Equal(t, uint64(3), interactions.Cursor, "could not keep acknowledged cursor")
+
+		err = storage.AddInteractionWithId("id", []byte("fourth"))
+		require.Nil(t, err, "could not add interaction to storage")
+
+		interactions, err = storage.GetInteractionsAfter("id", "", 3, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []uint64{4}, interactions.Sequences, "could not get monotonically increasing sequence")
+	})
+}
+
+func TestStorageFilter(t *testing.T) {
+	dns := `{"protocol":"dns","full-id":"abc.id","timestamp":"2021-09-15T12:00:00Z"}`
+	http := `{"protocol":"http","full-id":"xyz.id","timestamp":"2021-09-15T13:00:00Z"}`
+	smtp := `{"protocol":"smtp","full-id":"abc.id","timestamp":"2021-09-15T14:00:00Z"}`
+
+	forEachBackend(t, &Options{EvictionTTL: 1 * time.Hour}, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		for _, data := range []string{dns, http, smtp} {
+			err = storage.AddInteractionWithId("id", []byte(data))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+
+		interactions, err := storage.GetInteractionsAfter("id", "", 0, &Filter{Protocols: []string{"DNS", "smtp"}})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{dns, smtp}, interactions.Data, "could not filter interactions by protocol")
+
+		interactions, err = storage.GetInteractionsAfter("id", "", 0, &Filter{FullIDPrefix: "ABC", Limit: 1})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []uint64{1}, interactions.Sequences, "could not limit interactions filtered by full-id")
+
+		// Acknowledging filtered interactions keeps the other ones
+		since := time.Date(2021, 9, 15, 13, 0, 0, 0, time.UTC)
+		interactions, err = storage.GetInteractionsAfter("id", "", 3, &Filter{Since: since})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Empty(t, interactions.Data, "could get acknowledged interactions")
+
+		interactions, err = storage.GetInteractionsAfter("id", "", 0, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{dns}, interactions.Data, "could not keep interactions not matching the filter")
+
+		err = storage.AddInteractionWithId("id", []byte(http))
+		require.Nil(t, err, "could not add interaction to storage")
+
+		drained, err := storage.GetInteractionsWithId("id", &Filter{Protocols: []string{"http"}})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{http}, drained.Data, "could not drain interactions matching the filter")
+
+		drained, err = storage.GetInteractionsWithId("id", nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{dns}, drained.Data, "could not keep interactions not matching the filter")
+	})
+}
+
+func TestStoragePagination(t *testing.T) {
+	forEachBackend(t, &Options{EvictionTTL: 1 * time.Hour}, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		for _, data := range []string{"first", "second", "third", "fourth", "fifth"} {
+			err = storage.AddInteractionWithId("id", []byte(data))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+
+		interactions, err := storage.GetInteractionsAfter("id", "", 0, &Filter{Limit: 2})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{"first", "second"}, interactions.Data, "could not limit interactions")
+		require.True(t, interactions.HasMore, "could not report more interactions")
+
+		// The continuation returns the next page without acknowledging the first one
+		interactions, err = storage.GetInteractionsAfter("id", "", 0, &Filter{Limit: 2, Continuation: interactions.Cursor})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []uint64{3, 4}, interactions.Sequences, "could not get next page")
+
+		// The first interaction is returned regardless of the maximum size
+		interactions, err = storage.GetInteractionsAfter("id", "", interactions.Cursor, &Filter{MaxSize: 1})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{"fifth"}, interactions.Data, "could not get last page")
+		require.False(t, interactions.HasMore, "could report more interactions on last page")
+
+		drained, err := storage.GetInteractionsWithId("id", &Filter{Limit: 1})
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []string{"fifth"}, drained.Data, "could not acknowledge previous pages")
+		require.False(t, drained.HasMore, "could report more interactions once drained")
+	})
+}
+
+func TestStorageSharedInteractions(t *testing.T) {
+	options := &Options{EvictionTTL: 1 * time.Hour, SharedRetention: 1 * time.Hour}
+	forEachBackend(t, options, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano)
+		for _, data := range []string{`{"protocol":"smb","timestamp":"` + old + `"}`, `{"protocol":"smb"}`, `{"protocol":"responder"}`} {
+			err = storage.AddInteractionWithId("id", []byte(data))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+
+		// Each reader follows the interactions with its own cursor
+		for i := 0; i < 2; i++ {
+			interactions, err := storage.GetInteractionsWithIdAfter("id", 0, nil)
+			require.Nil(t, err, "could not get shared interactions from storage")
+			require.Equal(t, []uint64{1, 2, 3}, interactions.Sequences, "could not get shared interactions for reader %d", i)
+		}
+		interactions, err := storage.GetInteractionsWithIdAfter("id", 1, &Filter{Protocols: []string{"responder"}})
+		require.Nil(t, err, "could not get shared interactions from storage")
+		require.Equal(t, []uint64{3}, interactions.Sequences, "could not filter shared interactions")
+		require.Equal(t, uint64(3), interactions.Cursor, "could not get shared cursor")
+
+		interactions, err = storage.GetInteractionsWithIdAfter("id", 1, &Filter{Limit: 1})
+		require.Nil(t, err, "could not get shared interactions from storage")
+		require.Equal(t, []uint64{2}, interactions.Sequences, "could not limit shared interactions")
+		require.True(t, interactions.HasMore, "could not report more shared interactions")
+
+		// Interactions older than the retention are removed
+		storage.(interface{ removeExpired() }).removeExpired()
+		interactions, err = storage.GetInteractionsWithIdAfter("id", 0, nil)
+		require.Nil(t, err, "could not get shared interactions from storage")
+		require.Equal(t, []uint64{2, 3}, interactions.Sequences, "could not remove interactions older than the retention")
+	})
+}
+
+func TestStorageSubscribe(t *testing.T) {
+	forEachBackend(t, &Options{EvictionTTL: 1 * time.Hour}, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		notify, cancel := storage.Subscribe("id")
+		other, cancelOther := storage.Subscribe("other")
+		defer cancelOther()
+
+		for _, data := range []string{"first", "second"} {
+			err = storage.AddInteractionWithId("id", []byte(data))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+		select {
+		case <-notify:
+		default:
+			require.Fail(t, "could not notify subscriber")
+		}
+		select {
+		case <-notify:
+			require.Fail(t, "could not coalesce notifications")
+		case <-other:
+			require.Fail(t, "could notify subscriber of another id")
+		default:
+		}
+
+		cancel()
+		err = storage.AddInteractionWithId("id", []byte("third"))
+		require.Nil(t, err, "could not add interaction to storage")
+		select {
+		case <-notify:
+			require.Fail(t, "could notify cancelled subscriber")
+		default:
+		}
+	})
+}
+
+func TestStorageQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    Quota
+		expected []string
+		dropped  uint64
+	}{
+		{name: "oldest", quota: Quota{MaxInteractions: 2, DropPolicy: DropOldest}, expected: []string{"second", "third"}, dropped: 1},
+		{name: "newest", quota: Quota{MaxInteractions: 2, DropPolicy: DropNewest}, expected: []string{"first", "second"}, dropped: 1},
+		{name: "global", quota: Quota{MaxTotalBytes: 1}, expected: []string{}, dropped: 3},
+		{name: "unlimited", quota: Quota{}, expected: []string{"first", "second", "third"}},
+	}
+	for _, test := range tests {
+		options := &Options{EvictionTTL: 1 * time.Hour, Quota: test.quota}
+		t.Run(test.name, func(t *testing.T) {
+			forEachBackend(t, options, func(t *testing.T, storage Backend) {
+				err := storage.SetID("id")
+				require.Nil(t, err, "could not set id in storage")
+
+				for _, data := range []string{"first", "second", "third"} {
+					err = storage.AddInteractionWithId("id", []byte(data))
+					require.Nil(t, err, "could not add interaction to storage")
+				}
+				if len(test.expected) > 0 {
+					require.Greater(t, storage.GetCacheMetrics().Size, int64(0), "could not account pending interactions")
+				}
+
+				interactions, err := storage.GetInteractionsAfter("id", "", 0, nil)
+				require.Nil(t, err, "could not get interactions from storage")
+				require.Equal(t, test.expected, interactions.Data, "could not get correct interactions")
+				require.Equal(t, test.dropped, interactions.Dropped, "could not get correct dropped count")
+
+				_, err = storage.GetInteractionsAfter("id", "", interactions.Cursor, nil)
+				require.Nil(t, err, "could not acknowledge interactions")
+				require.Equal(t, int64(0), storage.GetCacheMetrics().Size, "could not release acknowledged interactions")
+			})
+		})
+	}
+}
+
+func TestStorageAEADInteractions(t *testing.T) {
+	storage := New(1 * time.Hour)
+
+	secret := uuid.New().String()
+	correlationID := xid.New().String()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "could not generate rsa key")
+
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(priv.Public())
+	require.Nil(t, err, "could not marshal public key")
+
+	pubkeyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: pubkeyBytes,
+	})
+	encoded := base64.StdEncoding.EncodeToString(pubkeyPem)
+
+	err = storage.Register(&Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: encoded, Version: CryptoVersionAEAD})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	err = storage.Register(&Registration{CorrelationID: xid.New().String(), SecretKey: secret, PublicKey: encoded, Version: 99})
+	require.NotNil(t, err, "could register unsupported crypto version")
+
+	dataOriginal := []byte("hello world, this is unencrypted interaction")
+	err = storage.AddInteraction(correlationID, dataOriginal)
+	require.Nil(t, err, "could not add interaction to storage")
+
+	interactions, err := storage.GetInteractions(correlationID, secret, nil)
+	require.Nil(t, err, "could not get interaction from storage")
+	require.Equal(t, CryptoVersionAEAD, interactions.Version, "could not get correct crypto version")
+
+	decodedKey, err := base64.StdEncoding.DecodeString(interactions.AESKey)
+	require.Nil(t, err, "could not decode key")
+
+	keyPlaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, decodedKey, nil)
+	require.Nil(t, err, "could not decrypt key to plaintext")
+	require.Len(t, keyPlaintext, 32, "could not get 256 bit aes key")
+
+	cipherText, err := base64.StdEncoding.DecodeString(interactions.Data[0])
+	require.Nil(t, err, "could not decode ciphertext")
+
+	block, err := aes.NewCipher(keyPlaintext)
+	require.Nil(t, err, "could not create aes cipher")
+	gcm, err := cipher.NewGCM(block)
+	require.Nil(t, err, "could not create gcm cipher")
+
+	nonce, sealed := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+	decoded, err := gcm.Open(nil, nonce, sealed, nil)
+	require.Nil(t, err, "could not decrypt interaction")
+	require.Equal(t, dataOriginal, decoded, "could not get correct decrypted interaction")
+
+	sealed[0] ^= 0xff
+	_, err = gcm.Open(nil, nonce, sealed, nil)
+	require.NotNil(t, err, "could decrypt tampered interaction")
+}
+
+func TestStorageX25519Registration(t *testing.T) {
+	storage := New(1 * time.Hour)
+
+	secret := uuid.New().String()
+	correlationID := xid.New().String()
+
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+
+	err = storage.Register(&Registration{CorrelationID: xid.New().String(), SecretKey: secret, PublicKey: "aW52YWxpZA==", KeyType: KeyTypeX25519})
+	require.NotNil(t, err, "could register invalid x25519 public key")
+
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+	err = storage.Register(&Registration{CorrelationID: correlationID, SecretKey: secret, PublicKey: encoded, KeyType: KeyTypeX25519, Version: CryptoVersionAEAD})
+	require.Nil(t, err, "could not register correlation-id in storage")
+
+	interactions, err := storage.GetInteractions(correlationID, secret, nil)
+	require.Nil(t, err, "could not get interactions from storage")
+
+	sealed, err := base64.StdEncoding.DecodeString(interactions.AESKey)
+	require.Nil(t, err, "could not decode key")
+
+	keyPlaintext, ok := box.OpenAnonymous(nil, sealed, pub, priv)
+	require.True(t, ok, "could not open sealed key")
+
+	value, err := storage.getCorrelationData(correlationID)
+	require.Nil(t, err, "could not get correlation-id item from storage")
+	require.Equal(t, value.aesKey, keyPlaintext, "could not get correct session key")
+}
+
+func TestStorageSessionTTL(t *testing.T) {
+	options := &Options{EvictionTTL: 2 * time.Hour}
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	forEachBackend(t, options, func(t *testing.T, storage Backend) {
+		short, long := xid.New().String(), xid.New().String()
+		err := storage.Register(&Registration{CorrelationID: short, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519, TTL: 1 * time.Hour, Sliding: true})
+		require.Nil(t, err, "could not register correlation-id in storage")
+		err = storage.Register(&Registration{CorrelationID: long, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519, TTL: 24 * time.Hour})
+		require.Nil(t, err, "could not register correlation-id in storage")
+
+		session, err := storage.GetSession(short, "secret")
+		require.Nil(t, err, "could not get session from storage")
+		require.Equal(t, 1*time.Hour, session.TTL, "could not get requested ttl")
+		require.True(t, session.Sliding, "could not get sliding expiry")
+		require.WithinDuration(t, time.Now().Add(1*time.Hour), session.Expiry, 1*time.Minute, "could not get correct expiry")
+
+		_, err = storage.GetSession(short, "wrong-secret")
+		require.NotNil(t, err, "could get session with invalid secret")
+
+		session, err = storage.GetSession(long, "secret")
+		require.Nil(t, err, "could not get session from storage")
+		require.Equal(t, 2*time.Hour, session.TTL, "could not bound requested ttl")
+		expiry := session.Expiry
+
+		// Only sliding sessions are refreshed by polls
+		time.Sleep(10 * time.Millisecond)
+		_, err = storage.GetInteractionsAfter(long, "secret", 0, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		session, err = storage.GetSession(long, "secret")
+		require.Nil(t, err, "could not get session from storage")
+		require.Equal(t, expiry, session.Expiry, "could refresh non sliding session")
+
+		session, err = storage.GetSession(short, "secret")
+		require.Nil(t, err, "could not get session from storage")
+		expiry = session.Expiry
+		time.Sleep(10 * time.Millisecond)
+		_, err = storage.GetInteractionsAfter(short, "secret", 0, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		session, err = storage.GetSession(short, "secret")
+		require.Nil(t, err, "could not get session from storage")
+		require.True(t, session.Expiry.After(expiry), "could not refresh sliding session")
+	})
+}
+
+func TestStorageEvictionEvents(t *testing.T) {
+	events := make(chan *EvictionEvent, 10)
+	options := &Options{EvictionTTL: 50 * time.Millisecond, OnEviction: func(event *EvictionEvent) {
+		events <- event
+	}}
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	nextEvent := func(t *testing.T) *EvictionEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "could not get eviction event")
+			return nil
+		}
+	}
+
+	forEachBackend(t, options, func(t *testing.T, storage Backend) {
+		_, err := storage.GetInteractions(xid.New().String(), "secret", nil)
+		reason, evicted := IsSessionEvicted(err)
+		require.True(t, evicted, "could not get missing session error")
+		require.Empty(t, reason, "could get reason for unknown session")
+
+		deregistered, expired := xid.New().String(), xid.New().String()
+		for _, correlationID := range []string{deregistered, expired} {
+			err = storage.Register(&Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519})
+			require.Nil(t, err, "could not register correlation-id in storage")
+		}
+
+		err = storage.RemoveID(deregistered, "secret")
+		require.Nil(t, err, "could not remove correlation-id from storage")
+		event := nextEvent(t)
+		require.Equal(t, deregistered, event.CorrelationID, "could not get evicted correlation-id")
+		require.Equal(t, EvictionDeregister, event.Reason, "could not get deregister reason")
+
+		_, err = storage.GetInteractions(deregistered, "secret", nil)
+		reason, evicted = IsSessionEvicted(err)
+		require.True(t, evicted, "could not get evicted session error")
+		require.Equal(t, EvictionDeregister, reason, "could not get deregister reason")
+
+		time.Sleep(100 * time.Millisecond)
+		storage.(interface{ removeExpired() }).removeExpired()
+		event = nextEvent(t)
+		require.Equal(t, expired, event.CorrelationID, "could not get evicted correlation-id")
+		require.Equal(t, EvictionTTL, event.Reason, "could not get ttl reason")
+
+		_, err = storage.GetInteractionsAfter(expired, "secret", 0, nil)
+		reason, evicted = IsSessionEvicted(err)
+		require.True(t, evicted, "could not get evicted session error")
+		require.Equal(t, EvictionTTL, reason, "could not get ttl reason")
+		require.Equal(t, int64(1), storage.GetCacheMetrics().Evictions[EvictionTTL], "could not count evicted session")
+	})
+}
+
+func TestStorageSessionAdministration(t *testing.T) {
+	options := &Options{EvictionTTL: 1 * time.Hour}
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	forEachBackend(t, options, func(t *testing.T, storage Backend) {
+		err := storage.SetID("id")
+		require.Nil(t, err, "could not set id in storage")
+
+		purged, evicted := xid.New().String(), xid.New().String()
+		for _, correlationID := range []string{purged, evicted} {
+			err = storage.Register(&Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519, Owner: "scanner", Webhook: "https://example.com/" + correlationID})
+			require.Nil(t, err, "could not register correlation-id in storage")
+		}
+		for i := 0; i < 2; i++ {
+			err = storage.AddInteraction(purged, []byte(`{"protocol":"dns"}`))
+			require.Nil(t, err, "could not add interaction to storage")
+		}
+
+		sessions, err := storage.ListSessions()
+		require.Nil(t, err, "could not list sessions")
+		require.Len(t, sessions, 2, "could not list only registered sessions")
+		info, err := storage.GetSessionInfo(purged)
+		require.Nil(t, err, "could not get session info")
+		require.Equal(t, "scanner", info.Owner, "could not get session owner")
+		require.Equal(t, "https://example.com/"+purged, info.Webhook, "could not get session webhook")
+		require.Equal(t, 2, info.Pending, "could not get pending interactions")
+		require.Positive(t, info.Size, "could not get pending size")
+		require.WithinDuration(t, time.Now(), info.Created, time.Minute, "could not get creation time")
+
+		// purged sessions keep their cursors
+		err = storage.PurgeSession(purged)
+		require.Nil(t, err, "could not purge session")
+		info, err = storage.GetSessionInfo(purged)
+		require.Nil(t, err, "could not get session info")
+		require.Zero(t, info.Pending, "could not purge pending interactions")
+		require.Zero(t, storage.GetCacheMetrics().Size, "could not account purged interactions")
+		err = storage.AddInteraction(purged, []byte(`{"protocol":"http"}`))
+		require.Nil(t, err, "could not add interaction to storage")
+		interactions, err := storage.GetInteractionsAfter(purged, "secret", 0, nil)
+		require.Nil(t, err, "could not get interactions from storage")
+		require.Equal(t, []uint64{3}, interactions.Sequences, "could not keep sequence of purged session")
+
+		err = storage.EvictSession(evicted)
+		require.Nil(t, err, "could not evict session")
+		_, err = storage.GetInteractions(evicted, "secret", nil)
+		reason, ok := IsSessionEvicted(err)
+		require.True(t, ok, "could not get evicted session error")
+		require.Equal(t, EvictionAdmin, reason, "could not get admin reason")
+
+		require.NotNil(t, storage.EvictSession("id"), "could evict id bucket")
+
+		webhooks, err := storage.ListWebhooks()
+		require.Nil(t, err, "could not list webhooks")
+		require.Equal(t, []*Webhook{{CorrelationID: purged, SecretKey: "secret", URL: "https://example.com/" + purged}}, webhooks, "could not list webhooks of registered sessions")
+	})
+}
+
+func TestStorageCounters(t *testing.T) {
+	options := &Options{EvictionTTL: 1 * time.Hour}
+
+	pub, _, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err, "could not generate x25519 key")
+	encoded := base64.StdEncoding.EncodeToString(pub[:])
+
+	forEachBackend(t, options, func(t *testing.T, storage Backend) {
+		correlationID := xid.New().String()
+		err := storage.Register(&Registration{CorrelationID: correlationID, SecretKey: "secret", PublicKey: encoded, KeyType: KeyTypeX25519})
+		require.Nil(t, err, "could not register correlation-id in storage")
+
+		for i := uint64(1); i <= 3; i++ {
+			count, err := storage.IncrementCounter(correlationID, "a")
+			require.Nil(t, err, "could not increment counter")
+			require.Equal(t, i, count, "could not get incremented counter")
+		}
+		count, err := storage.IncrementCounter(correlationID, "b")
+		require.Nil(t, err, "could not increment counter")
+		require.Equal(t, uint64(1), count, "could not get counter of new key")
+
+		for i := 0; i < maxSessionCounters; i++ {
+			_, err = storage.IncrementCounter(correlationID, fmt.Sprintf("key-%d", i))
+		}
+		require.Equal(t, ErrTooManyCounters, err, "could add counters beyond the maximum")
+
+		_, err = storage.IncrementCounter(xid.New().String(), "a")
+		require.NotNil(t, err, "could increment counter of unknown session")
+	})
+}